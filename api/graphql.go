@@ -0,0 +1,533 @@
+package api
+
+import (
+	"avax-indexer/db"
+	"context"
+	_ "embed"
+	"github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// maxQueryDepth limits how deep the nested resolution
+// block -> transactions -> account -> transactions -> ... may go
+const maxQueryDepth = 10
+
+// maxQueryParallelism limits how many fields of a query are resolved concurrently
+const maxQueryParallelism = 10
+
+// maxNestedPageSize caps the page size of the connections of accounts reached through
+// another object, whose pages multiply with the page of their parent
+const maxNestedPageSize = 10
+
+// maxQueryCost is the cost budget of a single query
+// Every lookup costs 1 and every page costs its page size, so the pages
+// nested down the tree multiply until the budget runs out
+const maxQueryCost = 1000
+
+//go:embed schema.graphql
+var schema string
+
+// newGraphQLHandler parses the schema and returns a handler serving it over the repo
+func newGraphQLHandler(repo db.BlocksRepo) http.Handler {
+	s := graphql.MustParseSchema(schema, &queryResolver{repo: repo},
+		graphql.MaxDepth(maxQueryDepth),
+		graphql.MaxParallelism(maxQueryParallelism))
+	return &costHandler{next: &relay.Handler{Schema: s}}
+}
+
+// costKey is the context key of the cost budget of a query
+type costKey struct{}
+
+// queryCost is the remaining cost budget of a query, shared by its concurrently running resolvers
+type queryCost struct {
+	remaining atomic.Int64
+}
+
+// costHandler gives every query its own cost budget
+type costHandler struct {
+	next http.Handler
+}
+
+func (h *costHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cost := &queryCost{}
+	cost.remaining.Store(maxQueryCost)
+	h.next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), costKey{}, cost)))
+}
+
+// spend takes n from the cost budget of the query before a resolver queries the repo,
+// failing once the budget is exhausted
+func spend(ctx context.Context, n int) error {
+	cost, ok := ctx.Value(costKey{}).(*queryCost)
+	if !ok {
+		return nil
+	}
+	if cost.remaining.Add(-int64(n)) < 0 {
+		return errors.Errorf("query exceeds the maximum cost of %d", maxQueryCost)
+	}
+	return nil
+}
+
+// queryResolver resolves the root Query type
+type queryResolver struct {
+	repo db.BlocksRepo
+}
+
+// Block resolves a block by hash or number, or the latest block if neither is given
+func (q *queryResolver) Block(ctx context.Context, args struct {
+	Number *Long
+	Hash   *Bytes32
+}) (*blockResolver, error) {
+	if err := spend(ctx, 1); err != nil {
+		return nil, err
+	}
+	if args.Hash != nil {
+		return resolveBlockByHash(ctx, q.repo, string(*args.Hash))
+	}
+
+	var number int64
+	if args.Number != nil {
+		number = int64(*args.Number)
+	} else {
+		head, err := q.repo.LastHead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		number = head
+	}
+
+	blocks, err := q.repo.FindByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, nil
+	}
+	return &blockResolver{repo: q.repo, block: &blocks[0]}, nil
+}
+
+// Blocks resolves a page of blocks in the number and timestamp ranges
+func (q *queryResolver) Blocks(ctx context.Context, args struct {
+	From          *Long
+	To            *Long
+	FromTimestamp *Long
+	ToTimestamp   *Long
+	First         int32
+	After         *string
+}) (*blockConnectionResolver, error) {
+	limit, err := pageSize(args.First, maxPageSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := spend(ctx, limit); err != nil {
+		return nil, err
+	}
+
+	filter := db.BlockFilter{
+		FromNumber: optionalLong(args.From),
+		ToNumber:   optionalLong(args.To),
+		FromTime:   optionalLong(args.FromTimestamp),
+		ToTime:     optionalLong(args.ToTimestamp),
+	}
+	if args.After != nil {
+		after, err := strconv.ParseInt(*args.After, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		// Pages go from the newest block to the oldest, so the next page ends right below the cursor
+		if before := after - 1; filter.ToNumber == nil || before < *filter.ToNumber {
+			filter.ToNumber = &before
+		}
+	}
+
+	blocks, err := q.repo.FindBlocks(ctx, filter, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &blockConnectionResolver{nodes: make([]*blockResolver, len(blocks))}
+	for i := range blocks {
+		res.nodes[i] = &blockResolver{repo: q.repo, block: &blocks[i]}
+	}
+	if len(blocks) == limit {
+		cursor := strconv.Itoa(blocks[len(blocks)-1].Number)
+		res.nextCursor = &cursor
+	}
+	return res, nil
+}
+
+// Transaction resolves a transaction by hash
+func (q *queryResolver) Transaction(ctx context.Context, args struct{ Hash Bytes32 }) (*transactionResolver, error) {
+	if err := spend(ctx, 1); err != nil {
+		return nil, err
+	}
+	tx, err := q.repo.FindTransaction(ctx, string(args.Hash))
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &transactionResolver{repo: q.repo, tx: tx}, nil
+}
+
+// Account resolves an account by address
+func (q *queryResolver) Account(args struct{ Address Address }) *accountResolver {
+	return &accountResolver{repo: q.repo, address: string(args.Address), root: true}
+}
+
+// blockResolver resolves the Block type
+type blockResolver struct {
+	repo  db.BlocksRepo
+	block *db.Block
+}
+
+func (b *blockResolver) Number() Long              { return Long(b.block.Number) }
+func (b *blockResolver) Hash() Bytes32             { return Bytes32(b.block.Hash) }
+func (b *blockResolver) Nonce() Bytes              { return Bytes(b.block.Nonce) }
+func (b *blockResolver) TransactionsRoot() Bytes32 { return Bytes32(b.block.TransactionsRoot) }
+func (b *blockResolver) StateRoot() Bytes32        { return Bytes32(b.block.StateRoot) }
+func (b *blockResolver) ExtraData() Bytes          { return Bytes(b.block.ExtraData) }
+func (b *blockResolver) GasLimit() Long            { return Long(b.block.GasLimit) }
+func (b *blockResolver) GasUsed() Long             { return Long(b.block.GasUsed) }
+func (b *blockResolver) Timestamp() Long           { return Long(b.block.Timestamp) }
+func (b *blockResolver) LogsBloom() Bytes          { return Bytes(b.block.LogsBloom) }
+func (b *blockResolver) Difficulty() BigInt        { return BigInt(b.block.Difficulty) }
+func (b *blockResolver) TotalDifficulty() BigInt   { return BigInt(b.block.TotalDifficulty) }
+
+// Parent resolves the parent block if it is still stored
+func (b *blockResolver) Parent(ctx context.Context) (*blockResolver, error) {
+	return resolveBlockByHash(ctx, b.repo, b.block.ParentHash)
+}
+
+// Miner resolves the account that produced the block
+func (b *blockResolver) Miner() *accountResolver {
+	return &accountResolver{repo: b.repo, address: strings.ToLower(b.block.Miner)}
+}
+
+// TransactionCount resolves the number of transactions in the block
+func (b *blockResolver) TransactionCount() *int32 {
+	n := int32(len(b.block.Transactions))
+	return &n
+}
+
+// Transactions resolves the transactions stored in the block
+func (b *blockResolver) Transactions() *[]*transactionResolver {
+	res := make([]*transactionResolver, len(b.block.Transactions))
+	for i := range b.block.Transactions {
+		res[i] = &transactionResolver{repo: b.repo, tx: &b.block.Transactions[i], block: b}
+	}
+	return &res
+}
+
+// TransactionAt resolves the transaction at the given index in the block
+func (b *blockResolver) TransactionAt(args struct{ Index int32 }) *transactionResolver {
+	if args.Index < 0 || int(args.Index) >= len(b.block.Transactions) {
+		return nil
+	}
+	return &transactionResolver{repo: b.repo, tx: &b.block.Transactions[args.Index], block: b}
+}
+
+// transactionResolver resolves the Transaction type
+// block is set when the transaction was resolved through its block
+type transactionResolver struct {
+	repo  db.BlocksRepo
+	tx    *db.Transaction
+	block *blockResolver
+}
+
+func (t *transactionResolver) Hash() Bytes32    { return Bytes32(t.tx.Hash) }
+func (t *transactionResolver) Nonce() Long      { return Long(t.tx.Nonce) }
+func (t *transactionResolver) Value() BigInt    { return BigInt(t.tx.Value) }
+func (t *transactionResolver) GasPrice() BigInt { return BigInt(t.tx.GasPrice) }
+func (t *transactionResolver) Gas() Long        { return Long(t.tx.Gas) }
+func (t *transactionResolver) InputData() Bytes { return Bytes(t.tx.Input) }
+
+// Index resolves the position of the transaction in its block
+func (t *transactionResolver) Index() *Long {
+	return optionalInt(t.tx.TransactionIndex)
+}
+
+// From resolves the sender account
+func (t *transactionResolver) From() *accountResolver {
+	return &accountResolver{repo: t.repo, address: strings.ToLower(t.tx.From)}
+}
+
+// To resolves the recipient account, which is null for contract creations
+func (t *transactionResolver) To() *accountResolver {
+	if t.tx.To == "" {
+		return nil
+	}
+	return &accountResolver{repo: t.repo, address: strings.ToLower(t.tx.To)}
+}
+
+// Block resolves the block containing the transaction
+func (t *transactionResolver) Block(ctx context.Context) (*blockResolver, error) {
+	if t.block != nil {
+		return t.block, nil
+	}
+	return resolveBlockByHash(ctx, t.repo, t.tx.BlockHash)
+}
+
+// Status resolves the receipt status
+func (t *transactionResolver) Status() *Long {
+	return optionalInt(t.tx.Status)
+}
+
+// GasUsed resolves the gas used by the transaction
+func (t *transactionResolver) GasUsed() *Long {
+	if t.tx.GasUsed == 0 {
+		return nil
+	}
+	l := Long(t.tx.GasUsed)
+	return &l
+}
+
+// CumulativeGasUsed resolves the gas used in the block up to and including the transaction
+func (t *transactionResolver) CumulativeGasUsed() *Long {
+	if t.tx.CumulativeGasUsed == 0 {
+		return nil
+	}
+	l := Long(t.tx.CumulativeGasUsed)
+	return &l
+}
+
+// EffectiveGasPrice resolves the price per gas paid by the transaction
+func (t *transactionResolver) EffectiveGasPrice() *BigInt {
+	if t.tx.EffectiveGasPrice == "" {
+		return nil
+	}
+	b := BigInt(t.tx.EffectiveGasPrice)
+	return &b
+}
+
+// CreatedContract resolves the contract created by the transaction, if any
+func (t *transactionResolver) CreatedContract() *accountResolver {
+	if t.tx.ContractAddress == "" {
+		return nil
+	}
+	return &accountResolver{repo: t.repo, address: strings.ToLower(t.tx.ContractAddress)}
+}
+
+// accountResolver resolves the Account type
+// root is set when the account was queried directly rather than reached through another object
+type accountResolver struct {
+	repo    db.BlocksRepo
+	address string
+	root    bool
+}
+
+// Address resolves the account address
+func (a *accountResolver) Address() Address {
+	return Address(a.address)
+}
+
+// pageSize validates the requested page size of the account's connections and spends it from the cost budget
+// Pages are capped at maxNestedPageSize unless the account was queried directly
+func (a *accountResolver) pageSize(ctx context.Context, first int32) (int, error) {
+	maxSize := maxNestedPageSize
+	if a.root {
+		maxSize = maxPageSize
+	}
+	limit, err := pageSize(first, maxSize)
+	if err != nil {
+		return 0, err
+	}
+	if err := spend(ctx, limit); err != nil {
+		return 0, err
+	}
+	return limit, nil
+}
+
+// Transactions resolves a page of the transactions sent from or to the account
+func (a *accountResolver) Transactions(ctx context.Context, args struct {
+	First int32
+	After *string
+}) (*transactionConnectionResolver, error) {
+	limit, err := a.pageSize(ctx, args.First)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor *db.TxCursor
+	if args.After != nil {
+		cursor, err = db.ParseTxCursor(*args.After)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+	}
+
+	txs, err := a.repo.FindAddressTransactions(ctx, a.address, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &transactionConnectionResolver{nodes: make([]*transactionResolver, len(txs))}
+	for i := range txs {
+		res.nodes[i] = &transactionResolver{repo: a.repo, tx: &txs[i]}
+	}
+	if len(txs) == limit {
+		next := db.NewTxCursor(&txs[len(txs)-1]).String()
+		res.nextCursor = &next
+	}
+	return res, nil
+}
+
+// Activity resolves a page of the transactions sent from or to the account, as seen from it
+func (a *accountResolver) Activity(ctx context.Context, args struct {
+	Blocks *Long
+	First  int32
+	After  *string
+}) (*activityConnectionResolver, error) {
+	limit, err := a.pageSize(ctx, args.First)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor *db.TxCursor
+	if args.After != nil {
+		cursor, err = db.ParseTxCursor(*args.After)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+	}
+
+	var blocks *int64
+	if args.Blocks != nil {
+		if *args.Blocks <= 0 {
+			return nil, errors.New("blocks must be a positive number")
+		}
+		n := int64(*args.Blocks)
+		blocks = &n
+	}
+	fromBlock, err := activityStart(ctx, a.repo, blocks)
+	if err != nil {
+		return nil, err
+	}
+
+	activity, err := a.repo.FindAddressActivity(ctx, a.address, fromBlock, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &activityConnectionResolver{nodes: make([]*activityResolver, len(activity))}
+	for i := range activity {
+		res.nodes[i] = &activityResolver{repo: a.repo, activity: &activity[i]}
+	}
+	if len(activity) == limit {
+		next := activity[len(activity)-1].Cursor().String()
+		res.nextCursor = &next
+	}
+	return res, nil
+}
+
+// activityResolver resolves the Activity type
+type activityResolver struct {
+	repo     db.BlocksRepo
+	activity *db.Activity
+}
+
+func (a *activityResolver) BlockNumber() Long { return Long(a.activity.BlockNumber) }
+func (a *activityResolver) Index() Long       { return Long(a.activity.TransactionIndex) }
+func (a *activityResolver) Timestamp() Long   { return Long(a.activity.Timestamp) }
+func (a *activityResolver) Direction() string { return strings.ToUpper(a.activity.Direction) }
+func (a *activityResolver) Value() BigInt     { return BigInt(a.activity.Value) }
+func (a *activityResolver) Status() *Long     { return optionalInt(a.activity.Status) }
+
+// Transaction resolves the activity's transaction, or null if it is no longer stored
+func (a *activityResolver) Transaction(ctx context.Context) (*transactionResolver, error) {
+	if err := spend(ctx, 1); err != nil {
+		return nil, err
+	}
+	tx, err := a.repo.FindTransaction(ctx, a.activity.Hash)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &transactionResolver{repo: a.repo, tx: tx}, nil
+}
+
+// Counterparty resolves the other side of the transaction
+func (a *activityResolver) Counterparty() *accountResolver {
+	if a.activity.Counterparty == "" {
+		return nil
+	}
+	return &accountResolver{repo: a.repo, address: strings.ToLower(a.activity.Counterparty)}
+}
+
+// Fee resolves the fee paid, or null until the receipt is indexed
+func (a *activityResolver) Fee() *BigInt {
+	if a.activity.Fee == "" {
+		return nil
+	}
+	fee := BigInt(a.activity.Fee)
+	return &fee
+}
+
+// activityConnectionResolver resolves the ActivityConnection type
+type activityConnectionResolver struct {
+	nodes      []*activityResolver
+	nextCursor *string
+}
+
+func (c *activityConnectionResolver) Nodes() []*activityResolver { return c.nodes }
+func (c *activityConnectionResolver) NextCursor() *string        { return c.nextCursor }
+
+// blockConnectionResolver resolves the BlockConnection type
+type blockConnectionResolver struct {
+	nodes      []*blockResolver
+	nextCursor *string
+}
+
+func (c *blockConnectionResolver) Nodes() []*blockResolver { return c.nodes }
+func (c *blockConnectionResolver) NextCursor() *string     { return c.nextCursor }
+
+// transactionConnectionResolver resolves the TransactionConnection type
+type transactionConnectionResolver struct {
+	nodes      []*transactionResolver
+	nextCursor *string
+}
+
+func (c *transactionConnectionResolver) Nodes() []*transactionResolver { return c.nodes }
+func (c *transactionConnectionResolver) NextCursor() *string           { return c.nextCursor }
+
+// resolveBlockByHash resolves a stored block by hash, or null if it is not stored
+func resolveBlockByHash(ctx context.Context, repo db.BlocksRepo, hash string) (*blockResolver, error) {
+	if err := spend(ctx, 1); err != nil {
+		return nil, err
+	}
+	block, err := repo.FindByHash(ctx, hash)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &blockResolver{repo: repo, block: block}, nil
+}
+
+// pageSize validates the requested page size and caps it at maxSize
+func pageSize(first int32, maxSize int) (int, error) {
+	if first <= 0 {
+		return 0, errors.New("first must be a positive number")
+	}
+	if int(first) > maxSize {
+		return maxSize, nil
+	}
+	return int(first), nil
+}
+
+// optionalInt converts an optional stored integer into an optional Long
+func optionalInt(n *int) *Long {
+	if n == nil {
+		return nil
+	}
+	l := Long(*n)
+	return &l
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Long is the GraphQL Long scalar
+type Long int64
+
+// ImplementsGraphQLType maps the type to the Long scalar
+func (Long) ImplementsGraphQLType(name string) bool {
+	return name == "Long"
+}
+
+// UnmarshalGraphQL accepts a number or a decimal or 0x-prefixed hex string
+func (l *Long) UnmarshalGraphQL(input interface{}) error {
+	switch v := input.(type) {
+	case int32:
+		*l = Long(v)
+	case int64:
+		*l = Long(v)
+	case float64:
+		*l = Long(v)
+	case string:
+		n, err := parseNumber(v)
+		if err != nil {
+			return fmt.Errorf("invalid Long %q", v)
+		}
+		*l = Long(n)
+	default:
+		return fmt.Errorf("wrong type for Long: %T", v)
+	}
+	return nil
+}
+
+// BigInt is the GraphQL BigInt scalar
+type BigInt string
+
+// ImplementsGraphQLType maps the type to the BigInt scalar
+func (BigInt) ImplementsGraphQLType(name string) bool {
+	return name == "BigInt"
+}
+
+// UnmarshalGraphQL accepts a decimal string
+func (b *BigInt) UnmarshalGraphQL(input interface{}) error {
+	s, ok := input.(string)
+	if !ok {
+		return fmt.Errorf("wrong type for BigInt: %T", input)
+	}
+	*b = BigInt(s)
+	return nil
+}
+
+// Bytes is the GraphQL Bytes scalar
+type Bytes string
+
+// ImplementsGraphQLType maps the type to the Bytes scalar
+func (Bytes) ImplementsGraphQLType(name string) bool {
+	return name == "Bytes"
+}
+
+// UnmarshalGraphQL accepts a 0x-prefixed hex string
+func (b *Bytes) UnmarshalGraphQL(input interface{}) error {
+	s, err := unmarshalHex("Bytes", input, -1)
+	*b = Bytes(s)
+	return err
+}
+
+// Bytes32 is the GraphQL Bytes32 scalar
+type Bytes32 string
+
+// ImplementsGraphQLType maps the type to the Bytes32 scalar
+func (Bytes32) ImplementsGraphQLType(name string) bool {
+	return name == "Bytes32"
+}
+
+// UnmarshalGraphQL accepts a 0x-prefixed 32 byte hex string
+func (b *Bytes32) UnmarshalGraphQL(input interface{}) error {
+	s, err := unmarshalHex("Bytes32", input, 32)
+	*b = Bytes32(s)
+	return err
+}
+
+// Address is the GraphQL Address scalar
+type Address string
+
+// ImplementsGraphQLType maps the type to the Address scalar
+func (Address) ImplementsGraphQLType(name string) bool {
+	return name == "Address"
+}
+
+// UnmarshalGraphQL accepts a 0x-prefixed 20 byte hex string
+func (a *Address) UnmarshalGraphQL(input interface{}) error {
+	s, err := unmarshalHex("Address", input, 20)
+	*a = Address(s)
+	return err
+}
+
+// unmarshalHex validates a 0x-prefixed hex input of the given byte size and lowercases it
+// A negative size accepts any length
+func unmarshalHex(scalar string, input interface{}, size int) (string, error) {
+	s, ok := input.(string)
+	if !ok {
+		return "", fmt.Errorf("wrong type for %s: %T", scalar, input)
+	}
+	if !isHex(s, size) {
+		return "", fmt.Errorf("invalid %s %q", scalar, s)
+	}
+	return strings.ToLower(s), nil
+}
+
+// optionalLong converts an optional Long argument into an optional int64
+func optionalLong(l *Long) *int64 {
+	if l == nil {
+		return nil
+	}
+	n := int64(*l)
+	return &n
+}
@@ -0,0 +1,453 @@
+package api
+
+import (
+	"avax-indexer/db"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 25
+	maxPageSize     = 100
+)
+
+// Server is a read-only HTTP API over the indexed blocks
+// All reads go through the storage layer. The balance deltas and contracts repositories are nil
+// if the storage backend does not provide them
+type Server struct {
+	repo      db.BlocksRepo
+	balances  db.BalanceDeltasRepo
+	contracts db.ContractsRepo
+	srv       *http.Server
+}
+
+// NewServer initializes a new API server listening on the given address
+func NewServer(addr string, repo db.BlocksRepo, balances db.BalanceDeltasRepo, contracts db.ContractsRepo) *Server {
+	s := &Server{repo: repo, balances: balances, contracts: contracts}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blocks/", s.handleBlock)
+	mux.HandleFunc("/tx/", s.handleTx)
+	mux.HandleFunc("/address/", s.handleAddress)
+	mux.HandleFunc("/contracts/", s.handleContract)
+	mux.Handle("/graphql", newGraphQLHandler(repo))
+
+	s.srv = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// Handle registers an additional handler on the server's mux
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.srv.Handler.(*http.ServeMux).Handle(pattern, handler)
+}
+
+// ListenAndServe serves the API until the server is shut down
+func (s *Server) ListenAndServe() error {
+	slog.Info("serving http api", "addr", s.srv.Addr)
+	if err := s.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return errors.Wrap(err, "failed to serve http api")
+	}
+	return nil
+}
+
+// Shutdown gracefully stops the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// handleBlock serves GET /blocks/latest and GET /blocks/{number|hash}
+func (s *Server) handleBlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	id := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/blocks/"))
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, db.ErrNotFound)
+		return
+	}
+
+	if isHash(id) {
+		block, err := s.repo.FindByHash(r.Context(), id)
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, block)
+		return
+	}
+
+	var number int64
+	if id == "latest" {
+		head, err := s.repo.LastHead(r.Context())
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		number = head
+	} else {
+		n, err := parseNumber(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("block id must be a number, a hash or latest"))
+			return
+		}
+		number = n
+	}
+
+	blocks, err := s.repo.FindByNumber(r.Context(), number)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	if len(blocks) == 0 {
+		writeError(w, http.StatusNotFound, db.ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, blocks[0])
+}
+
+// handleTx serves GET /tx/{hash}
+func (s *Server) handleTx(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	hash := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/tx/"))
+	if !isHash(hash) {
+		writeError(w, http.StatusBadRequest, errors.New("invalid transaction hash"))
+		return
+	}
+
+	tx, err := s.repo.FindTransaction(r.Context(), hash)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tx)
+}
+
+// contractResponse is a contract with its runtime code
+type contractResponse struct {
+	*db.Contract
+	Code string `json:"code"`
+}
+
+// codeResponse is runtime code with the contracts deployed with it
+type codeResponse struct {
+	*db.Bytecode
+	Contracts []db.Contract `json:"contracts"`
+}
+
+// handleContract serves GET /contracts/{address} and GET /contracts/{codehash}?limit=
+func (s *Server) handleContract(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if s.contracts == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("contracts are not indexed by this storage backend"))
+		return
+	}
+
+	id := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/contracts/"))
+	switch {
+	case isAddress(id):
+		contract, err := s.contracts.FindByAddress(r.Context(), id)
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		code, err := s.contracts.FindCode(r.Context(), contract.CodeHash)
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, contractResponse{Contract: contract, Code: code.Code})
+	case isHash(id):
+		limit, err := parseLimit(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		code, err := s.contracts.FindCode(r.Context(), id)
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		contracts, err := s.contracts.FindByCodeHash(r.Context(), id, limit)
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, codeResponse{Bytecode: code, Contracts: contracts})
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("contract id must be an address or a code hash"))
+	}
+}
+
+// addressTxsResponse is a page of an address's transactions
+type addressTxsResponse struct {
+	Transactions []db.Transaction `json:"transactions"`
+	NextCursor   string           `json:"next_cursor,omitempty"`
+}
+
+// addressActivityResponse is a page of an address's activity
+type addressActivityResponse struct {
+	Activity   []db.Activity `json:"activity"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// handleAddress serves GET /address/{addr}/txs?cursor=&limit=,
+// GET /address/{addr}/activity?blocks=&cursor=&limit= and GET /address/{addr}/balance-deltas?from=&to=
+func (s *Server) handleAddress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/address/"), "/")
+	if len(parts) != 2 || (parts[1] != "txs" && parts[1] != "activity" && parts[1] != "balance-deltas") {
+		writeError(w, http.StatusNotFound, db.ErrNotFound)
+		return
+	}
+	address := strings.ToLower(parts[0])
+	if !isAddress(address) {
+		writeError(w, http.StatusBadRequest, errors.New("invalid address"))
+		return
+	}
+
+	if parts[1] == "balance-deltas" {
+		s.handleBalanceDeltas(w, r, address)
+		return
+	}
+
+	cursor, limit, err := parsePage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if parts[1] == "activity" {
+		s.handleActivity(w, r, address, cursor, limit)
+		return
+	}
+
+	txs, err := s.repo.FindAddressTransactions(r.Context(), address, cursor, limit)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	res := addressTxsResponse{Transactions: txs}
+	if len(txs) == limit {
+		res.NextCursor = db.NewTxCursor(&txs[len(txs)-1]).String()
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleActivity serves a page of an address's activity, limited to the last blocks stored blocks
+// if the blocks query parameter is given
+func (s *Server) handleActivity(w http.ResponseWriter, r *http.Request, address string, cursor *db.TxCursor, limit int) {
+	var blocks *int64
+	if b := r.URL.Query().Get("blocks"); b != "" {
+		n, err := strconv.ParseInt(b, 10, 64)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("blocks must be a positive number"))
+			return
+		}
+		blocks = &n
+	}
+
+	fromBlock, err := activityStart(r.Context(), s.repo, blocks)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	activity, err := s.repo.FindAddressActivity(r.Context(), address, fromBlock, cursor, limit)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	res := addressActivityResponse{Activity: activity}
+	if len(activity) == limit {
+		res.NextCursor = activity[len(activity)-1].Cursor().String()
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// activityStart returns the first block of the activity covering the last blocks stored blocks,
+// or 0 for all stored blocks if blocks is nil
+func activityStart(ctx context.Context, repo db.BlocksRepo, blocks *int64) (int64, error) {
+	if blocks == nil {
+		return 0, nil
+	}
+
+	head, err := repo.LastHead(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return head - *blocks + 1, nil
+}
+
+// handleBalanceDeltas serves the sum of an address's balance deltas over a block range
+// The range defaults to the stored window
+func (s *Server) handleBalanceDeltas(w http.ResponseWriter, r *http.Request, address string) {
+	if s.balances == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("balance deltas are not indexed by this storage backend"))
+		return
+	}
+
+	from, to, err := parseRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if from == nil {
+		first, err := s.repo.FirstHead(r.Context())
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		from = &first
+	}
+	if to == nil {
+		head, err := s.repo.LastHead(r.Context())
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		to = &head
+	}
+	if *from > *to {
+		writeError(w, http.StatusBadRequest, errors.New("from must not be after to"))
+		return
+	}
+
+	sum, err := s.balances.SumBalanceDeltas(r.Context(), address, *from, *to)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sum)
+}
+
+// parseRange parses the from and to block number query parameters, which are nil if missing
+func parseRange(r *http.Request) (*int64, *int64, error) {
+	bounds := make([]*int64, 2)
+	for i, name := range []string{"from", "to"} {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := parseNumber(v)
+		if err != nil || n < 0 {
+			return nil, nil, errors.Errorf("%s must be a block number", name)
+		}
+		bounds[i] = &n
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// parsePage parses the cursor and limit query parameters
+func parsePage(r *http.Request) (*db.TxCursor, int, error) {
+	limit, err := parseLimit(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var cursor *db.TxCursor
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		parsed, err := db.ParseTxCursor(c)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "invalid cursor")
+		}
+		cursor = parsed
+	}
+
+	return cursor, limit, nil
+}
+
+// parseLimit parses the limit query parameter, capped at maxPageSize
+func parseLimit(r *http.Request) (int, error) {
+	limit := defaultPageSize
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return 0, errors.New("limit must be a positive number")
+		}
+		limit = n
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return limit, nil
+}
+
+// parseNumber parses a decimal or 0x prefixed hex block number
+func parseNumber(s string) (int64, error) {
+	if strings.HasPrefix(s, "0x") {
+		return strconv.ParseInt(s[2:], 16, 64)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// isHash reports whether s is a 32 byte hex hash
+func isHash(s string) bool {
+	return isHex(s, 32)
+}
+
+// isAddress reports whether s is a 20 byte hex address
+func isAddress(s string) bool {
+	return isHex(s, 20)
+}
+
+// isHex reports whether s is a 0x-prefixed hex string of size bytes, or of any size if size is negative
+func isHex(s string, size int) bool {
+	if !strings.HasPrefix(s, "0x") || (size >= 0 && len(s) != 2+2*size) {
+		return false
+	}
+	for _, c := range s[2:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeRepoError maps storage errors to HTTP errors
+func writeRepoError(w http.ResponseWriter, err error) {
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	slog.Error("failed to read from storage", "error", err)
+	writeError(w, http.StatusInternalServerError, errors.New("internal error"))
+}
+
+// writeError writes an error response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to write response", "error", err)
+	}
+}
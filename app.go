@@ -0,0 +1,224 @@
+package main
+
+import (
+	"avax-indexer/common"
+	"avax-indexer/db"
+	"avax-indexer/rpc"
+	"context"
+	"database/sql"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"time"
+)
+
+// receiptWorkers is the number of blocks whose receipts are fetched concurrently
+const receiptWorkers = 8
+
+// traceWorkers is the number of blocks traced concurrently
+const traceWorkers = 4
+
+// headWorkers is the number of new heads fetched concurrently
+const headWorkers = 4
+
+// headQueueSize is the number of new heads queued before the websocket feed is paused
+const headQueueSize = 64
+
+// rpcTimeout bounds a single request to an RPC provider
+const rpcTimeout = 30 * time.Second
+
+// app holds the storage and the RPC provider pool shared by the subcommands
+type app struct {
+	store *storage
+	// New heads are fetched from the live providers of the pool and
+	// the bulk requests for catching up with missed blocks are sent to the bulk ones
+	// Every provider is instrumented to record its latency and errors
+	pool *rpc.Pool
+	// stopPool stops polling the heads of the providers
+	stopPool context.CancelFunc
+}
+
+// newApp connects to the configured storage backend and starts the RPC provider pool
+func newApp() (*app, error) {
+	providers, err := cfg.rpcProviders()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := rpc.NewPool(providers, cfg.maxLag, rpcTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize rpc pool")
+	}
+
+	store, err := initStorage()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize storage")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go pool.Run(ctx, cfg.healthPoll)
+
+	return &app{store: store, pool: pool, stopPool: cancel}, nil
+}
+
+// close stops the RPC provider pool and disconnects from the storage backend
+func (a *app) close() {
+	a.stopPool()
+	a.store.close()
+}
+
+// catchUpper builds the service catching up the live window through the bulk providers
+func (a *app) catchUpper() *rpc.CatchUpper {
+	return rpc.NewCatchUpper(a.pool, a.store.blocks, newPipeline(a.pool, rpc.RoleBulk, a.store), cfg.blocksNum, cfg.batchSize, cfg.workers, cfg.retry)
+}
+
+// gapScanner builds the service filling gaps in the live window through the bulk providers
+func (a *app) gapScanner() *rpc.GapScanner {
+	return rpc.NewGapScanner(a.pool.Client(rpc.RoleBulk), a.store.blocks, newPipeline(a.pool, rpc.RoleBulk, a.store))
+}
+
+// indexer builds the service storing new heads fetched from the live providers
+func (a *app) indexer(gaps *rpc.GapScanner) *rpc.Indexer {
+	return rpc.NewIndexer(a.pool, a.store.blocks, a.store.failed, newPipeline(a.pool, rpc.RoleLive, a.store), gaps, cfg.retry)
+}
+
+// storage holds the repositories of the configured backend
+// Repositories the backend does not provide are nil
+type storage struct {
+	blocks    db.BlocksRepo
+	failed    db.FailedBlocksRepo
+	logs      db.LogsRepo
+	transfers db.TokenTransfersRepo
+	internal  db.InternalTransactionsRepo
+	balances  db.BalanceDeltasRepo
+	contracts db.ContractsRepo
+	close     func()
+	// historical opens a blocks repository for historical ranges, separate from the live window
+	// MongoDB uses the named collection, PostgreSQL the database of the given DSN
+	historical func(collection string, dsn common.SecretValue) (db.BlocksRepo, error)
+}
+
+// initStorage connects to the configured storage backend and initializes its repositories
+func initStorage() (*storage, error) {
+	switch cfg.storage {
+	case storagePostgres:
+		pgDb, err := db.InitPostgresConn(cfg.pgDsn)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to connect to postgres")
+		}
+
+		blocks, err := db.NewPostgresBlocksRepo(pgDb, cfg.blocksNum)
+		if err != nil {
+			return nil, err
+		}
+		failed, err := db.NewPostgresFailedBlocksRepo(pgDb)
+		if err != nil {
+			return nil, err
+		}
+
+		closers := []*sql.DB{pgDb}
+		return &storage{
+			blocks: blocks,
+			failed: failed,
+			close: func() {
+				slog.Info("disconnecting from postgres")
+				for _, c := range closers {
+					if err := c.Close(); err != nil {
+						slog.Error("failed to disconnect from postgres", "error", err)
+					}
+				}
+			},
+			historical: func(_ string, dsn common.SecretValue) (db.BlocksRepo, error) {
+				if dsn == "" || dsn == cfg.pgDsn {
+					return nil, errors.New("a postgres DSN of a database other than the live one is required")
+				}
+				histDb, err := db.InitPostgresConn(dsn)
+				if err != nil {
+					return nil, errors.Wrap(err, "failed to connect to historical postgres")
+				}
+				closers = append(closers, histDb)
+				return db.NewPostgresBlocksRepo(histDb, 0)
+			},
+		}, nil
+	default:
+		mongoDb, err := db.InitMongoConn(cfg.dbHost)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to connect to mongo")
+		}
+
+		blocks, err := db.NewMongoBlocksRepo(mongoDb, cfg.blocksNum, cfg.avgDocSize)
+		if err != nil {
+			return nil, err
+		}
+		logs, err := db.NewMongoLogsRepo(mongoDb)
+		if err != nil {
+			return nil, err
+		}
+		transfers, err := db.NewMongoTokenTransfersRepo(mongoDb)
+		if err != nil {
+			return nil, err
+		}
+		internal, err := db.NewMongoInternalTransactionsRepo(mongoDb)
+		if err != nil {
+			return nil, err
+		}
+		balances, err := db.NewMongoBalanceDeltasRepo(mongoDb)
+		if err != nil {
+			return nil, err
+		}
+		contracts, err := db.NewMongoContractsRepo(mongoDb)
+		if err != nil {
+			return nil, err
+		}
+		failed, err := db.NewMongoFailedBlocksRepo(mongoDb)
+		if err != nil {
+			return nil, err
+		}
+
+		return &storage{
+			blocks:    blocks,
+			failed:    failed,
+			logs:      logs,
+			transfers: transfers,
+			internal:  internal,
+			balances:  balances,
+			contracts: contracts,
+			historical: func(collection string, _ common.SecretValue) (db.BlocksRepo, error) {
+				return db.NewMongoHistoricalBlocksRepo(mongoDb, collection)
+			},
+			close: func() {
+				slog.Info("disconnecting from mongo")
+				if err := mongoDb.Client().Disconnect(context.Background()); err != nil {
+					slog.Error("failed to disconnect from mongo", "error", err)
+				}
+			},
+		}, nil
+	}
+}
+
+// newPipeline builds the block processing pipeline fetching additional data from the providers of the role
+// Stages whose repositories the storage backend does not provide are skipped, and blocks are
+// only traced if call tracing is enabled
+func newPipeline(pool *rpc.Pool, role string, store *storage) *rpc.Pipeline {
+	stages := []rpc.Stage{
+		rpc.NewReceiptsStage(pool.Client(role), pool.HTTPClient(role), receiptWorkers),
+		rpc.NewBlocksStage(store.blocks),
+	}
+	if store.logs != nil {
+		stages = append(stages, rpc.NewLogsStage(store.logs, store.blocks))
+	}
+	if store.transfers != nil {
+		stages = append(stages, rpc.NewTokenTransfersStage(store.transfers, store.blocks))
+	}
+	if cfg.traceCalls && store.internal != nil {
+		traces := rpc.NewTracesStage(pool.HTTPClient(role), pool.URL(role), traceWorkers)
+		stages = append(stages, traces, rpc.NewInternalTransactionsStage(store.internal, store.blocks, traces))
+	}
+	// Balance deltas and contracts come last, so the blocks are traced by the time they are derived
+	if store.balances != nil {
+		stages = append(stages, rpc.NewBalanceDeltasStage(store.balances, store.blocks))
+	}
+	if store.contracts != nil {
+		stages = append(stages, rpc.NewContractsStage(store.contracts, pool.HTTPClient(role), pool.URL(role), cfg.retry))
+	}
+
+	return rpc.NewPipeline(stages...)
+}
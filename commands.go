@@ -0,0 +1,270 @@
+package main
+
+import (
+	"avax-indexer/api"
+	"avax-indexer/common"
+	"avax-indexer/rpc"
+	"avax-indexer/verify"
+	"avax-indexer/ws"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/exp/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// command is a subcommand of the binary
+type command struct {
+	name  string
+	usage string
+	run   func(a *app, args []string) error
+}
+
+// commands lists the subcommands in the order they are printed in the usage
+var commands = []command{
+	{name: "run", usage: "catch up, then index new heads and serve the API (default)", run: runIndexer},
+	{name: "catchup", usage: "catch up with the chain head once and exit", run: catchUp},
+	{name: "backfill", usage: "load a historical block range into a separate collection or database", run: backfill},
+	{name: "verify", usage: "check the integrity of the stored blocks", run: verifyBlocks},
+	{name: "status", usage: "print the stored head, the chain head and the lag", run: status},
+	{name: "redrive", usage: "retry the blocks recorded as failed", run: redrive},
+}
+
+// findCommand returns the subcommand with the given name
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// usage prints the available subcommands
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [config flags] [command] [command flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command\n\nConfig flags:\n", os.Args[0])
+}
+
+// runIndexer catches up with the chain, then indexes new heads from the websocket feed
+// and serves the query API and the metrics until interrupted
+func runIndexer(a *app, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// The command is cancelled on interrupt, stopping the catch-up and the gap scans
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	gapScanner := a.gapScanner()
+	queue := rpc.NewHeadQueue(a.indexer(gapScanner), headQueueSize, headWorkers)
+
+	// Serve the read-only query API and the metrics
+	server := api.NewServer(cfg.httpAddr, a.store.blocks, a.store.balances, a.store.contracts)
+	server.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			slog.Error("failed to serve http api", "error", err)
+		}
+	}()
+
+	// Catch up with missed blocks
+	if err := a.catchUpper().CatchUp(ctx); err != nil {
+		return errors.Wrap(err, "failed to catch up with blockchain")
+	}
+
+	// Fill gaps in the stored window now and periodically
+	go gapScanner.Run(ctx, cfg.gapScan)
+
+	queue.Start()
+	c, err := ws.NewListener(cfg.wsHost, queue, cfg.wsRetries)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to ws")
+	}
+	if err := c.Subscribe(); err != nil {
+		slog.Error("failed to subscribe to newHeads", "error", err)
+	}
+
+	// The listener stopping on its own is an error, so the process exits non-zero and gets restarted
+	var runErr error
+	select {
+	case <-c.Done():
+		runErr = errors.New("listener gave up after max reconnects")
+	case <-ctx.Done():
+		if err := c.GraceClose(); err != nil {
+			slog.Error("failed to gracefully close ws connection", "error", err)
+		}
+	}
+
+	queue.Close()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to shut down http api", "error", err)
+	}
+	return runErr
+}
+
+// catchUp catches up the live window with the chain head once
+func catchUp(a *app, args []string) error {
+	fs := flag.NewFlagSet("catchup", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	return a.catchUpper().CatchUp(ctx)
+}
+
+// backfill loads a historical block range into a separate collection or database
+// It only runs the receipts and blocks stages, so the live derived collections are untouched
+func backfill(a *app, args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	from := fs.Int64("from", 0, "first block number of the range")
+	to := fs.Int64("to", 0, "last block number of the range")
+	collection := fs.String("collection", "historical_blocks", "mongo collection to store the blocks in")
+	dsn := fs.String("dsn", "", "postgres connection string of the database to store the blocks in, required for postgres")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from <= 0 || *to < *from {
+		return errors.New("-from and -to must be set to a valid block range")
+	}
+
+	repo, err := a.store.historical(*collection, common.SecretValue(*dsn))
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize historical storage")
+	}
+
+	pipeline := rpc.NewPipeline(
+		rpc.NewReceiptsStage(a.pool.Client(rpc.RoleBulk), a.pool.HTTPClient(rpc.RoleBulk), receiptWorkers),
+		rpc.NewBlocksStage(repo),
+	)
+	catchUpper := rpc.NewCatchUpper(a.pool, repo, pipeline, cfg.blocksNum, cfg.batchSize, cfg.workers, cfg.retry)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	return catchUpper.Backfill(ctx, *from, *to)
+}
+
+// verifyBlocks checks that the stored window has no gaps, no duplicates, a consistent parent chain
+// and transactions matching their blocks, printing the report as text or JSON
+// With -repair, the blocks with issues are fetched again and the window is verified once more
+// It fails if any issue is found, or is left after repairing
+func verifyBlocks(a *app, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	repair := fs.Bool("repair", false, "fetch the blocks with issues again and store them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	report, err := verify.Verify(ctx, a.store.blocks)
+	if err != nil {
+		return err
+	}
+
+	if *repair && !report.OK() {
+		numbers := report.Numbers()
+		repaired, failing, err := a.indexer(a.gapScanner()).Repair(ctx, numbers)
+		slog.Info("repaired blocks", "repaired", repaired, "still_failing", failing)
+		if err != nil {
+			return err
+		}
+
+		if report, err = verify.Verify(ctx, a.store.blocks); err != nil {
+			return err
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return errors.Wrap(err, "failed to encode report")
+		}
+	} else {
+		fmt.Printf("checked blocks %d to %d: %d stored, %d transactions, %d roots unchecked, %d issues\n",
+			report.From, report.To, report.Blocks, report.Transactions, report.Unchecked, len(report.Issues))
+		for _, issue := range report.Issues {
+			fmt.Printf("%-18s %-10d %s\n", issue.Kind, issue.Number, issue.Detail)
+		}
+	}
+	if !report.OK() {
+		return errors.Errorf("found %d issues in the stored blocks", len(report.Issues))
+	}
+	return nil
+}
+
+// status prints the stored window, the chain head, how far the stored head lags behind it
+// and the health of the RPC providers
+func status(a *app, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	firstHead, err := a.store.blocks.FirstHead(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get first head")
+	}
+	storedHead, err := a.store.blocks.LastHead(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get last head")
+	}
+	chainHead, err := a.pool.Client(rpc.RoleLive).EthBlockNumber()
+	if err != nil {
+		return errors.Wrap(err, "failed to get chain head")
+	}
+
+	fmt.Printf("first stored block: %d\n", firstHead)
+	fmt.Printf("stored head:        %d\n", storedHead)
+	fmt.Printf("chain head:         %d\n", chainHead)
+	fmt.Printf("lag:                %d\n", int64(chainHead)-storedHead)
+
+	a.pool.Poll()
+	fmt.Printf("\nrpc providers:\n")
+	for _, p := range a.pool.Status() {
+		state := "healthy"
+		if p.Ejected {
+			state = "ejected"
+		}
+		fmt.Printf("  %-40s %-10s head %-10d latency %-8s errors %3.0f%%  %s\n",
+			p.Name, strings.Join(p.Roles, ","), p.Head, p.Latency.Round(time.Millisecond), p.ErrorRate*100, state)
+	}
+	return nil
+}
+
+// redrive retries the blocks recorded in the failed blocks repository
+func redrive(a *app, args []string) error {
+	fs := flag.NewFlagSet("redrive", flag.ExitOnError)
+	limit := fs.Int("limit", 1000, "maximum number of failed blocks to retry")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	stored, failing, err := a.indexer(a.gapScanner()).Redrive(ctx, *limit)
+	slog.Info("redrove failed blocks", "stored", stored, "still_failing", failing)
+	return err
+}
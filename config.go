@@ -0,0 +1,483 @@
+package main
+
+import (
+	"avax-indexer/common"
+	"avax-indexer/rpc"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRPCAvalanche = "https://api.avax.network/ext/bc/C/rpc"
+	defaultWSAvalanche  = "wss://api.avax.network/ext/bc/C/ws"
+)
+
+const (
+	storageMongo    = "mongo"
+	storagePostgres = "postgres"
+)
+
+// config is the configuration shared by the subcommands
+// Every setting is read from the config file, the env vars and the flags,
+// each source overriding the previous one
+type config struct {
+	rpcHost    string
+	wsHost     string
+	rpcInfura  common.SecretValue
+	storage    string
+	dbHost     common.SecretValue
+	pgDsn      common.SecretValue
+	blocksNum  int64
+	avgDocSize int64
+	wsRetries  int
+	gapScan    time.Duration
+	httpAddr   string
+	retry      rpc.RetryPolicy
+	batchSize  int64
+	workers    int
+	providers  common.SecretValue
+	maxLag     int64
+	healthPoll time.Duration
+	traceCalls bool
+	// Rate limits of the default providers, used without rpc_providers
+	rpcRPS        float64
+	infuraRPS     float64
+	infuraCredits float64
+}
+
+// cfg is the loaded configuration, shared by the subcommands
+var cfg config
+
+// defaultConfig returns the configuration used for the settings no source sets
+func defaultConfig() config {
+	return config{
+		rpcHost:    defaultRPCAvalanche,
+		wsHost:     defaultWSAvalanche,
+		storage:    storageMongo,
+		blocksNum:  10000,
+		avgDocSize: 50,
+		wsRetries:  10,
+		gapScan:    5 * time.Minute,
+		httpAddr:   ":8080",
+		retry:      rpc.DefaultRetryPolicy,
+		batchSize:  100,
+		workers:    4,
+		maxLag:     20,
+		healthPoll: 10 * time.Second,
+	}
+}
+
+// setting binds a configuration field to its config file key
+// The env var is the upper-cased key and the flag the key with dashes
+type setting struct {
+	key   string
+	usage string
+	value flag.Value
+}
+
+func (s setting) envVar() string {
+	return strings.ToUpper(s.key)
+}
+
+func (s setting) flagName() string {
+	return strings.ReplaceAll(s.key, "_", "-")
+}
+
+// settings returns the settings bound to the fields of the config
+func (c *config) settings() []setting {
+	return []setting{
+		{key: "avax_rpc", usage: "Avalanche C-Chain RPC endpoint for new heads", value: (*stringValue)(&c.rpcHost)},
+		{key: "avax_ws", usage: "Avalanche C-Chain websocket endpoint for new heads", value: (*stringValue)(&c.wsHost)},
+		{key: "avax_rpc_infura", usage: "Infura RPC endpoint for catching up", value: (*secretValue)(&c.rpcInfura)},
+		{key: "storage", usage: "storage backend, mongo or postgres", value: (*stringValue)(&c.storage)},
+		{key: "mongodb_uri", usage: "MongoDB connection string", value: (*secretValue)(&c.dbHost)},
+		{key: "postgres_dsn", usage: "PostgreSQL connection string", value: (*secretValue)(&c.pgDsn)},
+		{key: "blocks", usage: "number of recent blocks to keep", value: (*int64Value)(&c.blocksNum)},
+		{key: "avg_doc_size", usage: "average block document size in KB, used to size the capped collection", value: (*int64Value)(&c.avgDocSize)},
+		{key: "ws_max_reconnects", usage: "websocket reconnect attempts before giving up", value: (*intValue)(&c.wsRetries)},
+		{key: "gap_scan_interval", usage: "interval between gap scans of the stored window", value: (*durationValue)(&c.gapScan)},
+		{key: "http_addr", usage: "address the HTTP API and the metrics are served on", value: (*stringValue)(&c.httpAddr)},
+		{key: "retry_max_attempts", usage: "attempts made to fetch and store a block", value: (*intValue)(&c.retry.MaxAttempts)},
+		{key: "retry_min_backoff", usage: "backoff before the first retry", value: (*durationValue)(&c.retry.MinBackoff)},
+		{key: "retry_max_backoff", usage: "maximum backoff between retries", value: (*durationValue)(&c.retry.MaxBackoff)},
+		{key: "catchup_batch_size", usage: "blocks fetched per catch-up batch request", value: (*int64Value)(&c.batchSize)},
+		{key: "catchup_workers", usage: "catch-up batches fetched concurrently", value: (*intValue)(&c.workers)},
+		{key: "avax_rpc_rps", usage: "requests per second sent to avax_rpc, 0 for unlimited", value: (*floatValue)(&c.rpcRPS)},
+		{key: "avax_rpc_infura_rps", usage: "requests per second sent to avax_rpc_infura, 0 for unlimited", value: (*floatValue)(&c.infuraRPS)},
+		{key: "avax_rpc_infura_credits", usage: "Infura credits per second spent on avax_rpc_infura, 0 for unlimited", value: (*floatValue)(&c.infuraCredits)},
+		{key: "rpc_providers", usage: "space-separated RPC providers as roles:weight[:rps:credits]:url, replacing avax_rpc and avax_rpc_infura", value: (*secretValue)(&c.providers)},
+		{key: "rpc_max_lag", usage: "blocks an RPC provider may lag behind the chain head before it is ejected", value: (*int64Value)(&c.maxLag)},
+		{key: "rpc_health_interval", usage: "interval between RPC provider head polls", value: (*durationValue)(&c.healthPoll)},
+		{key: "trace_calls", usage: "index internal transactions by tracing every block with debug_traceBlockByNumber", value: (*boolValue)(&c.traceCalls)},
+	}
+}
+
+// registerConfigFlags registers a flag for every setting on the flag set
+// Their values are applied by loadConfig, after the config file and the env vars
+func registerConfigFlags(fs *flag.FlagSet) {
+	for _, s := range (&config{}).settings() {
+		fs.String(s.flagName(), "", fmt.Sprintf("%s (env %s)", s.usage, s.envVar()))
+	}
+}
+
+// loadConfig loads the configuration from the defaults, the config file if one is given,
+// the env vars and the flags set on the parsed flag set, and validates it
+func loadConfig(file string, fs *flag.FlagSet) (config, error) {
+	c := defaultConfig()
+	settings := c.settings()
+
+	if file != "" {
+		if err := c.loadFile(file, settings); err != nil {
+			return config{}, err
+		}
+	}
+
+	for _, s := range settings {
+		v, ok := os.LookupEnv(s.envVar())
+		if !ok || v == "" {
+			continue
+		}
+		if err := s.value.Set(v); err != nil {
+			return config{}, errors.Wrapf(err, "failed to parse %s env var", s.envVar())
+		}
+	}
+
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	for _, s := range settings {
+		v, ok := flags[s.flagName()]
+		if !ok {
+			continue
+		}
+		if err := s.value.Set(v); err != nil {
+			return config{}, errors.Wrapf(err, "failed to parse -%s flag", s.flagName())
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return config{}, err
+	}
+	return c, nil
+}
+
+// loadFile applies the settings of a YAML config file
+// Unknown keys are rejected so that typos do not go unnoticed
+func (c *config) loadFile(file string, settings []setting) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read config file")
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return errors.Wrapf(err, "failed to parse config file %s", file)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return errors.Errorf("config file %s must be a mapping of settings", file)
+	}
+
+	byKey := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		byKey[s.key] = s
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		s, ok := byKey[key.Value]
+		if !ok {
+			return errors.Errorf("unknown setting %q in config file %s at line %d", key.Value, file, key.Line)
+		}
+		if value.Kind != yaml.ScalarNode {
+			return errors.Errorf("setting %q in config file %s at line %d must be a scalar", key.Value, file, value.Line)
+		}
+		if err := s.value.Set(value.Value); err != nil {
+			return errors.Wrapf(err, "failed to parse %s in config file %s at line %d", key.Value, file, value.Line)
+		}
+	}
+	return nil
+}
+
+// validate checks that the required settings are set and the others are in range
+// It reports all invalid settings at once
+func (c *config) validate() error {
+	problems := make([]string, 0)
+	if c.rpcHost == "" {
+		problems = append(problems, "avax_rpc is required")
+	}
+	if c.wsHost == "" {
+		problems = append(problems, "avax_ws is required")
+	}
+	if c.providers == "" && c.rpcInfura == "" {
+		problems = append(problems, "avax_rpc_infura or rpc_providers is required")
+	}
+	if _, err := c.rpcProviders(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	switch c.storage {
+	case storageMongo:
+		if c.dbHost == "" {
+			problems = append(problems, "mongodb_uri is required with mongo storage")
+		}
+	case storagePostgres:
+		if c.pgDsn == "" {
+			problems = append(problems, "postgres_dsn is required with postgres storage")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("storage must be %s or %s, got %q", storageMongo, storagePostgres, c.storage))
+	}
+	if c.blocksNum <= 0 {
+		problems = append(problems, "blocks must be positive")
+	}
+	if c.avgDocSize <= 0 {
+		problems = append(problems, "avg_doc_size must be positive")
+	}
+	if c.wsRetries < 0 {
+		problems = append(problems, "ws_max_reconnects must not be negative")
+	}
+	if c.gapScan <= 0 {
+		problems = append(problems, "gap_scan_interval must be positive")
+	}
+	if c.httpAddr == "" {
+		problems = append(problems, "http_addr is required")
+	}
+	if c.retry.MaxAttempts <= 0 {
+		problems = append(problems, "retry_max_attempts must be positive")
+	}
+	if c.retry.MinBackoff <= 0 {
+		problems = append(problems, "retry_min_backoff must be positive")
+	}
+	if c.retry.MaxBackoff < c.retry.MinBackoff {
+		problems = append(problems, "retry_max_backoff must not be lower than retry_min_backoff")
+	}
+	if c.batchSize <= 0 {
+		problems = append(problems, "catchup_batch_size must be positive")
+	}
+	if c.workers <= 0 {
+		problems = append(problems, "catchup_workers must be positive")
+	}
+	if c.maxLag < 0 {
+		problems = append(problems, "rpc_max_lag must not be negative")
+	}
+	if c.healthPoll <= 0 {
+		problems = append(problems, "rpc_health_interval must be positive")
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// rpcProviders returns the providers of the RPC pool
+// Without rpc_providers, avax_rpc is the live provider and avax_rpc_infura the bulk one
+func (c *config) rpcProviders() ([]rpc.ProviderConfig, error) {
+	if c.providers == "" {
+		if c.rpcRPS < 0 || c.infuraRPS < 0 || c.infuraCredits < 0 {
+			return nil, errors.New("rpc rate limits must not be negative")
+		}
+		return []rpc.ProviderConfig{
+			{URL: c.rpcHost, Weight: 1, Roles: []string{rpc.RoleLive}, RPS: c.rpcRPS},
+			{URL: string(c.rpcInfura), Weight: 1, Roles: []string{rpc.RoleBulk}, RPS: c.infuraRPS, CreditsPerSec: c.infuraCredits},
+		}, nil
+	}
+
+	res := make([]rpc.ProviderConfig, 0)
+	live, bulk := false, false
+	for i, entry := range strings.Fields(string(c.providers)) {
+		// The URL is last, as it contains colons itself
+		scheme := strings.Index(entry, "://")
+		sep := -1
+		if scheme > 0 {
+			sep = strings.LastIndex(entry[:scheme], ":")
+		}
+		if sep < 0 {
+			return nil, errors.Errorf("rpc_providers entry %d must be roles:weight[:rps:credits]:url", i+1)
+		}
+		rawURL := entry[sep+1:]
+		parts := strings.Split(entry[:sep], ":")
+		if len(parts) != 2 && len(parts) != 4 {
+			return nil, errors.Errorf("rpc_providers entry %d must be roles:weight[:rps:credits]:url", i+1)
+		}
+		weight, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || weight <= 0 {
+			return nil, errors.Errorf("rpc_providers entry %d must have a positive weight", i+1)
+		}
+		var rps, credits float64
+		if len(parts) == 4 {
+			rps, err = strconv.ParseFloat(parts[2], 64)
+			if err != nil || rps < 0 {
+				return nil, errors.Errorf("rpc_providers entry %d must have a non-negative rps", i+1)
+			}
+			credits, err = strconv.ParseFloat(parts[3], 64)
+			if err != nil || credits < 0 {
+				return nil, errors.Errorf("rpc_providers entry %d must have non-negative credits", i+1)
+			}
+		}
+		roles := strings.Split(parts[0], ",")
+		for _, role := range roles {
+			switch role {
+			case rpc.RoleLive:
+				live = true
+			case rpc.RoleBulk:
+				bulk = true
+			default:
+				return nil, errors.Errorf("rpc_providers entry %d has unknown role %q, must be %s or %s", i+1, role, rpc.RoleLive, rpc.RoleBulk)
+			}
+		}
+		if u, err := url.Parse(rawURL); err != nil || u.Host == "" {
+			return nil, errors.Errorf("rpc_providers entry %d has an invalid url", i+1)
+		}
+		res = append(res, rpc.ProviderConfig{URL: rawURL, Weight: weight, Roles: roles, RPS: rps, CreditsPerSec: credits})
+	}
+	if !live || !bulk {
+		return nil, errors.Errorf("rpc_providers must have at least one %s and one %s provider", rpc.RoleLive, rpc.RoleBulk)
+	}
+	return res, nil
+}
+
+// print writes the effective config as YAML, with the secrets redacted
+func (c *config) print(w io.Writer) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range c.settings() {
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: s.value.String()}
+		if value.Value == "" {
+			// Unset settings are printed as empty strings rather than null
+			value.Tag = "!!str"
+		}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: s.key}, value)
+	}
+
+	enc := yaml.NewEncoder(w)
+	defer enc.Close()
+	return enc.Encode(root)
+}
+
+// log logs the effective config, with the secrets redacted
+func (c *config) log() {
+	args := make([]any, 0)
+	for _, s := range c.settings() {
+		args = append(args, s.key, s.value.String())
+	}
+	slog.Info("effective config", args...)
+}
+
+// stringValue is a string setting
+type stringValue string
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+func (v *stringValue) String() string {
+	return string(*v)
+}
+
+// secretValue is a secret setting, redacted when printed
+type secretValue common.SecretValue
+
+func (v *secretValue) Set(s string) error {
+	*v = secretValue(s)
+	return nil
+}
+
+func (v *secretValue) String() string {
+	if *v == "" {
+		return ""
+	}
+	return common.SecretValue(*v).String()
+}
+
+// intValue is an integer setting
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.Errorf("%q is not an integer", s)
+	}
+	*v = intValue(i)
+	return nil
+}
+
+func (v *intValue) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+// int64Value is a 64-bit integer setting
+type int64Value int64
+
+func (v *int64Value) Set(s string) error {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return errors.Errorf("%q is not an integer", s)
+	}
+	*v = int64Value(i)
+	return nil
+}
+
+func (v *int64Value) String() string {
+	return strconv.FormatInt(int64(*v), 10)
+}
+
+// floatValue is a decimal setting
+type floatValue float64
+
+func (v *floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return errors.Errorf("%q is not a number", s)
+	}
+	*v = floatValue(f)
+	return nil
+}
+
+func (v *floatValue) String() string {
+	return strconv.FormatFloat(float64(*v), 'f', -1, 64)
+}
+
+// boolValue is a boolean setting, like true or false
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return errors.Errorf("%q is not a boolean", s)
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+func (v *boolValue) String() string {
+	return strconv.FormatBool(bool(*v))
+}
+
+// durationValue is a duration setting, like 5m or 1s
+type durationValue time.Duration
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.Errorf("%q is not a duration", s)
+	}
+	*v = durationValue(d)
+	return nil
+}
+
+func (v *durationValue) String() string {
+	return time.Duration(*v).String()
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"math/big"
+	"strings"
+)
+
+// Activity directions, seen from the address the activity is queried for
+const (
+	DirectionSent     = "sent"
+	DirectionReceived = "received"
+	DirectionSelf     = "self"
+)
+
+// Activity is a transaction seen from one of the addresses it involves
+// The counterparty is the other side of the transaction, the created contract for deployments
+// and the address itself for transactions it sent to itself
+// Fee is the gas used times the effective gas price, and is empty until the receipt is indexed
+type Activity struct {
+	Hash             string `json:"hash"`
+	BlockNumber      int64  `json:"block_number"`
+	TransactionIndex int64  `json:"transaction_index"`
+	Timestamp        int    `json:"timestamp"`
+	Direction        string `json:"direction"`
+	Counterparty     string `json:"counterparty"`
+	Value            string `json:"value"`
+	Fee              string `json:"fee,omitempty"`
+	Status           *int   `json:"status,omitempty"`
+}
+
+// NewActivity returns the activity of the address in the transaction
+func NewActivity(address string, t *Transaction) Activity {
+	cursor := NewTxCursor(t)
+	a := Activity{
+		Hash:             t.Hash,
+		BlockNumber:      cursor.BlockNumber,
+		TransactionIndex: cursor.TransactionIndex,
+		Timestamp:        t.Timestamp,
+		Value:            t.Value,
+		Status:           t.Status,
+	}
+
+	sent := strings.EqualFold(t.From, address)
+	received := strings.EqualFold(t.To, address)
+	switch {
+	case sent && received:
+		a.Direction, a.Counterparty = DirectionSelf, address
+	case sent && t.To == "":
+		a.Direction, a.Counterparty = DirectionSent, t.ContractAddress
+	case sent:
+		a.Direction, a.Counterparty = DirectionSent, t.To
+	default:
+		a.Direction, a.Counterparty = DirectionReceived, t.From
+	}
+
+	if price, ok := new(big.Int).SetString(t.EffectiveGasPrice, 10); ok {
+		a.Fee = price.Mul(price, big.NewInt(int64(t.GasUsed))).String()
+	}
+	return a
+}
+
+// Cursor returns a cursor pointing at the activity's transaction
+func (a *Activity) Cursor() *TxCursor {
+	return &TxCursor{BlockNumber: a.BlockNumber, TransactionIndex: a.TransactionIndex}
+}
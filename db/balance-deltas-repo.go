@@ -0,0 +1,18 @@
+package db
+
+import "context"
+
+// BalanceDeltasRepo is the storage for the native AVAX balance deltas derived from blocks
+// Deltas are keyed by block hash and address, so they can be replaced and reverted per block
+type BalanceDeltasRepo interface {
+	// UpsertMany inserts or updates many balance deltas
+	UpsertMany(ctx context.Context, deltas []BalanceDelta) error
+	// DeleteByBlockHashes removes the balance deltas of the given blocks
+	DeleteByBlockHashes(ctx context.Context, hashes []string) error
+	// DeleteBefore removes the balance deltas of blocks older than the given number
+	DeleteBefore(ctx context.Context, number int64) error
+	// SumBalanceDeltas sums the balance deltas of an address from fromBlock to toBlock, inclusive
+	SumBalanceDeltas(ctx context.Context, address string, fromBlock int64, toBlock int64) (*BalanceSum, error)
+}
+
+var _ BalanceDeltasRepo = (*MongoBalanceDeltasRepo)(nil)
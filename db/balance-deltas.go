@@ -0,0 +1,143 @@
+package db
+
+import (
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// valueCallTypes are the call types of internal transactions that move value between two addresses
+// Delegate and static calls carry no value of their own, and callcode moves it to the caller itself
+var valueCallTypes = map[string]bool{
+	"CALL":         true,
+	"CREATE":       true,
+	"CREATE2":      true,
+	"SELFDESTRUCT": true,
+}
+
+// balanceFlows accumulates the native AVAX moved into and out of an address
+type balanceFlows struct {
+	received *big.Int
+	sent     *big.Int
+	fees     *big.Int
+}
+
+func newBalanceFlows() *balanceFlows {
+	return &balanceFlows{received: new(big.Int), sent: new(big.Int), fees: new(big.Int)}
+}
+
+// delta returns the net change of the balance
+func (f *balanceFlows) delta() *big.Int {
+	d := new(big.Int).Sub(f.received, f.sent)
+	return d.Sub(d, f.fees)
+}
+
+// BalanceDeltasFromBlock derives the balance deltas of every address the block's transactions
+// moved AVAX for, sorted by address
+// The value of a failed transaction does not move, but its fee is still paid. Values sent to create
+// a contract go to the created contract. The internal transactions are only given for traced blocks,
+// and the ones that were reverted or carry no value of their own are left out
+func BalanceDeltasFromBlock(b *Block, internal []InternalTransaction, traced bool) []BalanceDelta {
+	flows := make(map[string]*balanceFlows)
+	get := func(address string) *balanceFlows {
+		address = strings.ToLower(address)
+		f, ok := flows[address]
+		if !ok {
+			f = newBalanceFlows()
+			flows[address] = f
+		}
+		return f
+	}
+	move := func(from, to string, value string) {
+		v, ok := new(big.Int).SetString(value, 10)
+		if !ok || v.Sign() <= 0 || from == "" || to == "" {
+			return
+		}
+		get(from).sent.Add(get(from).sent, v)
+		get(to).received.Add(get(to).received, v)
+	}
+
+	for _, t := range b.Transactions {
+		if t.Status == nil || *t.Status != 0 {
+			to := t.To
+			if to == "" {
+				to = t.ContractAddress
+			}
+			move(t.From, to, t.Value)
+		}
+		if price, ok := new(big.Int).SetString(t.EffectiveGasPrice, 10); ok && t.GasUsed > 0 {
+			fees := get(t.From).fees
+			fees.Add(fees, price.Mul(price, big.NewInt(int64(t.GasUsed))))
+		}
+	}
+	for _, it := range internal {
+		if !it.Reverted && valueCallTypes[it.Type] {
+			move(it.From, it.To, it.Value)
+		}
+	}
+
+	deltas := make([]BalanceDelta, 0, len(flows))
+	for address, f := range flows {
+		deltas = append(deltas, BalanceDelta{
+			Address:     address,
+			BlockHash:   b.Hash,
+			BlockNumber: b.Number,
+			Received:    f.received.String(),
+			Sent:        f.sent.String(),
+			Fees:        f.fees.String(),
+			Delta:       f.delta().String(),
+			Traced:      traced,
+		})
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		return deltas[i].Address < deltas[j].Address
+	})
+	return deltas
+}
+
+// BalanceSum is the sum of the balance deltas of an address over a block range
+// Blocks is the number of blocks in the range the address's balance changed in, and Untraced
+// the number of those whose internal transactions are not included
+type BalanceSum struct {
+	Address   string `json:"address"`
+	FromBlock int64  `json:"from_block"`
+	ToBlock   int64  `json:"to_block"`
+	Received  string `json:"received"`
+	Sent      string `json:"sent"`
+	Fees      string `json:"fees"`
+	Delta     string `json:"delta"`
+	Blocks    int    `json:"blocks"`
+	Untraced  int    `json:"untraced_blocks"`
+}
+
+// SumBalanceDeltas sums the balance deltas of an address over the block range
+func SumBalanceDeltas(address string, fromBlock int64, toBlock int64, deltas []BalanceDelta) *BalanceSum {
+	total := newBalanceFlows()
+	add := func(sum *big.Int, value string) {
+		if v, ok := new(big.Int).SetString(value, 10); ok {
+			sum.Add(sum, v)
+		}
+	}
+
+	untraced := 0
+	for _, d := range deltas {
+		add(total.received, d.Received)
+		add(total.sent, d.Sent)
+		add(total.fees, d.Fees)
+		if !d.Traced {
+			untraced++
+		}
+	}
+
+	return &BalanceSum{
+		Address:   address,
+		FromBlock: fromBlock,
+		ToBlock:   toBlock,
+		Received:  total.received.String(),
+		Sent:      total.sent.String(),
+		Fees:      total.fees.String(),
+		Delta:     total.delta().String(),
+		Blocks:    len(deltas),
+		Untraced:  untraced,
+	}
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by the read paths when the requested document does not exist
+var ErrNotFound = errors.New("not found")
+
+// BlocksRepo is the storage the indexing services depend on
+// It keeps a window of the most recent blocks, upserting them by hash
+type BlocksRepo interface {
+	// Insert inserts or updates a single block
+	Insert(ctx context.Context, block *Block) error
+	// UpsertMany inserts or updates many blocks, given in any order
+	UpsertMany(ctx context.Context, blocks []*Block) error
+	// LastHead returns the newest stored block number, or 0 if nothing is stored
+	LastHead(ctx context.Context) (int64, error)
+	// FirstHead returns the oldest stored block number, or 0 if nothing is stored
+	FirstHead(ctx context.Context) (int64, error)
+	// FindByNumber returns all stored blocks at the given height
+	FindByNumber(ctx context.Context, number int64) ([]Block, error)
+	// FindBlocks returns up to limit blocks matching the filter, from the newest to the oldest
+	FindBlocks(ctx context.Context, filter BlockFilter, limit int) ([]Block, error)
+	// FindByHash returns the stored block with the given hash or ErrNotFound
+	FindByHash(ctx context.Context, hash string) (*Block, error)
+	// FindTransaction returns the stored transaction with the given hash or ErrNotFound
+	FindTransaction(ctx context.Context, hash string) (*Transaction, error)
+	// FindAddressTransactions returns up to limit transactions sent from or to the address,
+	// from the newest to the oldest, starting after the cursor if one is given
+	FindAddressTransactions(ctx context.Context, address string, cursor *TxCursor, limit int) ([]Transaction, error)
+	// FindAddressActivity returns up to limit transactions sent from or to the address in blocks
+	// from fromBlock on, as seen from the address, from the newest to the oldest,
+	// starting after the cursor if one is given
+	FindAddressActivity(ctx context.Context, address string, fromBlock int64, cursor *TxCursor, limit int) ([]Activity, error)
+	// StoredNumbers returns the stored block numbers in the inclusive range, in ascending order
+	StoredNumbers(ctx context.Context, from int64, to int64) ([]int64, error)
+	// MoveToOrphans removes the given blocks and records them as orphaned by the canonical hash
+	MoveToOrphans(ctx context.Context, blocks []Block, canonicalHash string) error
+}
+
+// BlockFilter narrows down the blocks returned by FindBlocks
+// Nil bounds are open, set bounds are inclusive
+type BlockFilter struct {
+	FromNumber *int64
+	ToNumber   *int64
+	FromTime   *int64
+	ToTime     *int64
+}
+
+// Matches reports whether the block satisfies the filter
+func (f BlockFilter) Matches(b *Block) bool {
+	n, ts := int64(b.Number), int64(b.Timestamp)
+	return (f.FromNumber == nil || n >= *f.FromNumber) &&
+		(f.ToNumber == nil || n <= *f.ToNumber) &&
+		(f.FromTime == nil || ts >= *f.FromTime) &&
+		(f.ToTime == nil || ts <= *f.ToTime)
+}
+
+var (
+	_ BlocksRepo = (*MongoBlocksRepo)(nil)
+	_ BlocksRepo = (*MemoryBlocksRepo)(nil)
+	_ BlocksRepo = (*PostgresBlocksRepo)(nil)
+)
@@ -3,6 +3,8 @@ package db
 import (
 	"avax-indexer/common"
 	"context"
+	"database/sql"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -30,3 +32,23 @@ func InitMongoConn(host common.SecretValue) (*mongo.Database, error) {
 
 	return client.Database("avax-indexer"), nil
 }
+
+// InitPostgresConn initializes a connection pool to PostgreSQL
+// Ping is called to ensure the connection is valid
+func InitPostgresConn(dsn common.SecretValue) (*sql.DB, error) {
+	ctx, c := context.WithTimeout(context.Background(), 10*time.Second)
+	defer c()
+
+	connector, err := pq.NewConnector(string(dsn))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse postgres dsn")
+	}
+
+	slog.Info("connecting to postgres")
+	db := sql.OpenDB(connector)
+	if err := db.PingContext(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to ping postgres")
+	}
+
+	return db, nil
+}
@@ -0,0 +1,21 @@
+package db
+
+import "context"
+
+// ContractsRepo is the storage for deployed contracts and their runtime code
+// Contracts are keyed by address and the code is stored once per code hash
+type ContractsRepo interface {
+	// UpsertMany stores the code, skipping code hashes already stored, and inserts or updates the contracts
+	UpsertMany(ctx context.Context, contracts []Contract, codes []Bytecode) error
+	// DeleteByBlockHashes removes the contracts created in the given blocks
+	// Their code is kept, as it may be shared with other contracts
+	DeleteByBlockHashes(ctx context.Context, hashes []string) error
+	// FindByAddress returns the contract deployed at the given address or ErrNotFound
+	FindByAddress(ctx context.Context, address string) (*Contract, error)
+	// FindByCodeHash returns up to limit contracts with the given code hash, newest first
+	FindByCodeHash(ctx context.Context, codeHash string, limit int) ([]Contract, error)
+	// FindCode returns the code with the given hash or ErrNotFound
+	FindCode(ctx context.Context, codeHash string) (*Bytecode, error)
+}
+
+var _ ContractsRepo = (*MongoContractsRepo)(nil)
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+// TxCursor points at a transaction by its position in the chain
+// Results paginated by it are ordered from the newest transaction to the oldest,
+// so the next page starts right below the cursor, which keeps pages stable as new blocks arrive
+type TxCursor struct {
+	BlockNumber      int64
+	TransactionIndex int64
+}
+
+// NewTxCursor returns a cursor pointing at the given transaction
+func NewTxCursor(tx *Transaction) *TxCursor {
+	c := &TxCursor{}
+	if tx.BlockNumber != nil {
+		c.BlockNumber = int64(*tx.BlockNumber)
+	}
+	if tx.TransactionIndex != nil {
+		c.TransactionIndex = int64(*tx.TransactionIndex)
+	}
+	return c
+}
+
+// String encodes the cursor into an opaque token
+func (c *TxCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.BlockNumber, c.TransactionIndex)))
+}
+
+// ParseTxCursor decodes a cursor token created by TxCursor.String
+func ParseTxCursor(s string) (*TxCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode cursor")
+	}
+
+	c := &TxCursor{}
+	if _, err := fmt.Sscanf(string(b), "%d:%d", &c.BlockNumber, &c.TransactionIndex); err != nil {
+		return nil, errors.Wrap(err, "failed to parse cursor")
+	}
+	return c, nil
+}
+
+// After reports whether the transaction comes after the cursor in the pagination order,
+// i.e. it is older than the transaction the cursor points at
+func (c *TxCursor) After(tx *Transaction) bool {
+	cur := NewTxCursor(tx)
+	if cur.BlockNumber != c.BlockNumber {
+		return cur.BlockNumber < c.BlockNumber
+	}
+	return cur.TransactionIndex < c.TransactionIndex
+}
@@ -0,0 +1,20 @@
+package db
+
+import "context"
+
+// FailedBlocksRepo is the dead-letter queue for blocks that could not be fetched or stored
+// Entries are keyed by hash and number, so a block failing again updates its entry
+type FailedBlocksRepo interface {
+	// Record inserts the failed block or, if it is already recorded,
+	// adds its attempts and replaces its step, error and last failure time
+	Record(ctx context.Context, block *FailedBlock) error
+	// List returns up to limit failed blocks, ordered by number
+	List(ctx context.Context, limit int) ([]FailedBlock, error)
+	// Delete removes a failed block once it was stored
+	Delete(ctx context.Context, hash string, number int64) error
+}
+
+var (
+	_ FailedBlocksRepo = (*MongoFailedBlocksRepo)(nil)
+	_ FailedBlocksRepo = (*PostgresFailedBlocksRepo)(nil)
+)
@@ -0,0 +1,17 @@
+package db
+
+import "context"
+
+// InternalTransactionsRepo is the storage for the internal transactions traced from blocks
+// Internal transactions are keyed by block hash, transaction hash and index,
+// so they can be replaced and reverted per block
+type InternalTransactionsRepo interface {
+	// UpsertMany inserts or updates many internal transactions
+	UpsertMany(ctx context.Context, txs []InternalTransaction) error
+	// DeleteByBlockHashes removes the internal transactions of the given blocks
+	DeleteByBlockHashes(ctx context.Context, hashes []string) error
+	// DeleteBefore removes the internal transactions of blocks older than the given number
+	DeleteBefore(ctx context.Context, number int64) error
+}
+
+var _ InternalTransactionsRepo = (*MongoInternalTransactionsRepo)(nil)
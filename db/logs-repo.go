@@ -0,0 +1,16 @@
+package db
+
+import "context"
+
+// LogsRepo is the storage for event logs
+// Logs are keyed by block hash and log index, so they can be replaced and reverted per block
+type LogsRepo interface {
+	// UpsertMany inserts or updates many logs
+	UpsertMany(ctx context.Context, logs []Log) error
+	// DeleteByBlockHashes removes the logs of the given blocks
+	DeleteByBlockHashes(ctx context.Context, hashes []string) error
+	// DeleteBefore removes the logs of blocks older than the given number
+	DeleteBefore(ctx context.Context, number int64) error
+}
+
+var _ LogsRepo = (*MongoLogsRepo)(nil)
@@ -1,6 +1,12 @@
 package db
 
-import "github.com/onrik/ethrpc"
+import (
+	"avax-indexer/third_party"
+	"github.com/onrik/ethrpc"
+	"math/big"
+	"strconv"
+	"strings"
+)
 
 // FromResponse maps an ethrpc.Block to a domain Block
 func (Block) FromResponse(block *ethrpc.Block) *Block {
@@ -11,6 +17,7 @@ func (Block) FromResponse(block *ethrpc.Block) *Block {
 		result := make([]Transaction, len(tx))
 		for i, t := range tx {
 			result[i] = *Transaction{}.FromResponse(&t)
+			result[i].Timestamp = block.Timestamp
 		}
 		return result
 	}
@@ -53,3 +60,172 @@ func (Transaction) FromResponse(tx *ethrpc.Transaction) *Transaction {
 		Input:            tx.Input,
 	}
 }
+
+// WithReceipts sets the receipt fields of the block's transactions,
+// matching the receipts to the transactions by hash
+func (b *Block) WithReceipts(receipts []*third_party.Receipt) *Block {
+	byHash := make(map[string]*third_party.Receipt, len(receipts))
+	for _, r := range receipts {
+		byHash[r.TransactionHash] = r
+	}
+
+	for i := range b.Transactions {
+		r, ok := byHash[b.Transactions[i].Hash]
+		if !ok {
+			continue
+		}
+		b.Transactions[i].ApplyReceipt(r)
+	}
+
+	return b
+}
+
+// WithEnvelopes sets the envelope fields of the block's transactions,
+// matching the envelopes to the transactions by hash
+func (b *Block) WithEnvelopes(envelopes []*third_party.TxEnvelope) *Block {
+	byHash := make(map[string]*third_party.TxEnvelope, len(envelopes))
+	for _, e := range envelopes {
+		byHash[e.Hash] = e
+	}
+
+	for i := range b.Transactions {
+		e, ok := byHash[b.Transactions[i].Hash]
+		if !ok {
+			continue
+		}
+		b.Transactions[i].ApplyEnvelope(e)
+	}
+
+	return b
+}
+
+// ApplyEnvelope sets the envelope fields of a transaction
+func (t *Transaction) ApplyEnvelope(e *third_party.TxEnvelope) {
+	bigString := func(i *big.Int) string {
+		if i == nil {
+			return ""
+		}
+		return i.String()
+	}
+
+	t.Type = e.Type
+	t.ChainID = bigString(e.ChainID)
+	t.MaxFeePerGas = bigString(e.MaxFeePerGas)
+	t.MaxPriorityFeePerGas = bigString(e.MaxPriorityFeePerGas)
+	t.AccessList = nil
+	for _, a := range e.AccessList {
+		t.AccessList = append(t.AccessList, AccessTuple{Address: a.Address, StorageKeys: a.StorageKeys})
+	}
+	t.V = e.V
+	t.R = e.R
+	t.S = e.S
+}
+
+// ApplyReceipt sets the receipt fields of a transaction
+func (t *Transaction) ApplyReceipt(r *third_party.Receipt) {
+	if status, err := strconv.ParseInt(strings.TrimPrefix(r.Status, "0x"), 16, 64); err == nil {
+		s := int(status)
+		t.Status = &s
+	}
+	t.GasUsed = r.GasUsed
+	t.CumulativeGasUsed = r.CumulativeGasUsed
+	t.EffectiveGasPrice = r.EffectiveGasPrice.String()
+	t.ContractAddress = r.ContractAddress
+}
+
+// LogsFromReceipts maps the logs of the given receipts to domain Logs
+func LogsFromReceipts(receipts []*third_party.Receipt) []Log {
+	result := make([]Log, 0)
+	for _, r := range receipts {
+		for _, l := range r.Logs {
+			topic0 := ""
+			if len(l.Topics) > 0 {
+				topic0 = l.Topics[0]
+			}
+			result = append(result, Log{
+				Address:          l.Address,
+				Topic0:           topic0,
+				Topics:           l.Topics,
+				Data:             l.Data,
+				BlockNumber:      l.BlockNumber,
+				BlockHash:        l.BlockHash,
+				TransactionHash:  l.TransactionHash,
+				TransactionIndex: l.TransactionIndex,
+				LogIndex:         l.LogIndex,
+			})
+		}
+	}
+	return result
+}
+
+// InternalTransactionsFromTraces flattens the call trees of a block's transactions into
+// internal transactions, depth-first, leaving out the top-level calls,
+// which are the transactions themselves
+func InternalTransactionsFromTraces(blockHash string, blockNumber int, traces []*third_party.TxTrace) []InternalTransaction {
+	result := make([]InternalTransaction, 0)
+	for _, trace := range traces {
+		index := 0
+		var walk func(calls []third_party.CallFrame, depth int, reverted bool)
+		walk = func(calls []third_party.CallFrame, depth int, reverted bool) {
+			for _, c := range calls {
+				value := "0"
+				if c.Value != nil {
+					value = c.Value.String()
+				}
+				failed := reverted || c.Error != ""
+				result = append(result, InternalTransaction{
+					TransactionHash: trace.TxHash,
+					BlockHash:       blockHash,
+					BlockNumber:     blockNumber,
+					Index:           index,
+					Depth:           depth,
+					Type:            c.Type,
+					From:            strings.ToLower(c.From),
+					To:              strings.ToLower(c.To),
+					Value:           value,
+					Gas:             c.Gas,
+					GasUsed:         c.GasUsed,
+					Error:           c.Error,
+					Reverted:        failed,
+				})
+				index++
+				walk(c.Calls, depth+1, failed)
+			}
+		}
+		walk(trace.Result.Calls, 1, trace.Result.Error != "")
+	}
+	return result
+}
+
+// ContractsFromBlock returns the contracts created in the block, without their code hash
+// Failed creations are left out, and contracts created by contracts are only included
+// if the block's internal transactions are given
+func ContractsFromBlock(b *Block, internal []InternalTransaction) []Contract {
+	result := make([]Contract, 0)
+	for _, t := range b.Transactions {
+		if t.To != "" || t.ContractAddress == "" || (t.Status != nil && *t.Status == 0) {
+			continue
+		}
+		result = append(result, Contract{
+			Address:         strings.ToLower(t.ContractAddress),
+			Deployer:        strings.ToLower(t.From),
+			TransactionHash: t.Hash,
+			BlockHash:       b.Hash,
+			BlockNumber:     b.Number,
+		})
+	}
+	for _, it := range internal {
+		if it.Reverted || (it.Type != "CREATE" && it.Type != "CREATE2") {
+			continue
+		}
+		result = append(result, Contract{
+			Address:         it.To,
+			Deployer:        it.From,
+			TransactionHash: it.TransactionHash,
+			BlockHash:       b.Hash,
+			BlockNumber:     b.Number,
+			Internal:        true,
+		})
+	}
+	return result
+}
@@ -0,0 +1,263 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryBlocksRepo is an in-memory repository for blocks
+// It behaves like the capped blocks collection: blocks are kept in insertion order,
+// updates keep a block's position and the oldest inserted block is evicted
+// once the configured number of blocks is exceeded
+type MemoryBlocksRepo struct {
+	mu      sync.RWMutex
+	max     int64
+	blocks  []Block
+	orphans []OrphanedBlock
+}
+
+// NewMemoryBlocksRepo initializes a new in-memory blocks repository holding up to num blocks
+func NewMemoryBlocksRepo(num int64) *MemoryBlocksRepo {
+	return &MemoryBlocksRepo{
+		max:     num,
+		blocks:  make([]Block, 0),
+		orphans: make([]OrphanedBlock, 0),
+	}
+}
+
+// Insert inserts a block into the repository
+func (r *MemoryBlocksRepo) Insert(_ context.Context, block *Block) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.upsert(block)
+	return nil
+}
+
+// UpsertMany inserts or updates many blocks into the repository, given in any order
+// New blocks are inserted in ascending number order, like in the capped collection,
+// so the oldest blocks are evicted first
+func (r *MemoryBlocksRepo) UpsertMany(_ context.Context, blocks []*Block) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, b := range ascending(blocks) {
+		r.upsert(b)
+	}
+	return nil
+}
+
+// LastHead returns the last block number in the repository
+func (r *MemoryBlocksRepo) LastHead(_ context.Context) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	head := int64(0)
+	for _, b := range r.blocks {
+		if int64(b.Number) > head {
+			head = int64(b.Number)
+		}
+	}
+	return head, nil
+}
+
+// FirstHead returns the oldest block number in the repository
+func (r *MemoryBlocksRepo) FirstHead(_ context.Context) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.blocks) == 0 {
+		return 0, nil
+	}
+	head := int64(r.blocks[0].Number)
+	for _, b := range r.blocks {
+		if int64(b.Number) < head {
+			head = int64(b.Number)
+		}
+	}
+	return head, nil
+}
+
+// FindByNumber returns all stored blocks at the given height
+func (r *MemoryBlocksRepo) FindByNumber(_ context.Context, number int64) ([]Block, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make([]Block, 0)
+	for _, b := range r.blocks {
+		if int64(b.Number) == number {
+			res = append(res, b)
+		}
+	}
+	return res, nil
+}
+
+// FindBlocks returns the blocks matching the filter, from the newest to the oldest
+func (r *MemoryBlocksRepo) FindBlocks(_ context.Context, filter BlockFilter, limit int) ([]Block, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make([]Block, 0)
+	for _, b := range r.blocks {
+		if filter.Matches(&b) {
+			res = append(res, b)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Number > res[j].Number
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+// FindByHash returns the stored block with the given hash
+func (r *MemoryBlocksRepo) FindByHash(_ context.Context, hash string) (*Block, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i := r.indexOf(hash)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	b := r.blocks[i]
+	return &b, nil
+}
+
+// FindTransaction returns the stored transaction with the given hash
+func (r *MemoryBlocksRepo) FindTransaction(_ context.Context, hash string) (*Transaction, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, b := range r.blocks {
+		for _, t := range b.Transactions {
+			if t.Hash == hash {
+				return &t, nil
+			}
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// FindAddressTransactions returns the transactions sent from or to the address,
+// from the newest to the oldest, starting after the cursor if one is given
+func (r *MemoryBlocksRepo) FindAddressTransactions(_ context.Context, address string, cursor *TxCursor, limit int) ([]Transaction, error) {
+	return r.findAddressTransactions(address, 0, cursor, limit), nil
+}
+
+// FindAddressActivity returns the transactions sent from or to the address in blocks from fromBlock on,
+// as seen from the address, from the newest to the oldest, starting after the cursor if one is given
+func (r *MemoryBlocksRepo) FindAddressActivity(_ context.Context, address string, fromBlock int64, cursor *TxCursor, limit int) ([]Activity, error) {
+	txs := r.findAddressTransactions(address, fromBlock, cursor, limit)
+	res := make([]Activity, len(txs))
+	for i := range txs {
+		res[i] = NewActivity(address, &txs[i])
+	}
+	return res, nil
+}
+
+// findAddressTransactions returns the transactions sent from or to the address in blocks from fromBlock on,
+// from the newest to the oldest, starting after the cursor if one is given
+func (r *MemoryBlocksRepo) findAddressTransactions(address string, fromBlock int64, cursor *TxCursor, limit int) []Transaction {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make([]Transaction, 0)
+	for _, b := range r.blocks {
+		if int64(b.Number) < fromBlock {
+			continue
+		}
+		for _, t := range b.Transactions {
+			if t.From != address && t.To != address {
+				continue
+			}
+			if cursor != nil && !cursor.After(&t) {
+				continue
+			}
+			res = append(res, t)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return NewTxCursor(&res[i]).After(&res[j])
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res
+}
+
+// StoredNumbers returns the stored block numbers in the inclusive range, in ascending order
+func (r *MemoryBlocksRepo) StoredNumbers(_ context.Context, from int64, to int64) ([]int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make([]int64, 0)
+	for _, b := range r.blocks {
+		if int64(b.Number) >= from && int64(b.Number) <= to {
+			res = append(res, int64(b.Number))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res, nil
+}
+
+// MoveToOrphans moves the given blocks to the orphaned blocks,
+// recording the canonical block that replaced them
+func (r *MemoryBlocksRepo) MoveToOrphans(_ context.Context, blocks []Block, canonicalHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, b := range blocks {
+		r.orphans = append(r.orphans, OrphanedBlock{
+			Block:      b,
+			ReplacedBy: canonicalHash,
+			OrphanedAt: now,
+		})
+		if i := r.indexOf(b.Hash); i >= 0 {
+			r.blocks = append(r.blocks[:i], r.blocks[i+1:]...)
+		}
+	}
+	return nil
+}
+
+// Orphans returns the blocks orphaned so far
+func (r *MemoryBlocksRepo) Orphans() []OrphanedBlock {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make([]OrphanedBlock, len(r.orphans))
+	copy(res, r.orphans)
+	return res
+}
+
+// upsert replaces a block with the same hash in place or appends it,
+// evicting the oldest inserted block if the cap is exceeded
+// The caller must hold r.mu
+func (r *MemoryBlocksRepo) upsert(block *Block) {
+	if i := r.indexOf(block.Hash); i >= 0 {
+		r.blocks[i] = *block
+		return
+	}
+
+	r.blocks = append(r.blocks, *block)
+	if int64(len(r.blocks)) > r.max {
+		r.blocks = r.blocks[1:]
+	}
+}
+
+// indexOf returns the position of the block with the given hash or -1
+// The caller must hold r.mu
+func (r *MemoryBlocksRepo) indexOf(hash string) int {
+	for i, b := range r.blocks {
+		if b.Hash == hash {
+			return i
+		}
+	}
+	return -1
+}
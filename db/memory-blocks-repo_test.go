@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/exp/slices"
+	"testing"
+)
+
+func TestMemoryBlocksRepoUpsertManyEvictsOldest(t *testing.T) {
+	ascendingBlocks := make([]*Block, 0, 5)
+	descendingBlocks := make([]*Block, 0, 5)
+	for num := 1; num <= 5; num++ {
+		ascendingBlocks = append(ascendingBlocks, &Block{Number: num, Hash: fmt.Sprintf("0x%064x", num)})
+		descendingBlocks = append(descendingBlocks, &Block{Number: 6 - num, Hash: fmt.Sprintf("0x%064x", 6-num)})
+	}
+
+	tests := []struct {
+		name   string
+		blocks []*Block
+	}{
+		{"oldest first", ascendingBlocks},
+		{"newest first", descendingBlocks},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := NewMemoryBlocksRepo(3)
+			if err := repo.UpsertMany(ctx, tt.blocks); err != nil {
+				t.Fatalf("failed to upsert: %v", err)
+			}
+
+			stored, err := repo.StoredNumbers(ctx, 0, 10)
+			if err != nil {
+				t.Fatalf("failed to get stored numbers: %v", err)
+			}
+			if want := []int64{3, 4, 5}; !slices.Equal(stored, want) {
+				t.Errorf("stored %v, want the newest blocks %v", stored, want)
+			}
+
+			// Inserting a newer block evicts the oldest stored one
+			if err := repo.UpsertMany(ctx, []*Block{{Number: 6, Hash: fmt.Sprintf("0x%064x", 6)}}); err != nil {
+				t.Fatalf("failed to upsert: %v", err)
+			}
+			first, err := repo.FirstHead(ctx)
+			if err != nil {
+				t.Fatalf("failed to get first head: %v", err)
+			}
+			if first != 4 {
+				t.Errorf("got first head %d, want 4", first)
+			}
+		})
+	}
+}
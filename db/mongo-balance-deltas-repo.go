@@ -0,0 +1,141 @@
+package db
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+const balanceDeltasCollection = "balance_deltas"
+
+// MongoBalanceDeltasRepo is a repository for native AVAX balance deltas
+type MongoBalanceDeltasRepo struct {
+	db *mongo.Database
+}
+
+// NewMongoBalanceDeltasRepo initializes a new balance deltas repository
+// If the balance deltas collection does not exist, it will be created
+// and indexes will be created
+func NewMongoBalanceDeltasRepo(db *mongo.Database) (*MongoBalanceDeltasRepo, error) {
+	colls, err := db.ListCollectionNames(context.Background(), bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list collection names")
+	}
+
+	if !slices.Contains(colls, balanceDeltasCollection) {
+		slog.Info("creating balance deltas collection")
+		if err := db.CreateCollection(context.Background(), balanceDeltasCollection); err != nil {
+			return nil, errors.Wrap(err, "failed to create balance deltas collection")
+		}
+
+		idx := []mongo.IndexModel{
+			{
+				Keys: bson.D{
+					{
+						Key:   "block_hash",
+						Value: 1,
+					},
+					{
+						Key:   "address",
+						Value: 1,
+					},
+				},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys: bson.D{
+					{
+						Key:   "address",
+						Value: 1,
+					},
+					{
+						Key:   "block_number",
+						Value: -1,
+					},
+				},
+			},
+			{
+				Keys: bson.D{{
+					Key:   "block_number",
+					Value: -1,
+				}},
+			},
+		}
+		slog.Info("creating balance deltas indexes", "count", len(idx))
+		if _, err := db.Collection(balanceDeltasCollection).Indexes().CreateMany(context.Background(), idx); err != nil {
+			return nil, errors.Wrap(err, "failed to create balance deltas indexes")
+		}
+	}
+
+	return &MongoBalanceDeltasRepo{db: db}, nil
+}
+
+// UpsertMany inserts or updates many balance deltas, keyed by block hash and address
+func (r *MongoBalanceDeltasRepo) UpsertMany(ctx context.Context, deltas []BalanceDelta) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, len(deltas))
+	for i, d := range deltas {
+		models[i] = mongo.NewReplaceOneModel().
+			SetUpsert(true).
+			SetFilter(bson.M{
+				"block_hash": d.BlockHash,
+				"address":    d.Address,
+			}).
+			SetReplacement(d)
+	}
+
+	_, err := r.db.Collection(balanceDeltasCollection).
+		BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return errors.Wrap(err, "failed to bulk upsert balance deltas")
+	}
+
+	return nil
+}
+
+// DeleteByBlockHashes removes the balance deltas of the given blocks
+func (r *MongoBalanceDeltasRepo) DeleteByBlockHashes(ctx context.Context, hashes []string) error {
+	_, err := r.db.Collection(balanceDeltasCollection).
+		DeleteMany(ctx, bson.M{"block_hash": bson.M{"$in": hashes}})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete balance deltas by block hashes")
+	}
+
+	return nil
+}
+
+// DeleteBefore removes the balance deltas of blocks older than the given number
+func (r *MongoBalanceDeltasRepo) DeleteBefore(ctx context.Context, number int64) error {
+	_, err := r.db.Collection(balanceDeltasCollection).
+		DeleteMany(ctx, bson.M{"block_number": bson.M{"$lt": number}})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete old balance deltas")
+	}
+
+	return nil
+}
+
+// SumBalanceDeltas sums the balance deltas of an address from fromBlock to toBlock, inclusive
+func (r *MongoBalanceDeltasRepo) SumBalanceDeltas(ctx context.Context, address string, fromBlock int64, toBlock int64) (*BalanceSum, error) {
+	cur, err := r.db.Collection(balanceDeltasCollection).Find(ctx, bson.M{
+		"address":      address,
+		"block_number": bson.M{"$gte": fromBlock, "$lte": toBlock},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find balance deltas")
+	}
+
+	deltas := make([]BalanceDelta, 0)
+	if err := cur.All(ctx, &deltas); err != nil {
+		return nil, errors.Wrap(err, "failed to decode balance deltas")
+	}
+
+	return SumBalanceDeltas(address, fromBlock, toBlock, deltas), nil
+}
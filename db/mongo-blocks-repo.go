@@ -1,29 +1,58 @@
 package db
 
 import (
+	"avax-indexer/metrics"
 	"context"
-	"github.com/onrik/ethrpc"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/exp/slices"
 	"golang.org/x/exp/slog"
+	"sort"
+	"sync/atomic"
+	"time"
 )
 
 const blocksCollection = "blocks"
+const orphansCollection = "orphaned_blocks"
+const transactionsCollection = "transactions"
+const migrationsCollection = "migrations"
 const blocksRange = 10000
 const avgBlockSizeBytes = 50 * 1000 // 50 kb
 
+// sweepEvery is the number of writes to the live repository between sweeps
+// of the transactions of the blocks evicted from the capped blocks collection
+const sweepEvery = 100
+
+// minServerMajor is the oldest MongoDB major version allowing deletes from capped collections,
+// which orphaning blocks relies on
+const minServerMajor = 5
+
 // MongoBlocksRepo is a repository for blocks
+// Transactions are stored in their own collection keyed by hash, written along with their block
+// and attached to the blocks read back. Blocks stored before they were split out keep
+// their embedded transactions, which are copied to the transactions collection once, on startup
+// A block and its transactions are written separately, the block first, so a block read back
+// while its write is in flight or failed half way may lack some of its transactions until it is written again
+// The transactions of the live repository are swept every sweepEvery writes, removing the ones
+// whose block was evicted from the capped blocks collection
 type MongoBlocksRepo struct {
-	db *mongo.Database
+	db     *mongo.Database
+	coll   string
+	txColl string
+	trim   bool
+	writes atomic.Int64
 }
 
 // NewMongoBlocksRepo initializes a new blocks repository
 // If the blocks collection does not exist, it will be created
 // and indexes will be created
 func NewMongoBlocksRepo(db *mongo.Database, num int64, docSize int64) (*MongoBlocksRepo, error) {
+	if err := checkServerVersion(db); err != nil {
+		return nil, err
+	}
+
 	colls, err := db.ListCollectionNames(context.Background(), bson.M{})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to list collection names")
@@ -43,6 +72,19 @@ func NewMongoBlocksRepo(db *mongo.Database, num int64, docSize int64) (*MongoBlo
 		}
 
 		// create indexes
+		idx := blocksIndexes()
+		slog.Info("creating indexes", "count", len(idx))
+		if _, err := db.Collection(blocksCollection).Indexes().CreateMany(context.Background(), idx); err != nil {
+			return nil, errors.Wrap(err, "failed to create indexes")
+		}
+	}
+
+	if !slices.Contains(colls, orphansCollection) {
+		slog.Info("creating orphaned blocks collection")
+		if err := db.CreateCollection(context.Background(), orphansCollection); err != nil {
+			return nil, errors.Wrap(err, "failed to create orphaned blocks collection")
+		}
+
 		idx := []mongo.IndexModel{
 			{
 				Keys: bson.D{{
@@ -50,122 +92,462 @@ func NewMongoBlocksRepo(db *mongo.Database, num int64, docSize int64) (*MongoBlo
 					Value: -1,
 				}},
 			},
-			{
-				Keys: bson.D{{
-					Key:   "timestamp",
-					Value: -1,
-				}},
-			},
 			{
 				Keys: bson.D{{
 					Key:   "hash",
 					Value: -1,
 				}},
 			},
-			{
-				Keys: bson.D{
-					{
-						Key:   "transactions.from",
-						Value: -1,
-					},
-					{
-						Key:   "transactions.value",
-						Value: -1,
-					},
+		}
+		if _, err := db.Collection(orphansCollection).Indexes().CreateMany(context.Background(), idx); err != nil {
+			return nil, errors.Wrap(err, "failed to create orphaned blocks indexes")
+		}
+	}
+
+	if err := createTransactionsCollection(db, colls, transactionsCollection); err != nil {
+		return nil, err
+	}
+	if err := migrateEmbeddedTransactions(db, blocksCollection, transactionsCollection); err != nil {
+		return nil, err
+	}
+
+	return &MongoBlocksRepo{db: db, coll: blocksCollection, txColl: transactionsCollection, trim: true}, nil
+}
+
+// checkServerVersion fails if the MongoDB server is older than minServerMajor
+func checkServerVersion(db *mongo.Database) error {
+	var info struct {
+		Version      string  `bson:"version"`
+		VersionArray []int32 `bson:"versionArray"`
+	}
+	if err := db.RunCommand(context.Background(), bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info); err != nil {
+		return errors.Wrap(err, "failed to get mongo server version")
+	}
+	if len(info.VersionArray) == 0 || info.VersionArray[0] < minServerMajor {
+		return errors.Errorf("mongo server %s is not supported, %d.0 or newer is required to orphan blocks from the capped blocks collection", info.Version, minServerMajor)
+	}
+
+	return nil
+}
+
+// NewMongoHistoricalBlocksRepo initializes a blocks repository over an uncapped collection
+// It is used to load historical block ranges without touching the live capped collection
+// If the collection does not exist, it will be created with the same indexes as the blocks collection
+// Its transactions are stored in the collection suffixed with _transactions
+func NewMongoHistoricalBlocksRepo(db *mongo.Database, collection string) (*MongoBlocksRepo, error) {
+	txCollection := collection + "_" + transactionsCollection
+	reserved := []string{blocksCollection, orphansCollection, transactionsCollection, migrationsCollection}
+	if slices.Contains(reserved, collection) || slices.Contains(reserved, txCollection) {
+		return nil, errors.Errorf("collection %s is reserved for live blocks", collection)
+	}
+
+	colls, err := db.ListCollectionNames(context.Background(), bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list collection names")
+	}
+
+	if !slices.Contains(colls, collection) {
+		slog.Info("creating historical blocks collection", "collection", collection)
+		if err := db.CreateCollection(context.Background(), collection); err != nil {
+			return nil, errors.Wrap(err, "failed to create historical blocks collection")
+		}
+
+		idx := blocksIndexes()
+		slog.Info("creating indexes", "count", len(idx))
+		if _, err := db.Collection(collection).Indexes().CreateMany(context.Background(), idx); err != nil {
+			return nil, errors.Wrap(err, "failed to create indexes")
+		}
+	}
+
+	if err := createTransactionsCollection(db, colls, txCollection); err != nil {
+		return nil, err
+	}
+	if err := migrateEmbeddedTransactions(db, collection, txCollection); err != nil {
+		return nil, err
+	}
+
+	return &MongoBlocksRepo{db: db, coll: collection, txColl: txCollection}, nil
+}
+
+// migrateEmbeddedTransactions copies the transactions embedded in the blocks stored before
+// transactions were split out into the transactions collection, so they can be found by hash and address
+// The blocks keep their embedded copy, as documents of a capped collection cannot shrink
+// It runs once per transactions collection, which is recorded in the migrations collection
+func migrateEmbeddedTransactions(db *mongo.Database, coll string, txColl string) error {
+	ctx := context.Background()
+	id := "embedded_transactions:" + txColl
+	err := db.Collection(migrationsCollection).FindOne(ctx, bson.M{"_id": id}).Err()
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return errors.Wrap(err, "failed to find migration")
+	}
+
+	cur, err := db.Collection(coll).Find(ctx, bson.M{"transactions.0": bson.M{"$exists": true}})
+	if err != nil {
+		return errors.Wrap(err, "failed to find blocks with embedded transactions")
+	}
+	defer cur.Close(ctx)
+
+	models := make([]mongo.WriteModel, 0)
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := db.Collection(txColl).
+			BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return errors.Wrap(err, "failed to copy embedded transactions")
+		}
+		models = models[:0]
+		return nil
+	}
+
+	blocks, txs := 0, 0
+	for cur.Next(ctx) {
+		var b Block
+		if err := cur.Decode(&b); err != nil {
+			return errors.Wrap(err, "failed to decode block")
+		}
+		for _, t := range b.Transactions {
+			// Timestamps were only stored on the block before the split
+			if t.Timestamp == 0 {
+				t.Timestamp = b.Timestamp
+			}
+			models = append(models, transactionModel(t))
+		}
+		blocks++
+		txs += len(b.Transactions)
+
+		if len(models) >= 1000 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return errors.Wrap(err, "failed to read blocks with embedded transactions")
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	_, err = db.Collection(migrationsCollection).InsertOne(ctx, bson.M{"_id": id, "migrated_at": time.Now().UTC()})
+	if err != nil {
+		return errors.Wrap(err, "failed to record migration")
+	}
+	if blocks > 0 {
+		slog.Info("copied embedded transactions", "collection", txColl, "blocks", blocks, "transactions", txs)
+	}
+
+	return nil
+}
+
+// createTransactionsCollection creates a transactions collection and its indexes,
+// unless it is among the existing collections
+// Transactions are looked up by hash through _id, by block, and by sender or recipient
+// from the newest to the oldest
+func createTransactionsCollection(db *mongo.Database, colls []string, name string) error {
+	if slices.Contains(colls, name) {
+		return nil
+	}
+
+	slog.Info("creating transactions collection", "collection", name)
+	if err := db.CreateCollection(context.Background(), name); err != nil {
+		return errors.Wrap(err, "failed to create transactions collection")
+	}
+
+	idx := []mongo.IndexModel{
+		{
+			Keys: bson.D{{
+				Key:   "block_hash",
+				Value: 1,
+			}},
+		},
+		{
+			Keys: bson.D{
+				{
+					Key:   "block_number",
+					Value: -1,
 				},
-			},
-			{
-				Keys: bson.D{
-					{
-						Key:   "transactions.to",
-						Value: -1,
-					},
-					{
-						Key:   "transactions.value",
-						Value: -1,
-					},
+				{
+					Key:   "transaction_index",
+					Value: -1,
 				},
 			},
-			{
-				Keys: bson.D{
-					{
-						Key:   "transactions.hash",
-						Value: -1,
-					},
+		},
+		{
+			Keys: bson.D{
+				{
+					Key:   "from",
+					Value: 1,
+				},
+				{
+					Key:   "block_number",
+					Value: -1,
+				},
+				{
+					Key:   "transaction_index",
+					Value: -1,
 				},
 			},
-			{
-				Keys: bson.D{
-					{
-						Key:   "transactions.block_number",
-						Value: -1,
-					},
-					{
-						Key:   "transactions.transaction_index",
-						Value: -1,
-					},
+		},
+		{
+			Keys: bson.D{
+				{
+					Key:   "to",
+					Value: 1,
+				},
+				{
+					Key:   "block_number",
+					Value: -1,
+				},
+				{
+					Key:   "transaction_index",
+					Value: -1,
 				},
 			},
-		}
-		slog.Info("creating indexes", "count", len(idx))
-		if _, err := db.Collection(blocksCollection).Indexes().CreateMany(context.Background(), idx); err != nil {
-			return nil, errors.Wrap(err, "failed to create indexes")
-		}
+		},
+	}
+	if _, err := db.Collection(name).Indexes().CreateMany(context.Background(), idx); err != nil {
+		return errors.Wrap(err, "failed to create transactions indexes")
 	}
 
-	return &MongoBlocksRepo{db: db}, nil
+	return nil
+}
+
+// blocksIndexes returns the indexes of a blocks collection
+func blocksIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys: bson.D{{
+				Key:   "number",
+				Value: -1,
+			}},
+		},
+		{
+			Keys: bson.D{{
+				Key:   "timestamp",
+				Value: -1,
+			}},
+		},
+		{
+			Keys: bson.D{{
+				Key:   "hash",
+				Value: -1,
+			}},
+		},
+	}
 }
 
-// Insert inserts a block into the database
-func (r *MongoBlocksRepo) Insert(ctx context.Context, block *ethrpc.Block) error {
-	m := Block{}.FromResponse(block)
+// Insert inserts a block into the database, followed by its transactions
+func (r *MongoBlocksRepo) Insert(ctx context.Context, m *Block) error {
+	defer metrics.Since(metrics.DbWriteDuration.WithLabelValues("mongo", "insert"), time.Now())
+
 	opts := options.Update().
 		SetUpsert(true)
 	f := bson.M{
 		"hash": m.Hash,
 	}
 	u := bson.M{
-		"$set": m,
+		"$set": withoutTransactions(m),
 	}
 
-	_, err := r.db.Collection(blocksCollection).UpdateOne(ctx, f, u, opts)
-	return err
+	if _, err := r.db.Collection(r.coll).UpdateOne(ctx, f, u, opts); err != nil {
+		return err
+	}
+	if err := r.upsertTransactions(ctx, []*Block{m}); err != nil {
+		return err
+	}
+
+	return r.trimTransactions(ctx)
 }
 
-// UpsertMany inserts or updates many blocks into the database
-func (r *MongoBlocksRepo) UpsertMany(ctx context.Context, blocks []*ethrpc.Block) error {
-	models := make([]mongo.WriteModel, 0)
-	for i := len(blocks) - 1; i >= 0; i-- {
-		b := blocks[i]
-		m := Block{}.FromResponse(b)
+// UpsertMany inserts or updates many blocks into the database, followed by their transactions
+func (r *MongoBlocksRepo) UpsertMany(ctx context.Context, blocks []*Block) error {
+	defer metrics.Since(metrics.DbWriteDuration.WithLabelValues("mongo", "upsert_many"), time.Now())
 
+	// The capped collection evicts blocks in insertion order, so they are written oldest first
+	blocks = ascending(blocks)
+	models := make([]mongo.WriteModel, 0)
+	for _, m := range blocks {
 		upd := mongo.NewUpdateOneModel().
 			SetUpsert(true).
 			SetFilter(bson.M{
 				"hash": m.Hash,
 			}).
 			SetUpdate(bson.M{
-				"$set": m,
+				"$set": withoutTransactions(m),
 			})
 
 		models = append(models, upd)
 	}
 
-	_, err := r.db.Collection(blocksCollection).
+	_, err := r.db.Collection(r.coll).
 		BulkWrite(ctx, models)
 	if err != nil {
 		return errors.Wrap(err, "failed to bulk upsert blocks")
 	}
+	if err := r.upsertTransactions(ctx, blocks); err != nil {
+		return err
+	}
+
+	return r.trimTransactions(ctx)
+}
+
+// ascending returns a copy of the blocks sorted by ascending number
+func ascending(blocks []*Block) []*Block {
+	sorted := slices.Clone(blocks)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Number < sorted[j].Number
+	})
+	return sorted
+}
+
+// withoutTransactions returns a copy of the block without its transactions,
+// which are stored in the transactions collection
+func withoutTransactions(m *Block) *Block {
+	b := *m
+	b.Transactions = nil
+	return &b
+}
+
+// upsertTransactions inserts or updates the transactions of the blocks by hash
+func (r *MongoBlocksRepo) upsertTransactions(ctx context.Context, blocks []*Block) error {
+	models := make([]mongo.WriteModel, 0)
+	for _, b := range blocks {
+		for _, t := range b.Transactions {
+			models = append(models, transactionModel(t))
+		}
+	}
+	if len(models) == 0 {
+		return nil
+	}
+
+	_, err := r.db.Collection(r.txColl).
+		BulkWrite(ctx, models)
+	if err != nil {
+		return errors.Wrap(err, "failed to bulk upsert transactions")
+	}
+
+	return nil
+}
+
+// transactionModel returns the write inserting or updating a transaction by hash
+func transactionModel(t Transaction) mongo.WriteModel {
+	return mongo.NewUpdateOneModel().
+		SetUpsert(true).
+		SetFilter(bson.M{
+			"_id": t.Hash,
+		}).
+		SetUpdate(bson.M{
+			"$set": t,
+		})
+}
+
+// trimTransactions removes the transactions of the blocks that are no longer stored,
+// on the first and then on every sweepEvery-th write to the live repository
+// The capped blocks collection evicts blocks silently and by insertion order rather than by number,
+// so the block hashes of the transactions are checked against the stored blocks
+func (r *MongoBlocksRepo) trimTransactions(ctx context.Context) error {
+	if !r.trim || r.writes.Add(1)%sweepEvery != 1 {
+		return nil
+	}
+
+	// Blocks are written before their transactions, so reading the block hashes of the transactions
+	// first leaves out the transactions of blocks written concurrently
+	txBlocks, err := r.db.Collection(r.txColl).Distinct(ctx, "block_hash", bson.M{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list the blocks of stored transactions")
+	}
+	hashes, err := r.db.Collection(r.coll).Distinct(ctx, "hash", bson.M{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list stored blocks")
+	}
+
+	stored := make(map[interface{}]bool, len(hashes))
+	for _, h := range hashes {
+		stored[h] = true
+	}
+	evicted := make([]interface{}, 0)
+	for _, h := range txBlocks {
+		if !stored[h] {
+			evicted = append(evicted, h)
+		}
+	}
+	if len(evicted) == 0 {
+		return nil
+	}
+
+	_, err = r.db.Collection(r.txColl).
+		DeleteMany(ctx, bson.M{"block_hash": bson.M{"$in": evicted}})
+	if err != nil {
+		return errors.Wrap(err, "failed to trim transactions")
+	}
+
+	return nil
+}
+
+// attachTransactions sets the transactions of the blocks that were stored without embedded ones,
+// ordered by index
+func (r *MongoBlocksRepo) attachTransactions(ctx context.Context, blocks []Block) error {
+	hashes := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		if len(b.Transactions) == 0 {
+			hashes = append(hashes, b.Hash)
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "transaction_index", Value: 1}})
+	cur, err := r.db.Collection(r.txColl).
+		Find(ctx, bson.M{"block_hash": bson.M{"$in": hashes}}, opts)
+	if err != nil {
+		return errors.Wrap(err, "failed to find block transactions")
+	}
+	defer cur.Close(ctx)
+
+	txs := make([]Transaction, 0)
+	if err := cur.All(ctx, &txs); err != nil {
+		return errors.Wrap(err, "failed to decode block transactions")
+	}
+
+	byBlock := make(map[string][]Transaction, len(hashes))
+	for _, t := range txs {
+		byBlock[t.BlockHash] = append(byBlock[t.BlockHash], t)
+	}
+	for i := range blocks {
+		if len(blocks[i].Transactions) == 0 {
+			blocks[i].Transactions = byBlock[blocks[i].Hash]
+			if blocks[i].Transactions == nil {
+				blocks[i].Transactions = make([]Transaction, 0)
+			}
+		}
+	}
 
 	return nil
 }
 
 // LastHead returns the last block number in the database
 func (r *MongoBlocksRepo) LastHead(ctx context.Context) (int64, error) {
+	return r.head(ctx, -1)
+}
+
+// FirstHead returns the oldest block number in the database
+func (r *MongoBlocksRepo) FirstHead(ctx context.Context) (int64, error) {
+	return r.head(ctx, 1)
+}
+
+// head returns the first block number in the database in the given sort order
+func (r *MongoBlocksRepo) head(ctx context.Context, order int) (int64, error) {
 	agg := []bson.M{
 		{
 			"$sort": bson.M{
-				"number": -1,
+				"number": order,
 			},
 		},
 		{
@@ -178,10 +560,10 @@ func (r *MongoBlocksRepo) LastHead(ctx context.Context) (int64, error) {
 		},
 	}
 
-	cur, err := r.db.Collection(blocksCollection).
+	cur, err := r.db.Collection(r.coll).
 		Aggregate(ctx, agg)
 	if err != nil {
-		return 0, errors.Wrap(err, "failed to aggregate latest block number")
+		return 0, errors.Wrap(err, "failed to aggregate head block number")
 	}
 	defer cur.Close(ctx)
 
@@ -192,11 +574,277 @@ func (r *MongoBlocksRepo) LastHead(ctx context.Context) (int64, error) {
 		return 0, nil
 	}
 	if err := cur.Decode(&res); err != nil {
-		return 0, errors.Wrap(err, "failed to decode latest block number")
+		return 0, errors.Wrap(err, "failed to decode head block number")
 	}
 	if cur.Err() != nil {
-		return 0, errors.Wrap(cur.Err(), "failed to iterate latest block number")
+		return 0, errors.Wrap(cur.Err(), "failed to iterate head block number")
 	}
 
 	return res.Number, nil
 }
+
+// StoredNumbers returns the stored block numbers in the inclusive range, in ascending order
+func (r *MongoBlocksRepo) StoredNumbers(ctx context.Context, from int64, to int64) ([]int64, error) {
+	opts := options.Find().
+		SetSort(bson.M{"number": 1}).
+		SetProjection(bson.M{"_id": 0, "number": 1})
+	f := bson.M{
+		"number": bson.M{
+			"$gte": from,
+			"$lte": to,
+		},
+	}
+
+	cur, err := r.db.Collection(r.coll).
+		Find(ctx, f, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find stored block numbers")
+	}
+	defer cur.Close(ctx)
+
+	res := make([]int64, 0)
+	for cur.Next(ctx) {
+		var doc struct {
+			Number int64 `bson:"number"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return nil, errors.Wrap(err, "failed to decode stored block number")
+		}
+		res = append(res, doc.Number)
+	}
+	if cur.Err() != nil {
+		return nil, errors.Wrap(cur.Err(), "failed to iterate stored block numbers")
+	}
+
+	return res, nil
+}
+
+// FindByNumber returns all stored blocks at the given height
+// More than one block is returned only if a reorg has not been resolved yet
+func (r *MongoBlocksRepo) FindByNumber(ctx context.Context, number int64) ([]Block, error) {
+	cur, err := r.db.Collection(r.coll).
+		Find(ctx, bson.M{"number": number})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find blocks by number")
+	}
+	defer cur.Close(ctx)
+
+	res := make([]Block, 0)
+	if err := cur.All(ctx, &res); err != nil {
+		return nil, errors.Wrap(err, "failed to decode blocks by number")
+	}
+	if err := r.attachTransactions(ctx, res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// FindBlocks returns the blocks matching the filter, from the newest to the oldest
+func (r *MongoBlocksRepo) FindBlocks(ctx context.Context, filter BlockFilter, limit int) ([]Block, error) {
+	query := bson.M{}
+	if number := rangeQuery(filter.FromNumber, filter.ToNumber); len(number) > 0 {
+		query["number"] = number
+	}
+	if timestamp := rangeQuery(filter.FromTime, filter.ToTime); len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "number", Value: -1}}).
+		SetLimit(int64(limit))
+	cur, err := r.db.Collection(r.coll).Find(ctx, query, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find blocks")
+	}
+	defer cur.Close(ctx)
+
+	res := make([]Block, 0)
+	if err := cur.All(ctx, &res); err != nil {
+		return nil, errors.Wrap(err, "failed to decode blocks")
+	}
+	if err := r.attachTransactions(ctx, res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// rangeQuery builds an inclusive range condition from optional bounds
+func rangeQuery(from, to *int64) bson.M {
+	q := bson.M{}
+	if from != nil {
+		q["$gte"] = *from
+	}
+	if to != nil {
+		q["$lte"] = *to
+	}
+	return q
+}
+
+// MoveToOrphans moves the given blocks from the blocks collection
+// to the orphaned blocks collection, recording the canonical block that replaced them
+// Orphans are upserted by hash, so retrying after a failed delete does not record them twice
+func (r *MongoBlocksRepo) MoveToOrphans(ctx context.Context, blocks []Block, canonicalHash string) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	defer metrics.Since(metrics.DbWriteDuration.WithLabelValues("mongo", "move_to_orphans"), time.Now())
+
+	now := time.Now().UTC()
+	models := make([]mongo.WriteModel, len(blocks))
+	hashes := make([]string, len(blocks))
+	for i, b := range blocks {
+		models[i] = mongo.NewReplaceOneModel().
+			SetUpsert(true).
+			SetFilter(bson.M{"hash": b.Hash}).
+			SetReplacement(OrphanedBlock{
+				Block:      b,
+				ReplacedBy: canonicalHash,
+				OrphanedAt: now,
+			})
+		hashes[i] = b.Hash
+	}
+
+	if _, err := r.db.Collection(orphansCollection).BulkWrite(ctx, models); err != nil {
+		return errors.Wrap(err, "failed to upsert orphaned blocks")
+	}
+
+	_, err := r.db.Collection(r.coll).
+		DeleteMany(ctx, bson.M{"hash": bson.M{"$in": hashes}})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete orphaned blocks")
+	}
+
+	// Transactions included again by the canonical block were rewritten with its hash and are kept
+	_, err = r.db.Collection(r.txColl).
+		DeleteMany(ctx, bson.M{"block_hash": bson.M{"$in": hashes}})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete orphaned transactions")
+	}
+
+	return nil
+}
+
+// FindByHash returns the stored block with the given hash
+func (r *MongoBlocksRepo) FindByHash(ctx context.Context, hash string) (*Block, error) {
+	var res Block
+	err := r.db.Collection(r.coll).
+		FindOne(ctx, bson.M{"hash": hash}).
+		Decode(&res)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "failed to find block by hash")
+	}
+
+	blocks := []Block{res}
+	if err := r.attachTransactions(ctx, blocks); err != nil {
+		return nil, err
+	}
+
+	return &blocks[0], nil
+}
+
+// FindTransaction returns the stored transaction with the given hash
+func (r *MongoBlocksRepo) FindTransaction(ctx context.Context, hash string) (*Transaction, error) {
+	var res Transaction
+	err := r.db.Collection(r.txColl).
+		FindOne(ctx, bson.M{"_id": hash}).
+		Decode(&res)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "failed to find transaction by hash")
+	}
+
+	return &res, nil
+}
+
+// FindAddressTransactions returns the transactions sent from or to the address,
+// from the newest to the oldest, starting after the cursor if one is given
+func (r *MongoBlocksRepo) FindAddressTransactions(ctx context.Context, address string, cursor *TxCursor, limit int) ([]Transaction, error) {
+	return r.findAddressTransactions(ctx, address, 0, cursor, limit, nil)
+}
+
+// FindAddressActivity returns the transactions sent from or to the address in blocks from fromBlock on,
+// as seen from the address, from the newest to the oldest, starting after the cursor if one is given
+// Only the fields an activity is built from are loaded
+func (r *MongoBlocksRepo) FindAddressActivity(ctx context.Context, address string, fromBlock int64, cursor *TxCursor, limit int) ([]Activity, error) {
+	projection := bson.M{
+		"hash":                1,
+		"block_number":        1,
+		"transaction_index":   1,
+		"timestamp":           1,
+		"from":                1,
+		"to":                  1,
+		"value":               1,
+		"status":              1,
+		"gas_used":            1,
+		"effective_gas_price": 1,
+		"contract_address":    1,
+	}
+	txs, err := r.findAddressTransactions(ctx, address, fromBlock, cursor, limit, projection)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Activity, len(txs))
+	for i := range txs {
+		res[i] = NewActivity(address, &txs[i])
+	}
+	return res, nil
+}
+
+// findAddressTransactions returns the transactions sent from or to the address in blocks from fromBlock on,
+// from the newest to the oldest, starting after the cursor if one is given
+// Each side of the match uses its address index, which is already in the result order
+func (r *MongoBlocksRepo) findAddressTransactions(ctx context.Context, address string, fromBlock int64, cursor *TxCursor, limit int, projection bson.M) ([]Transaction, error) {
+	conds := []bson.M{
+		{
+			"$or": []bson.M{
+				{"from": address},
+				{"to": address},
+			},
+		},
+	}
+	if fromBlock > 0 {
+		conds = append(conds, bson.M{"block_number": bson.M{"$gte": fromBlock}})
+	}
+	if cursor != nil {
+		conds = append(conds, bson.M{
+			"$or": []bson.M{
+				{"block_number": bson.M{"$lt": cursor.BlockNumber}},
+				{
+					"block_number":      cursor.BlockNumber,
+					"transaction_index": bson.M{"$lt": cursor.TransactionIndex},
+				},
+			},
+		})
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{
+			{Key: "block_number", Value: -1},
+			{Key: "transaction_index", Value: -1},
+		}).
+		SetLimit(int64(limit))
+	if projection != nil {
+		opts.SetProjection(projection)
+	}
+	cur, err := r.db.Collection(r.txColl).
+		Find(ctx, bson.M{"$and": conds}, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find address transactions")
+	}
+	defer cur.Close(ctx)
+
+	res := make([]Transaction, 0)
+	if err := cur.All(ctx, &res); err != nil {
+		return nil, errors.Wrap(err, "failed to decode address transactions")
+	}
+
+	return res, nil
+}
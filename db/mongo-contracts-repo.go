@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	contractsCollection    = "contracts"
+	contractCodeCollection = "contract_code"
+)
+
+// MongoContractsRepo is a repository for deployed contracts and their runtime code
+type MongoContractsRepo struct {
+	db *mongo.Database
+}
+
+// NewMongoContractsRepo initializes a new contracts repository
+// If the contracts and code collections do not exist, they will be created
+// and indexes will be created
+func NewMongoContractsRepo(db *mongo.Database) (*MongoContractsRepo, error) {
+	colls, err := db.ListCollectionNames(context.Background(), bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list collection names")
+	}
+
+	if !slices.Contains(colls, contractCodeCollection) {
+		slog.Info("creating contract code collection")
+		if err := db.CreateCollection(context.Background(), contractCodeCollection); err != nil {
+			return nil, errors.Wrap(err, "failed to create contract code collection")
+		}
+	}
+
+	if !slices.Contains(colls, contractsCollection) {
+		slog.Info("creating contracts collection")
+		if err := db.CreateCollection(context.Background(), contractsCollection); err != nil {
+			return nil, errors.Wrap(err, "failed to create contracts collection")
+		}
+
+		idx := []mongo.IndexModel{
+			{
+				Keys: bson.D{{
+					Key:   "address",
+					Value: 1,
+				}},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys: bson.D{
+					{
+						Key:   "code_hash",
+						Value: 1,
+					},
+					{
+						Key:   "block_number",
+						Value: -1,
+					},
+				},
+			},
+			{
+				Keys: bson.D{{
+					Key:   "block_hash",
+					Value: 1,
+				}},
+			},
+		}
+		slog.Info("creating contracts indexes", "count", len(idx))
+		if _, err := db.Collection(contractsCollection).Indexes().CreateMany(context.Background(), idx); err != nil {
+			return nil, errors.Wrap(err, "failed to create contracts indexes")
+		}
+	}
+
+	return &MongoContractsRepo{db: db}, nil
+}
+
+// UpsertMany stores the code, skipping code hashes already stored, and inserts or updates the contracts by address
+// The code is written first, so a stored contract always has its code
+func (r *MongoContractsRepo) UpsertMany(ctx context.Context, contracts []Contract, codes []Bytecode) error {
+	if len(codes) > 0 {
+		models := make([]mongo.WriteModel, len(codes))
+		for i, c := range codes {
+			models[i] = mongo.NewUpdateOneModel().
+				SetUpsert(true).
+				SetFilter(bson.M{"_id": c.CodeHash}).
+				SetUpdate(bson.M{"$setOnInsert": bson.M{"code": c.Code}})
+		}
+
+		_, err := r.db.Collection(contractCodeCollection).
+			BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return errors.Wrap(err, "failed to bulk upsert contract code")
+		}
+	}
+
+	if len(contracts) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, len(contracts))
+	for i, c := range contracts {
+		models[i] = mongo.NewReplaceOneModel().
+			SetUpsert(true).
+			SetFilter(bson.M{"address": c.Address}).
+			SetReplacement(c)
+	}
+
+	_, err := r.db.Collection(contractsCollection).
+		BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return errors.Wrap(err, "failed to bulk upsert contracts")
+	}
+
+	return nil
+}
+
+// DeleteByBlockHashes removes the contracts created in the given blocks
+func (r *MongoContractsRepo) DeleteByBlockHashes(ctx context.Context, hashes []string) error {
+	_, err := r.db.Collection(contractsCollection).
+		DeleteMany(ctx, bson.M{"block_hash": bson.M{"$in": hashes}})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete contracts by block hashes")
+	}
+
+	return nil
+}
+
+// FindByAddress returns the contract deployed at the given address or ErrNotFound
+func (r *MongoContractsRepo) FindByAddress(ctx context.Context, address string) (*Contract, error) {
+	var res Contract
+	err := r.db.Collection(contractsCollection).
+		FindOne(ctx, bson.M{"address": address}).
+		Decode(&res)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "failed to find contract by address")
+	}
+
+	return &res, nil
+}
+
+// FindByCodeHash returns up to limit contracts with the given code hash, newest first
+func (r *MongoContractsRepo) FindByCodeHash(ctx context.Context, codeHash string, limit int) ([]Contract, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "block_number", Value: -1}}).
+		SetLimit(int64(limit))
+	cur, err := r.db.Collection(contractsCollection).
+		Find(ctx, bson.M{"code_hash": codeHash}, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find contracts by code hash")
+	}
+
+	res := make([]Contract, 0)
+	if err := cur.All(ctx, &res); err != nil {
+		return nil, errors.Wrap(err, "failed to decode contracts")
+	}
+
+	return res, nil
+}
+
+// FindCode returns the code with the given hash or ErrNotFound
+func (r *MongoContractsRepo) FindCode(ctx context.Context, codeHash string) (*Bytecode, error) {
+	var res Bytecode
+	err := r.db.Collection(contractCodeCollection).
+		FindOne(ctx, bson.M{"_id": codeHash}).
+		Decode(&res)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "failed to find contract code")
+	}
+
+	return &res, nil
+}
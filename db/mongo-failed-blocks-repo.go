@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+const failedBlocksCollection = "failed_blocks"
+
+// MongoFailedBlocksRepo is a repository for blocks that failed processing
+type MongoFailedBlocksRepo struct {
+	db *mongo.Database
+}
+
+// NewMongoFailedBlocksRepo initializes a new failed blocks repository
+// If the failed blocks collection does not exist, it will be created
+// and indexes will be created
+func NewMongoFailedBlocksRepo(db *mongo.Database) (*MongoFailedBlocksRepo, error) {
+	colls, err := db.ListCollectionNames(context.Background(), bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list collection names")
+	}
+
+	if !slices.Contains(colls, failedBlocksCollection) {
+		slog.Info("creating failed blocks collection")
+		if err := db.CreateCollection(context.Background(), failedBlocksCollection); err != nil {
+			return nil, errors.Wrap(err, "failed to create failed blocks collection")
+		}
+
+		idx := []mongo.IndexModel{
+			{
+				Keys: bson.D{
+					{
+						Key:   "hash",
+						Value: 1,
+					},
+					{
+						Key:   "number",
+						Value: 1,
+					},
+				},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys: bson.D{{
+					Key:   "number",
+					Value: 1,
+				}},
+			},
+		}
+		slog.Info("creating failed blocks indexes", "count", len(idx))
+		if _, err := db.Collection(failedBlocksCollection).Indexes().CreateMany(context.Background(), idx); err != nil {
+			return nil, errors.Wrap(err, "failed to create failed blocks indexes")
+		}
+	}
+
+	return &MongoFailedBlocksRepo{db: db}, nil
+}
+
+// Record upserts the failed block by hash and number, accumulating its attempts
+func (r *MongoFailedBlocksRepo) Record(ctx context.Context, block *FailedBlock) error {
+	f := bson.M{
+		"hash":   block.Hash,
+		"number": block.Number,
+	}
+	u := bson.M{
+		"$set": bson.M{
+			"step":           block.Step,
+			"error":          block.Error,
+			"last_failed_at": block.LastFailedAt,
+		},
+		"$inc": bson.M{
+			"attempts": block.Attempts,
+		},
+		"$setOnInsert": bson.M{
+			"first_failed_at": block.FirstFailedAt,
+		},
+	}
+
+	_, err := r.db.Collection(failedBlocksCollection).
+		UpdateOne(ctx, f, u, options.Update().SetUpsert(true))
+	if err != nil {
+		return errors.Wrap(err, "failed to record failed block")
+	}
+
+	return nil
+}
+
+// List returns the failed blocks ordered by number
+func (r *MongoFailedBlocksRepo) List(ctx context.Context, limit int) ([]FailedBlock, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "number", Value: 1}}).
+		SetLimit(int64(limit))
+	cur, err := r.db.Collection(failedBlocksCollection).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find failed blocks")
+	}
+	defer cur.Close(ctx)
+
+	res := make([]FailedBlock, 0)
+	if err := cur.All(ctx, &res); err != nil {
+		return nil, errors.Wrap(err, "failed to decode failed blocks")
+	}
+
+	return res, nil
+}
+
+// Delete removes the failed block with the given hash and number
+func (r *MongoFailedBlocksRepo) Delete(ctx context.Context, hash string, number int64) error {
+	_, err := r.db.Collection(failedBlocksCollection).
+		DeleteOne(ctx, bson.M{"hash": hash, "number": number})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete failed block")
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+const internalTransactionsCollection = "internal_transactions"
+
+// MongoInternalTransactionsRepo is a repository for traced internal transactions
+type MongoInternalTransactionsRepo struct {
+	db *mongo.Database
+}
+
+// NewMongoInternalTransactionsRepo initializes a new internal transactions repository
+// If the internal transactions collection does not exist, it will be created
+// and indexes will be created
+func NewMongoInternalTransactionsRepo(db *mongo.Database) (*MongoInternalTransactionsRepo, error) {
+	colls, err := db.ListCollectionNames(context.Background(), bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list collection names")
+	}
+
+	if !slices.Contains(colls, internalTransactionsCollection) {
+		slog.Info("creating internal transactions collection")
+		if err := db.CreateCollection(context.Background(), internalTransactionsCollection); err != nil {
+			return nil, errors.Wrap(err, "failed to create internal transactions collection")
+		}
+
+		idx := []mongo.IndexModel{
+			{
+				Keys: bson.D{
+					{
+						Key:   "block_hash",
+						Value: 1,
+					},
+					{
+						Key:   "transaction_hash",
+						Value: 1,
+					},
+					{
+						Key:   "index",
+						Value: 1,
+					},
+				},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys: bson.D{{
+					Key:   "transaction_hash",
+					Value: 1,
+				}},
+			},
+			{
+				Keys: bson.D{
+					{
+						Key:   "from",
+						Value: 1,
+					},
+					{
+						Key:   "block_number",
+						Value: -1,
+					},
+				},
+			},
+			{
+				Keys: bson.D{
+					{
+						Key:   "to",
+						Value: 1,
+					},
+					{
+						Key:   "block_number",
+						Value: -1,
+					},
+				},
+			},
+			{
+				Keys: bson.D{{
+					Key:   "block_number",
+					Value: -1,
+				}},
+			},
+		}
+		slog.Info("creating internal transactions indexes", "count", len(idx))
+		if _, err := db.Collection(internalTransactionsCollection).Indexes().CreateMany(context.Background(), idx); err != nil {
+			return nil, errors.Wrap(err, "failed to create internal transactions indexes")
+		}
+	}
+
+	return &MongoInternalTransactionsRepo{db: db}, nil
+}
+
+// UpsertMany inserts or updates many internal transactions, keyed by block hash, transaction hash and index
+func (r *MongoInternalTransactionsRepo) UpsertMany(ctx context.Context, txs []InternalTransaction) error {
+	if len(txs) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, len(txs))
+	for i, t := range txs {
+		models[i] = mongo.NewReplaceOneModel().
+			SetUpsert(true).
+			SetFilter(bson.M{
+				"block_hash":       t.BlockHash,
+				"transaction_hash": t.TransactionHash,
+				"index":            t.Index,
+			}).
+			SetReplacement(t)
+	}
+
+	_, err := r.db.Collection(internalTransactionsCollection).
+		BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return errors.Wrap(err, "failed to bulk upsert internal transactions")
+	}
+
+	return nil
+}
+
+// DeleteByBlockHashes removes the internal transactions of the given blocks
+func (r *MongoInternalTransactionsRepo) DeleteByBlockHashes(ctx context.Context, hashes []string) error {
+	_, err := r.db.Collection(internalTransactionsCollection).
+		DeleteMany(ctx, bson.M{"block_hash": bson.M{"$in": hashes}})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete internal transactions by block hashes")
+	}
+
+	return nil
+}
+
+// DeleteBefore removes the internal transactions of blocks older than the given number
+func (r *MongoInternalTransactionsRepo) DeleteBefore(ctx context.Context, number int64) error {
+	_, err := r.db.Collection(internalTransactionsCollection).
+		DeleteMany(ctx, bson.M{"block_number": bson.M{"$lt": number}})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete old internal transactions")
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+const logsCollection = "logs"
+
+// MongoLogsRepo is a repository for event logs
+type MongoLogsRepo struct {
+	db *mongo.Database
+}
+
+// NewMongoLogsRepo initializes a new logs repository
+// If the logs collection does not exist, it will be created
+// and indexes will be created
+func NewMongoLogsRepo(db *mongo.Database) (*MongoLogsRepo, error) {
+	colls, err := db.ListCollectionNames(context.Background(), bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list collection names")
+	}
+
+	if !slices.Contains(colls, logsCollection) {
+		slog.Info("creating logs collection")
+		if err := db.CreateCollection(context.Background(), logsCollection); err != nil {
+			return nil, errors.Wrap(err, "failed to create logs collection")
+		}
+
+		idx := []mongo.IndexModel{
+			{
+				Keys: bson.D{
+					{
+						Key:   "block_hash",
+						Value: 1,
+					},
+					{
+						Key:   "log_index",
+						Value: 1,
+					},
+				},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys: bson.D{
+					{
+						Key:   "address",
+						Value: 1,
+					},
+					{
+						Key:   "block_number",
+						Value: -1,
+					},
+				},
+			},
+			{
+				Keys: bson.D{
+					{
+						Key:   "topic0",
+						Value: 1,
+					},
+					{
+						Key:   "block_number",
+						Value: -1,
+					},
+				},
+			},
+			{
+				Keys: bson.D{{
+					Key:   "transaction_hash",
+					Value: -1,
+				}},
+			},
+			{
+				Keys: bson.D{{
+					Key:   "block_number",
+					Value: -1,
+				}},
+			},
+		}
+		slog.Info("creating logs indexes", "count", len(idx))
+		if _, err := db.Collection(logsCollection).Indexes().CreateMany(context.Background(), idx); err != nil {
+			return nil, errors.Wrap(err, "failed to create logs indexes")
+		}
+	}
+
+	return &MongoLogsRepo{db: db}, nil
+}
+
+// UpsertMany inserts or updates many logs, keyed by block hash and log index
+func (r *MongoLogsRepo) UpsertMany(ctx context.Context, logs []Log) error {
+	if len(logs) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, len(logs))
+	for i, l := range logs {
+		models[i] = mongo.NewReplaceOneModel().
+			SetUpsert(true).
+			SetFilter(bson.M{
+				"block_hash": l.BlockHash,
+				"log_index":  l.LogIndex,
+			}).
+			SetReplacement(l)
+	}
+
+	_, err := r.db.Collection(logsCollection).
+		BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return errors.Wrap(err, "failed to bulk upsert logs")
+	}
+
+	return nil
+}
+
+// DeleteByBlockHashes removes the logs of the given blocks
+func (r *MongoLogsRepo) DeleteByBlockHashes(ctx context.Context, hashes []string) error {
+	_, err := r.db.Collection(logsCollection).
+		DeleteMany(ctx, bson.M{"block_hash": bson.M{"$in": hashes}})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete logs by block hashes")
+	}
+
+	return nil
+}
+
+// DeleteBefore removes the logs of blocks older than the given number
+func (r *MongoLogsRepo) DeleteBefore(ctx context.Context, number int64) error {
+	_, err := r.db.Collection(logsCollection).
+		DeleteMany(ctx, bson.M{"block_number": bson.M{"$lt": number}})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete old logs")
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+const tokenTransfersCollection = "token_transfers"
+
+// MongoTokenTransfersRepo is a repository for decoded token transfers
+type MongoTokenTransfersRepo struct {
+	db *mongo.Database
+}
+
+// NewMongoTokenTransfersRepo initializes a new token transfers repository
+// If the token transfers collection does not exist, it will be created
+// and indexes will be created
+func NewMongoTokenTransfersRepo(db *mongo.Database) (*MongoTokenTransfersRepo, error) {
+	colls, err := db.ListCollectionNames(context.Background(), bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list collection names")
+	}
+
+	if !slices.Contains(colls, tokenTransfersCollection) {
+		slog.Info("creating token transfers collection")
+		if err := db.CreateCollection(context.Background(), tokenTransfersCollection); err != nil {
+			return nil, errors.Wrap(err, "failed to create token transfers collection")
+		}
+
+		idx := []mongo.IndexModel{
+			{
+				Keys: bson.D{
+					{
+						Key:   "block_hash",
+						Value: 1,
+					},
+					{
+						Key:   "log_index",
+						Value: 1,
+					},
+				},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys: bson.D{
+					{
+						Key:   "from",
+						Value: 1,
+					},
+					{
+						Key:   "block_number",
+						Value: -1,
+					},
+				},
+			},
+			{
+				Keys: bson.D{
+					{
+						Key:   "to",
+						Value: 1,
+					},
+					{
+						Key:   "block_number",
+						Value: -1,
+					},
+				},
+			},
+			{
+				Keys: bson.D{
+					{
+						Key:   "token",
+						Value: 1,
+					},
+					{
+						Key:   "block_number",
+						Value: -1,
+					},
+				},
+			},
+			{
+				Keys: bson.D{{
+					Key:   "block_number",
+					Value: -1,
+				}},
+			},
+		}
+		slog.Info("creating token transfers indexes", "count", len(idx))
+		if _, err := db.Collection(tokenTransfersCollection).Indexes().CreateMany(context.Background(), idx); err != nil {
+			return nil, errors.Wrap(err, "failed to create token transfers indexes")
+		}
+	}
+
+	return &MongoTokenTransfersRepo{db: db}, nil
+}
+
+// UpsertMany inserts or updates many token transfers, keyed by block hash and log index
+func (r *MongoTokenTransfersRepo) UpsertMany(ctx context.Context, transfers []TokenTransfer) error {
+	if len(transfers) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, len(transfers))
+	for i, t := range transfers {
+		models[i] = mongo.NewReplaceOneModel().
+			SetUpsert(true).
+			SetFilter(bson.M{
+				"block_hash": t.BlockHash,
+				"log_index":  t.LogIndex,
+			}).
+			SetReplacement(t)
+	}
+
+	_, err := r.db.Collection(tokenTransfersCollection).
+		BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return errors.Wrap(err, "failed to bulk upsert token transfers")
+	}
+
+	return nil
+}
+
+// DeleteByBlockHashes removes the token transfers of the given blocks
+func (r *MongoTokenTransfersRepo) DeleteByBlockHashes(ctx context.Context, hashes []string) error {
+	_, err := r.db.Collection(tokenTransfersCollection).
+		DeleteMany(ctx, bson.M{"block_hash": bson.M{"$in": hashes}})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete token transfers by block hashes")
+	}
+
+	return nil
+}
+
+// DeleteBefore removes the token transfers of blocks older than the given number
+func (r *MongoTokenTransfersRepo) DeleteBefore(ctx context.Context, number int64) error {
+	_, err := r.db.Collection(tokenTransfersCollection).
+		DeleteMany(ctx, bson.M{"block_number": bson.M{"$lt": number}})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete old token transfers")
+	}
+
+	return nil
+}
@@ -0,0 +1,524 @@
+package db
+
+import (
+	"avax-indexer/metrics"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"strings"
+	"time"
+)
+
+// postgresSchema creates the normalized blocks and transactions tables
+// Numeric values that may exceed 64 bits are stored as NUMERIC
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS blocks (
+	hash              TEXT PRIMARY KEY,
+	number            BIGINT NOT NULL,
+	parent_hash       TEXT NOT NULL,
+	nonce             TEXT NOT NULL,
+	sha3_uncles       TEXT NOT NULL,
+	logs_bloom        TEXT NOT NULL,
+	transactions_root TEXT NOT NULL,
+	state_root        TEXT NOT NULL,
+	miner             TEXT NOT NULL,
+	difficulty        NUMERIC NOT NULL,
+	total_difficulty  NUMERIC NOT NULL,
+	extra_data        TEXT NOT NULL,
+	size              BIGINT NOT NULL,
+	gas_limit         BIGINT NOT NULL,
+	gas_used          BIGINT NOT NULL,
+	timestamp         BIGINT NOT NULL,
+	uncles            TEXT[] NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS blocks_number_idx ON blocks (number DESC);
+CREATE INDEX IF NOT EXISTS blocks_timestamp_idx ON blocks (timestamp DESC);
+
+CREATE TABLE IF NOT EXISTS transactions (
+	hash              TEXT NOT NULL,
+	block_hash        TEXT NOT NULL REFERENCES blocks (hash) ON DELETE CASCADE,
+	block_number      BIGINT,
+	transaction_index INTEGER,
+	nonce             BIGINT NOT NULL,
+	from_address      TEXT NOT NULL,
+	to_address        TEXT NOT NULL,
+	value             NUMERIC NOT NULL,
+	gas               BIGINT NOT NULL,
+	gas_price         NUMERIC NOT NULL,
+	input             TEXT NOT NULL,
+	PRIMARY KEY (block_hash, hash)
+);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS status SMALLINT;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS gas_used BIGINT;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS cumulative_gas_used BIGINT;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS effective_gas_price NUMERIC;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS contract_address TEXT;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS type SMALLINT;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS chain_id NUMERIC;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS max_fee_per_gas NUMERIC;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS max_priority_fee_per_gas NUMERIC;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS access_list JSONB;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS v TEXT;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS r TEXT;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS s TEXT;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS timestamp BIGINT;
+CREATE INDEX IF NOT EXISTS transactions_hash_idx ON transactions (hash);
+CREATE INDEX IF NOT EXISTS transactions_from_idx ON transactions (from_address, block_number DESC);
+CREATE INDEX IF NOT EXISTS transactions_to_idx ON transactions (to_address, block_number DESC);
+
+CREATE TABLE IF NOT EXISTS orphaned_blocks (
+	LIKE blocks INCLUDING DEFAULTS,
+	replaced_by TEXT NOT NULL,
+	orphaned_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS orphaned_blocks_number_idx ON orphaned_blocks (number DESC);
+
+CREATE TABLE IF NOT EXISTS orphaned_transactions (
+	LIKE transactions INCLUDING DEFAULTS
+);
+`
+
+const blockColumns = `hash, number, parent_hash, nonce, sha3_uncles, logs_bloom, transactions_root, state_root,
+	miner, difficulty, total_difficulty, extra_data, size, gas_limit, gas_used, timestamp, uncles`
+
+const transactionColumns = `hash, block_hash, block_number, transaction_index, nonce,
+	from_address, to_address, value, gas, gas_price, input,
+	status, gas_used, cumulative_gas_used, effective_gas_price, contract_address,
+	type, chain_id, max_fee_per_gas, max_priority_fee_per_gas, access_list, v, r, s, timestamp`
+
+// PostgresBlocksRepo is a repository for blocks backed by PostgreSQL
+// Blocks and transactions are stored in normalized tables and upserted by hash
+// Instead of a capped collection, blocks older than the configured window
+// below the newest stored block are deleted after every write
+type PostgresBlocksRepo struct {
+	db     *sql.DB
+	window int64
+}
+
+// NewPostgresBlocksRepo initializes a new PostgreSQL blocks repository
+// The tables and indexes are created if they do not exist
+// A window of 0 keeps all blocks, which is used to load historical block ranges
+func NewPostgresBlocksRepo(db *sql.DB, num int64) (*PostgresBlocksRepo, error) {
+	slog.Info("creating postgres schema", "window", num)
+	if _, err := db.ExecContext(context.Background(), postgresSchema); err != nil {
+		return nil, errors.Wrap(err, "failed to create postgres schema")
+	}
+
+	return &PostgresBlocksRepo{db: db, window: num}, nil
+}
+
+// Insert inserts a block into the database
+func (r *PostgresBlocksRepo) Insert(ctx context.Context, block *Block) error {
+	return r.UpsertMany(ctx, []*Block{block})
+}
+
+// UpsertMany inserts or updates many blocks and their transactions in a single database transaction
+func (r *PostgresBlocksRepo) UpsertMany(ctx context.Context, blocks []*Block) error {
+	defer metrics.Since(metrics.DbWriteDuration.WithLabelValues("postgres", "upsert_many"), time.Now())
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	upsertBlock, err := tx.PrepareContext(ctx, `INSERT INTO blocks (`+blockColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		ON CONFLICT (hash) DO UPDATE SET
+			number = EXCLUDED.number,
+			parent_hash = EXCLUDED.parent_hash,
+			nonce = EXCLUDED.nonce,
+			sha3_uncles = EXCLUDED.sha3_uncles,
+			logs_bloom = EXCLUDED.logs_bloom,
+			transactions_root = EXCLUDED.transactions_root,
+			state_root = EXCLUDED.state_root,
+			miner = EXCLUDED.miner,
+			difficulty = EXCLUDED.difficulty,
+			total_difficulty = EXCLUDED.total_difficulty,
+			extra_data = EXCLUDED.extra_data,
+			size = EXCLUDED.size,
+			gas_limit = EXCLUDED.gas_limit,
+			gas_used = EXCLUDED.gas_used,
+			timestamp = EXCLUDED.timestamp,
+			uncles = EXCLUDED.uncles`)
+	if err != nil {
+		return errors.Wrap(err, "failed to prepare block upsert")
+	}
+	defer upsertBlock.Close()
+
+	mapped := make([]*Block, 0, len(blocks))
+	hashes := make([]string, 0, len(blocks))
+	for i := len(blocks) - 1; i >= 0; i-- {
+		m := blocks[i]
+		_, err := upsertBlock.ExecContext(ctx,
+			m.Hash, m.Number, m.ParentHash, m.Nonce, m.Sha3Uncles, m.LogsBloom, m.TransactionsRoot, m.StateRoot,
+			m.Miner, m.Difficulty, m.TotalDifficulty, m.ExtraData, m.Size, m.GasLimit, m.GasUsed, m.Timestamp,
+			pq.Array(m.Uncles))
+		if err != nil {
+			return errors.Wrapf(err, "failed to upsert block %s", m.Hash)
+		}
+		mapped = append(mapped, m)
+		hashes = append(hashes, m.Hash)
+	}
+
+	// Transactions are replaced as a whole, so they can be copied in bulk
+	if _, err := tx.ExecContext(ctx, `DELETE FROM transactions WHERE block_hash = ANY($1)`, pq.Array(hashes)); err != nil {
+		return errors.Wrap(err, "failed to delete replaced transactions")
+	}
+
+	copyTxs, err := tx.PrepareContext(ctx, pq.CopyIn("transactions",
+		"hash", "block_hash", "block_number", "transaction_index", "nonce",
+		"from_address", "to_address", "value", "gas", "gas_price", "input",
+		"status", "gas_used", "cumulative_gas_used", "effective_gas_price", "contract_address",
+		"type", "chain_id", "max_fee_per_gas", "max_priority_fee_per_gas", "access_list", "v", "r", "s", "timestamp"))
+	if err != nil {
+		return errors.Wrap(err, "failed to prepare transactions copy")
+	}
+	for _, m := range mapped {
+		for _, t := range m.Transactions {
+			accessList, err := accessListJSON(t.AccessList)
+			if err != nil {
+				copyTxs.Close()
+				return errors.Wrapf(err, "failed to encode access list of transaction %s", t.Hash)
+			}
+			_, err = copyTxs.ExecContext(ctx,
+				t.Hash, m.Hash, t.BlockNumber, t.TransactionIndex, t.Nonce,
+				t.From, t.To, t.Value, t.Gas, t.GasPrice, t.Input,
+				t.Status, nullIfZero(t.GasUsed), nullIfZero(t.CumulativeGasUsed),
+				nullIfEmpty(t.EffectiveGasPrice), nullIfEmpty(t.ContractAddress),
+				sql.NullInt64{Int64: int64(t.Type), Valid: t.V != ""}, nullIfEmpty(t.ChainID),
+				nullIfEmpty(t.MaxFeePerGas), nullIfEmpty(t.MaxPriorityFeePerGas), accessList,
+				nullIfEmpty(t.V), nullIfEmpty(t.R), nullIfEmpty(t.S), nullIfZero(t.Timestamp))
+			if err != nil {
+				copyTxs.Close()
+				return errors.Wrapf(err, "failed to copy transaction %s", t.Hash)
+			}
+		}
+	}
+	if _, err := copyTxs.ExecContext(ctx); err != nil {
+		copyTxs.Close()
+		return errors.Wrap(err, "failed to flush transactions copy")
+	}
+	if err := copyTxs.Close(); err != nil {
+		return errors.Wrap(err, "failed to close transactions copy")
+	}
+
+	// Enforce the rolling window, transactions are removed by the cascade
+	if r.window > 0 {
+		_, err = tx.ExecContext(ctx, `DELETE FROM blocks WHERE number <= (SELECT max(number) FROM blocks) - $1`, r.window)
+		if err != nil {
+			return errors.Wrap(err, "failed to trim blocks window")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit blocks")
+	}
+
+	return nil
+}
+
+// LastHead returns the last block number in the database
+func (r *PostgresBlocksRepo) LastHead(ctx context.Context) (int64, error) {
+	var head sql.NullInt64
+	if err := r.db.QueryRowContext(ctx, `SELECT max(number) FROM blocks`).Scan(&head); err != nil {
+		return 0, errors.Wrap(err, "failed to query latest block number")
+	}
+	return head.Int64, nil
+}
+
+// FirstHead returns the oldest block number in the database
+func (r *PostgresBlocksRepo) FirstHead(ctx context.Context) (int64, error) {
+	var head sql.NullInt64
+	if err := r.db.QueryRowContext(ctx, `SELECT min(number) FROM blocks`).Scan(&head); err != nil {
+		return 0, errors.Wrap(err, "failed to query oldest block number")
+	}
+	return head.Int64, nil
+}
+
+// FindByNumber returns all stored blocks at the given height
+func (r *PostgresBlocksRepo) FindByNumber(ctx context.Context, number int64) ([]Block, error) {
+	return r.findBlocks(ctx, `SELECT `+blockColumns+` FROM blocks WHERE number = $1`, number)
+}
+
+// FindBlocks returns the blocks matching the filter, from the newest to the oldest
+func (r *PostgresBlocksRepo) FindBlocks(ctx context.Context, filter BlockFilter, limit int) ([]Block, error) {
+	where := make([]string, 0, 4)
+	args := make([]interface{}, 0, 5)
+	cond := func(expr string, v *int64) {
+		if v != nil {
+			args = append(args, *v)
+			where = append(where, fmt.Sprintf(expr, len(args)))
+		}
+	}
+	cond("number >= $%d", filter.FromNumber)
+	cond("number <= $%d", filter.ToNumber)
+	cond("timestamp >= $%d", filter.FromTime)
+	cond("timestamp <= $%d", filter.ToTime)
+
+	query := `SELECT ` + blockColumns + ` FROM blocks`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(` ORDER BY number DESC LIMIT $%d`, len(args))
+
+	return r.findBlocks(ctx, query, args...)
+}
+
+// FindByHash returns the stored block with the given hash
+func (r *PostgresBlocksRepo) FindByHash(ctx context.Context, hash string) (*Block, error) {
+	blocks, err := r.findBlocks(ctx, `SELECT `+blockColumns+` FROM blocks WHERE hash = $1`, hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, ErrNotFound
+	}
+	return &blocks[0], nil
+}
+
+// FindTransaction returns the stored transaction with the given hash
+func (r *PostgresBlocksRepo) FindTransaction(ctx context.Context, hash string) (*Transaction, error) {
+	txs, err := r.findTransactions(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE hash = $1 LIMIT 1`, hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(txs) == 0 {
+		return nil, ErrNotFound
+	}
+	return &txs[0], nil
+}
+
+// FindAddressTransactions returns the transactions sent from or to the address,
+// from the newest to the oldest, starting after the cursor if one is given
+func (r *PostgresBlocksRepo) FindAddressTransactions(ctx context.Context, address string, cursor *TxCursor, limit int) ([]Transaction, error) {
+	return r.findAddressTransactions(ctx, address, 0, cursor, limit)
+}
+
+// FindAddressActivity returns the transactions sent from or to the address in blocks from fromBlock on,
+// as seen from the address, from the newest to the oldest, starting after the cursor if one is given
+func (r *PostgresBlocksRepo) FindAddressActivity(ctx context.Context, address string, fromBlock int64, cursor *TxCursor, limit int) ([]Activity, error) {
+	txs, err := r.findAddressTransactions(ctx, address, fromBlock, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Activity, len(txs))
+	for i := range txs {
+		res[i] = NewActivity(address, &txs[i])
+	}
+	return res, nil
+}
+
+// findAddressTransactions returns the transactions sent from or to the address in blocks from fromBlock on,
+// from the newest to the oldest, starting after the cursor if one is given
+func (r *PostgresBlocksRepo) findAddressTransactions(ctx context.Context, address string, fromBlock int64, cursor *TxCursor, limit int) ([]Transaction, error) {
+	if cursor == nil {
+		return r.findTransactions(ctx, `SELECT `+transactionColumns+` FROM transactions
+			WHERE (from_address = $1 OR to_address = $1) AND block_number >= $2
+			ORDER BY block_number DESC, transaction_index DESC LIMIT $3`, address, fromBlock, limit)
+	}
+
+	return r.findTransactions(ctx, `SELECT `+transactionColumns+` FROM transactions
+		WHERE (from_address = $1 OR to_address = $1) AND block_number >= $2 AND (block_number, transaction_index) < ($3, $4)
+		ORDER BY block_number DESC, transaction_index DESC LIMIT $5`,
+		address, fromBlock, cursor.BlockNumber, cursor.TransactionIndex, limit)
+}
+
+// StoredNumbers returns the stored block numbers in the inclusive range, in ascending order
+func (r *PostgresBlocksRepo) StoredNumbers(ctx context.Context, from int64, to int64) ([]int64, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT number FROM blocks WHERE number BETWEEN $1 AND $2 ORDER BY number`, from, to)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query stored block numbers")
+	}
+	defer rows.Close()
+
+	res := make([]int64, 0)
+	for rows.Next() {
+		var num int64
+		if err := rows.Scan(&num); err != nil {
+			return nil, errors.Wrap(err, "failed to scan stored block number")
+		}
+		res = append(res, num)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate stored block numbers")
+	}
+
+	return res, nil
+}
+
+// MoveToOrphans moves the given blocks and their transactions to the orphaned tables,
+// recording the canonical block that replaced them
+func (r *PostgresBlocksRepo) MoveToOrphans(ctx context.Context, blocks []Block, canonicalHash string) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	defer metrics.Since(metrics.DbWriteDuration.WithLabelValues("postgres", "move_to_orphans"), time.Now())
+
+	hashes := make([]string, len(blocks))
+	for i, b := range blocks {
+		hashes[i] = b.Hash
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO orphaned_blocks (`+blockColumns+`, replaced_by, orphaned_at)
+		SELECT `+blockColumns+`, $2, $3 FROM blocks WHERE hash = ANY($1)`,
+		pq.Array(hashes), canonicalHash, time.Now().UTC())
+	if err != nil {
+		return errors.Wrap(err, "failed to insert orphaned blocks")
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO orphaned_transactions (`+transactionColumns+`)
+		SELECT `+transactionColumns+` FROM transactions WHERE block_hash = ANY($1)`, pq.Array(hashes))
+	if err != nil {
+		return errors.Wrap(err, "failed to insert orphaned transactions")
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM blocks WHERE hash = ANY($1)`, pq.Array(hashes)); err != nil {
+		return errors.Wrap(err, "failed to delete orphaned blocks")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit orphaned blocks")
+	}
+
+	return nil
+}
+
+// findBlocks queries blocks and loads their transactions ordered by index
+func (r *PostgresBlocksRepo) findBlocks(ctx context.Context, query string, args ...interface{}) ([]Block, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query blocks")
+	}
+	defer rows.Close()
+
+	res := make([]Block, 0)
+	for rows.Next() {
+		var b Block
+		err := rows.Scan(&b.Hash, &b.Number, &b.ParentHash, &b.Nonce, &b.Sha3Uncles, &b.LogsBloom,
+			&b.TransactionsRoot, &b.StateRoot, &b.Miner, &b.Difficulty, &b.TotalDifficulty, &b.ExtraData,
+			&b.Size, &b.GasLimit, &b.GasUsed, &b.Timestamp, pq.Array(&b.Uncles))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan block")
+		}
+		res = append(res, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate blocks")
+	}
+
+	for i := range res {
+		txs, err := r.findTransactions(ctx, `SELECT `+transactionColumns+` FROM transactions
+			WHERE block_hash = $1 ORDER BY transaction_index`, res[i].Hash)
+		if err != nil {
+			return nil, err
+		}
+		res[i].Transactions = txs
+	}
+
+	return res, nil
+}
+
+// findTransactions queries transactions selecting transactionColumns
+func (r *PostgresBlocksRepo) findTransactions(ctx context.Context, query string, args ...interface{}) ([]Transaction, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query transactions")
+	}
+	defer rows.Close()
+
+	res := make([]Transaction, 0)
+	for rows.Next() {
+		var (
+			t                 Transaction
+			blockNumber       sql.NullInt64
+			txIndex           sql.NullInt64
+			status            sql.NullInt64
+			gasUsed           sql.NullInt64
+			cumulativeGasUsed sql.NullInt64
+			effectiveGasPrice sql.NullString
+			contractAddress   sql.NullString
+			txType            sql.NullInt64
+			chainID           sql.NullString
+			maxFee            sql.NullString
+			maxPriorityFee    sql.NullString
+			accessList        sql.NullString
+			sigV, sigR, sigS  sql.NullString
+			timestamp         sql.NullInt64
+		)
+		err := rows.Scan(&t.Hash, &t.BlockHash, &blockNumber, &txIndex, &t.Nonce,
+			&t.From, &t.To, &t.Value, &t.Gas, &t.GasPrice, &t.Input,
+			&status, &gasUsed, &cumulativeGasUsed, &effectiveGasPrice, &contractAddress,
+			&txType, &chainID, &maxFee, &maxPriorityFee, &accessList, &sigV, &sigR, &sigS, &timestamp)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan transaction")
+		}
+		if blockNumber.Valid {
+			n := int(blockNumber.Int64)
+			t.BlockNumber = &n
+		}
+		if txIndex.Valid {
+			n := int(txIndex.Int64)
+			t.TransactionIndex = &n
+		}
+		if status.Valid {
+			n := int(status.Int64)
+			t.Status = &n
+		}
+		t.GasUsed = int(gasUsed.Int64)
+		t.CumulativeGasUsed = int(cumulativeGasUsed.Int64)
+		t.EffectiveGasPrice = effectiveGasPrice.String
+		t.ContractAddress = contractAddress.String
+		t.Type = int(txType.Int64)
+		t.ChainID = chainID.String
+		t.MaxFeePerGas = maxFee.String
+		t.MaxPriorityFeePerGas = maxPriorityFee.String
+		if accessList.Valid {
+			if err := json.Unmarshal([]byte(accessList.String), &t.AccessList); err != nil {
+				return nil, errors.Wrap(err, "failed to decode access list")
+			}
+		}
+		t.V, t.R, t.S = sigV.String, sigR.String, sigS.String
+		t.Timestamp = int(timestamp.Int64)
+		res = append(res, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate transactions")
+	}
+
+	return res, nil
+}
+
+// nullIfZero maps zero values of optional integer columns to NULL
+func nullIfZero(v int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(v), Valid: v != 0}
+}
+
+// nullIfEmpty maps empty values of optional text and numeric columns to NULL
+func nullIfEmpty(v string) sql.NullString {
+	return sql.NullString{String: v, Valid: v != ""}
+}
+
+// accessListJSON encodes an access list for its JSONB column, mapping an empty list to NULL
+func accessListJSON(list []AccessTuple) (sql.NullString, error) {
+	if len(list) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
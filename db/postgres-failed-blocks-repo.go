@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/pkg/errors"
+)
+
+// postgresFailedBlocksSchema creates the failed blocks table
+// Blocks backfilled by number are recorded with an empty hash
+const postgresFailedBlocksSchema = `
+CREATE TABLE IF NOT EXISTS failed_blocks (
+	hash            TEXT NOT NULL,
+	number          BIGINT NOT NULL,
+	step            TEXT NOT NULL,
+	error           TEXT NOT NULL,
+	attempts        INTEGER NOT NULL,
+	first_failed_at TIMESTAMPTZ NOT NULL,
+	last_failed_at  TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (hash, number)
+);
+CREATE INDEX IF NOT EXISTS failed_blocks_number_idx ON failed_blocks (number);
+`
+
+// PostgresFailedBlocksRepo is a repository for blocks that failed processing backed by PostgreSQL
+type PostgresFailedBlocksRepo struct {
+	db *sql.DB
+}
+
+// NewPostgresFailedBlocksRepo initializes a new PostgreSQL failed blocks repository
+// The table is created if it does not exist
+func NewPostgresFailedBlocksRepo(db *sql.DB) (*PostgresFailedBlocksRepo, error) {
+	if _, err := db.ExecContext(context.Background(), postgresFailedBlocksSchema); err != nil {
+		return nil, errors.Wrap(err, "failed to create failed blocks schema")
+	}
+
+	return &PostgresFailedBlocksRepo{db: db}, nil
+}
+
+// Record upserts the failed block by hash and number, accumulating its attempts
+func (r *PostgresFailedBlocksRepo) Record(ctx context.Context, block *FailedBlock) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO failed_blocks
+		(hash, number, step, error, attempts, first_failed_at, last_failed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (hash, number) DO UPDATE SET
+			step = EXCLUDED.step,
+			error = EXCLUDED.error,
+			attempts = failed_blocks.attempts + EXCLUDED.attempts,
+			last_failed_at = EXCLUDED.last_failed_at`,
+		block.Hash, block.Number, block.Step, block.Error, block.Attempts, block.FirstFailedAt, block.LastFailedAt)
+	if err != nil {
+		return errors.Wrap(err, "failed to record failed block")
+	}
+
+	return nil
+}
+
+// List returns the failed blocks ordered by number
+func (r *PostgresFailedBlocksRepo) List(ctx context.Context, limit int) ([]FailedBlock, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT hash, number, step, error, attempts, first_failed_at, last_failed_at
+		FROM failed_blocks ORDER BY number LIMIT $1`, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query failed blocks")
+	}
+	defer rows.Close()
+
+	res := make([]FailedBlock, 0)
+	for rows.Next() {
+		var b FailedBlock
+		if err := rows.Scan(&b.Hash, &b.Number, &b.Step, &b.Error, &b.Attempts, &b.FirstFailedAt, &b.LastFailedAt); err != nil {
+			return nil, errors.Wrap(err, "failed to scan failed block")
+		}
+		res = append(res, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate failed blocks")
+	}
+
+	return res, nil
+}
+
+// Delete removes the failed block with the given hash and number
+func (r *PostgresFailedBlocksRepo) Delete(ctx context.Context, hash string, number int64) error {
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM failed_blocks WHERE hash = $1 AND number = $2`, hash, number); err != nil {
+		return errors.Wrap(err, "failed to delete failed block")
+	}
+
+	return nil
+}
@@ -1,38 +1,170 @@
 package db
 
-// Block represents a block in the blockchain, annotated for MongoDB
+import "time"
+
+// Block represents a block in the blockchain, annotated for MongoDB and the HTTP API
 type Block struct {
-	Number           int           `bson:"number"`
-	Hash             string        `bson:"hash"`
-	ParentHash       string        `bson:"parent_hash"`
-	Nonce            string        `bson:"nonce"`
-	Sha3Uncles       string        `bson:"sha_3_uncles"`
-	LogsBloom        string        `bson:"logs_bloom"`
-	TransactionsRoot string        `bson:"transactions_root"`
-	StateRoot        string        `bson:"state_root"`
-	Miner            string        `bson:"miner"`
-	Difficulty       string        `bson:"difficulty"`
-	TotalDifficulty  string        `bson:"total_difficulty"`
-	ExtraData        string        `bson:"extra_data"`
-	Size             int           `bson:"size"`
-	GasLimit         int           `bson:"gas_limit"`
-	GasUsed          int           `bson:"gas_used"`
-	Timestamp        int           `bson:"timestamp"`
-	Uncles           []string      `bson:"uncles"`
-	Transactions     []Transaction `bson:"transactions"`
-}
-
-// Transaction represents a transaction in the blockchain, annotated for MongoDB
+	Number           int           `bson:"number" json:"number"`
+	Hash             string        `bson:"hash" json:"hash"`
+	ParentHash       string        `bson:"parent_hash" json:"parent_hash"`
+	Nonce            string        `bson:"nonce" json:"nonce"`
+	Sha3Uncles       string        `bson:"sha_3_uncles" json:"sha_3_uncles"`
+	LogsBloom        string        `bson:"logs_bloom" json:"logs_bloom"`
+	TransactionsRoot string        `bson:"transactions_root" json:"transactions_root"`
+	StateRoot        string        `bson:"state_root" json:"state_root"`
+	Miner            string        `bson:"miner" json:"miner"`
+	Difficulty       string        `bson:"difficulty" json:"difficulty"`
+	TotalDifficulty  string        `bson:"total_difficulty" json:"total_difficulty"`
+	ExtraData        string        `bson:"extra_data" json:"extra_data"`
+	Size             int           `bson:"size" json:"size"`
+	GasLimit         int           `bson:"gas_limit" json:"gas_limit"`
+	GasUsed          int           `bson:"gas_used" json:"gas_used"`
+	Timestamp        int           `bson:"timestamp" json:"timestamp"`
+	Uncles           []string      `bson:"uncles" json:"uncles"`
+	Transactions     []Transaction `bson:"transactions,omitempty" json:"transactions"`
+}
+
+// Transaction represents a transaction in the blockchain, annotated for MongoDB and the HTTP API
+// The receipt fields are empty until the transaction's receipt is fetched
 type Transaction struct {
-	Hash             string `bson:"hash"`
-	Nonce            int    `bson:"nonce"`
-	BlockHash        string `bson:"block_hash"`
-	BlockNumber      *int   `bson:"block_number"`
-	TransactionIndex *int   `bson:"transaction_index"`
-	From             string `bson:"from"`
-	To               string `bson:"to"`
-	Value            string `bson:"value"`
-	Gas              int    `bson:"gas"`
-	GasPrice         string `bson:"gas_price"`
-	Input            string `bson:"input"`
+	Hash              string `bson:"hash" json:"hash"`
+	Nonce             int    `bson:"nonce" json:"nonce"`
+	BlockHash         string `bson:"block_hash" json:"block_hash"`
+	BlockNumber       *int   `bson:"block_number" json:"block_number"`
+	TransactionIndex  *int   `bson:"transaction_index" json:"transaction_index"`
+	Timestamp         int    `bson:"timestamp" json:"timestamp"`
+	From              string `bson:"from" json:"from"`
+	To                string `bson:"to" json:"to"`
+	Value             string `bson:"value" json:"value"`
+	Gas               int    `bson:"gas" json:"gas"`
+	GasPrice          string `bson:"gas_price" json:"gas_price"`
+	Input             string `bson:"input" json:"input"`
+	Status            *int   `bson:"status,omitempty" json:"status,omitempty"`
+	GasUsed           int    `bson:"gas_used,omitempty" json:"gas_used,omitempty"`
+	CumulativeGasUsed int    `bson:"cumulative_gas_used,omitempty" json:"cumulative_gas_used,omitempty"`
+	EffectiveGasPrice string `bson:"effective_gas_price,omitempty" json:"effective_gas_price,omitempty"`
+	ContractAddress   string `bson:"contract_address,omitempty" json:"contract_address,omitempty"`
+	// The envelope fields are empty for transactions stored before they were indexed,
+	// which is told by a missing signature
+	Type                 int           `bson:"type,omitempty" json:"type,omitempty"`
+	ChainID              string        `bson:"chain_id,omitempty" json:"chain_id,omitempty"`
+	MaxFeePerGas         string        `bson:"max_fee_per_gas,omitempty" json:"max_fee_per_gas,omitempty"`
+	MaxPriorityFeePerGas string        `bson:"max_priority_fee_per_gas,omitempty" json:"max_priority_fee_per_gas,omitempty"`
+	AccessList           []AccessTuple `bson:"access_list,omitempty" json:"access_list,omitempty"`
+	V                    string        `bson:"v,omitempty" json:"v,omitempty"`
+	R                    string        `bson:"r,omitempty" json:"r,omitempty"`
+	S                    string        `bson:"s,omitempty" json:"s,omitempty"`
+}
+
+// AccessTuple is an entry of the access list of a typed transaction
+type AccessTuple struct {
+	Address     string   `bson:"address" json:"address"`
+	StorageKeys []string `bson:"storage_keys" json:"storage_keys"`
+}
+
+// Log represents an event log emitted by a transaction, annotated for MongoDB
+// Topic0 duplicates the first topic, the event signature, so it can be indexed
+type Log struct {
+	Address          string   `bson:"address"`
+	Topic0           string   `bson:"topic0"`
+	Topics           []string `bson:"topics"`
+	Data             string   `bson:"data"`
+	BlockNumber      int      `bson:"block_number"`
+	BlockHash        string   `bson:"block_hash"`
+	TransactionHash  string   `bson:"transaction_hash"`
+	TransactionIndex int      `bson:"transaction_index"`
+	LogIndex         int      `bson:"log_index"`
+}
+
+// OrphanedBlock represents a block that was replaced by a chain reorganization
+// It is kept in a separate collection so that reorgs can be audited
+type OrphanedBlock struct {
+	Block      `bson:",inline"`
+	ReplacedBy string    `bson:"replaced_by"`
+	OrphanedAt time.Time `bson:"orphaned_at"`
+}
+
+// TokenTransfer represents a decoded ERC-20 Transfer or Approval event, annotated for MongoDB
+// For approvals From is the owner and To is the spender
+// Amount is the raw token amount as a decimal string, not adjusted for decimals
+type TokenTransfer struct {
+	Event           string `bson:"event"`
+	Token           string `bson:"token"`
+	From            string `bson:"from"`
+	To              string `bson:"to"`
+	Amount          string `bson:"amount"`
+	BlockNumber     int    `bson:"block_number"`
+	BlockHash       string `bson:"block_hash"`
+	TransactionHash string `bson:"transaction_hash"`
+	LogIndex        int    `bson:"log_index"`
+}
+
+// InternalTransaction represents a call made by a contract while executing a transaction,
+// flattened from the transaction's call tree, annotated for MongoDB
+// Index is the position of the call in the depth-first order of the tree, and Depth is 1
+// for the calls made directly by the transaction. Reverted is set when the call
+// or any of its callers, the transaction included, failed, in which case no value moved
+// Value is in wei as a decimal string
+type InternalTransaction struct {
+	TransactionHash string `bson:"transaction_hash"`
+	BlockHash       string `bson:"block_hash"`
+	BlockNumber     int    `bson:"block_number"`
+	Index           int    `bson:"index"`
+	Depth           int    `bson:"depth"`
+	Type            string `bson:"type"`
+	From            string `bson:"from"`
+	To              string `bson:"to"`
+	Value           string `bson:"value"`
+	Gas             int    `bson:"gas"`
+	GasUsed         int    `bson:"gas_used"`
+	Error           string `bson:"error,omitempty"`
+	Reverted        bool   `bson:"reverted"`
+}
+
+// BalanceDelta is the net change of an address's native AVAX balance in a block, annotated for MongoDB
+// Received and Sent are the values the block's transactions moved into and out of the address,
+// including the internal transactions if the block was traced, and Fees are the fees
+// the address paid as sender. Delta is Received - Sent - Fees
+// Amounts are in wei as decimal strings, Delta being signed
+type BalanceDelta struct {
+	Address     string `bson:"address" json:"address"`
+	BlockHash   string `bson:"block_hash" json:"block_hash"`
+	BlockNumber int    `bson:"block_number" json:"block_number"`
+	Received    string `bson:"received" json:"received"`
+	Sent        string `bson:"sent" json:"sent"`
+	Fees        string `bson:"fees" json:"fees"`
+	Delta       string `bson:"delta" json:"delta"`
+	Traced      bool   `bson:"traced" json:"traced"`
+}
+
+// Contract represents a deployed contract, annotated for MongoDB
+// The deployer is the sender of the creating transaction, or the creating contract for contracts
+// created by internal transactions, which are only found in traced blocks
+// The runtime code is stored once per code hash, as Bytecode
+type Contract struct {
+	Address         string `bson:"address" json:"address"`
+	CodeHash        string `bson:"code_hash" json:"code_hash"`
+	Deployer        string `bson:"deployer" json:"deployer"`
+	TransactionHash string `bson:"transaction_hash" json:"transaction_hash"`
+	BlockHash       string `bson:"block_hash" json:"block_hash"`
+	BlockNumber     int    `bson:"block_number" json:"block_number"`
+	Internal        bool   `bson:"internal" json:"internal"`
+}
+
+// Bytecode is the runtime code of contracts, keyed by its Keccak-256 hash, annotated for MongoDB
+type Bytecode struct {
+	CodeHash string `bson:"_id" json:"code_hash"`
+	Code     string `bson:"code" json:"code"`
+}
+
+// FailedBlock represents a block that could not be fetched or stored after all retries
+// Blocks backfilled by number are recorded without a hash
+type FailedBlock struct {
+	Hash          string    `bson:"hash"`
+	Number        int64     `bson:"number"`
+	Step          string    `bson:"step"`
+	Error         string    `bson:"error"`
+	Attempts      int       `bson:"attempts"`
+	FirstFailedAt time.Time `bson:"first_failed_at"`
+	LastFailedAt  time.Time `bson:"last_failed_at"`
 }
@@ -0,0 +1,16 @@
+package db
+
+import "context"
+
+// TokenTransfersRepo is the storage for decoded token transfers
+// Transfers are keyed by block hash and log index, so they can be replaced and reverted per block
+type TokenTransfersRepo interface {
+	// UpsertMany inserts or updates many token transfers
+	UpsertMany(ctx context.Context, transfers []TokenTransfer) error
+	// DeleteByBlockHashes removes the token transfers of the given blocks
+	DeleteByBlockHashes(ctx context.Context, hashes []string) error
+	// DeleteBefore removes the token transfers of blocks older than the given number
+	DeleteBefore(ctx context.Context, number int64) error
+}
+
+var _ TokenTransfersRepo = (*MongoTokenTransfersRepo)(nil)
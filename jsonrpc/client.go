@@ -0,0 +1,218 @@
+package jsonrpc
+
+import (
+	"avax-indexer/model"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Retrier retries an operation, like rpc.RetryPolicy
+type Retrier interface {
+	Do(ctx context.Context, fn func(ctx context.Context) error, onRetry func(err error, backoff time.Duration)) (int, error)
+}
+
+// Call is a single JSON-RPC call of a batch
+type Call struct {
+	Method string
+	Params []interface{}
+}
+
+// NewCall returns a call of the method with the given params
+func NewCall(method string, params ...interface{}) Call {
+	if params == nil {
+		params = make([]interface{}, 0)
+	}
+	return Call{Method: method, Params: params}
+}
+
+// Response is the outcome of a call of a batch
+// Exactly one of Result and Err is set
+type Response struct {
+	Result json.RawMessage
+	Err    error
+}
+
+// Client sends JSON-RPC batches to a provider
+// Responses are matched to their calls by id, and calls failing in a batch
+// are retried on their own according to the retrier
+type Client struct {
+	http  *http.Client
+	url   string
+	retry Retrier
+}
+
+// NewClient initializes a new Client sending batches to the url with httpClient
+// A nil retrier sends every batch once
+func NewClient(httpClient *http.Client, url string, retry Retrier) *Client {
+	return &Client{http: httpClient, url: url, retry: retry}
+}
+
+// request is a single JSON-RPC request of a batch
+type request struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	Id      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+// response is a single JSON-RPC response of a batch
+type response struct {
+	Id     *int            `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// Batch sends the calls as a single batch and returns their responses, in the order of the calls
+// It fails only if the batch as a whole failed; the errors of single calls are set on their responses
+func (c *Client) Batch(ctx context.Context, calls []Call) ([]Response, error) {
+	if len(calls) == 0 {
+		return make([]Response, 0), nil
+	}
+
+	// Ids are the positions of the calls, so responses can be matched in any order
+	reqs := make([]request, len(calls))
+	for i, call := range calls {
+		reqs[i] = request{Jsonrpc: "2.0", Id: i, Method: call.Method, Params: call.Params}
+	}
+	b, err := json.Marshal(reqs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal batch request")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create batch request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	rs, err := c.http.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send batch request")
+	}
+	defer rs.Body.Close()
+
+	body := io.Reader(rs.Body)
+	if rs.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(rs.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decompress batch response")
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read batch response")
+	}
+
+	if rs.StatusCode == http.StatusTooManyRequests {
+		var infErr model.InfuraError
+		_ = json.Unmarshal(data, &infErr)
+		return nil, &RateLimitError{Backoff: time.Duration(infErr.Data.Rate.BackoffSeconds * float64(time.Second))}
+	}
+	if rs.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: rs.StatusCode}
+	}
+
+	// Providers answer a batch they reject as a whole with a single error response
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '{' {
+		var single response
+		if err := json.Unmarshal(data, &single); err != nil {
+			return nil, errors.Wrap(err, "failed to decode batch response")
+		}
+		if single.Error != nil {
+			return nil, errors.Wrap(single.Error, "batch rejected")
+		}
+		return nil, errors.New("got a single response to a batch request")
+	}
+
+	var res []response
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, errors.Wrap(err, "failed to decode batch response")
+	}
+
+	responses := make([]Response, len(calls))
+	for i := range responses {
+		responses[i].Err = ErrMissingResponse
+	}
+	for _, r := range res {
+		if r.Id == nil || *r.Id < 0 || *r.Id >= len(calls) {
+			continue
+		}
+		switch {
+		case r.Error != nil:
+			responses[*r.Id] = Response{Err: r.Error}
+		case len(r.Result) == 0 || string(r.Result) == "null":
+			responses[*r.Id] = Response{Err: ErrNullResult}
+		default:
+			responses[*r.Id] = Response{Result: r.Result}
+		}
+	}
+
+	return responses, nil
+}
+
+// Do sends the calls as a batch and decodes their results, in the order of the calls
+// Failed calls are retried on their own according to the client's retrier, while the results
+// of the successful ones are kept. If some calls still fail, it returns a *BatchError
+func Do[T any](ctx context.Context, c *Client, calls []Call) ([]T, error) {
+	results := make([]T, len(calls))
+	pending := make([]int, len(calls))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	attempt := func(ctx context.Context) error {
+		batch := make([]Call, len(pending))
+		for i, idx := range pending {
+			batch[i] = calls[idx]
+		}
+		res, err := c.Batch(ctx, batch)
+		if err != nil {
+			return err
+		}
+
+		failed := make([]int, 0)
+		batchErr := &BatchError{Total: len(calls)}
+		for i, r := range res {
+			idx := pending[i]
+			err := r.Err
+			if err == nil {
+				if err = json.Unmarshal(r.Result, &results[idx]); err != nil {
+					err = errors.Wrap(err, "failed to decode result")
+				}
+			}
+			if err != nil {
+				failed = append(failed, idx)
+				batchErr.Calls = append(batchErr.Calls, CallError{Index: idx, Method: calls[idx].Method, Err: err})
+			}
+		}
+
+		pending = failed
+		if len(pending) > 0 {
+			return batchErr
+		}
+		return nil
+	}
+
+	var err error
+	if c.retry == nil {
+		err = attempt(ctx)
+	} else {
+		_, err = c.retry.Do(ctx, attempt, func(err error, backoff time.Duration) {
+			slog.Warn("batch calls failed; retrying them", "failed", len(pending), "total", len(calls), "backoff", backoff, "error", err)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,76 @@
+package jsonrpc
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+// ErrNullResult is the error of a call that returned a null result, like a block that does not exist yet
+var ErrNullResult = errors.New("null result")
+
+// ErrMissingResponse is the error of a call the batch response has no response for
+var ErrMissingResponse = errors.New("missing response")
+
+// Error is a JSON-RPC error returned for a call
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("json-rpc error %d: %s", e.Code, e.Message)
+}
+
+// StatusError is returned when the provider answers a batch with an unsuccessful HTTP status
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("got status code %d", e.StatusCode)
+}
+
+// RateLimitError is returned when the provider rejects a batch with 429 Too Many Requests
+// Backoff is the time the provider asks to wait before sending another request
+type RateLimitError struct {
+	Backoff time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited; backoff %s", e.Backoff)
+}
+
+// CallError is the error of a single call of a batch
+type CallError struct {
+	Index  int
+	Method string
+	Err    error
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("call %d (%s): %s", e.Index, e.Method, e.Err)
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError lists the calls of a batch that failed, out of Total calls
+type BatchError struct {
+	Calls []CallError
+	Total int
+}
+
+func (e *BatchError) Error() string {
+	const shown = 3
+	msgs := make([]string, 0, shown)
+	for i := 0; i < len(e.Calls) && i < shown; i++ {
+		msgs = append(msgs, e.Calls[i].Error())
+	}
+	if len(e.Calls) > shown {
+		msgs = append(msgs, fmt.Sprintf("and %d more", len(e.Calls)-shown))
+	}
+	return fmt.Sprintf("%d of %d calls failed: %s", len(e.Calls), e.Total, strings.Join(msgs, "; "))
+}
@@ -0,0 +1,211 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const namespace = "avax_indexer"
+
+var (
+	// WsBlocksReceived counts the new heads received from the websocket feed
+	WsBlocksReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_blocks_received_total",
+		Help:      "New heads received from the websocket feed.",
+	})
+	// WsConnected is 1 while the websocket connection is up
+	WsConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ws_connected",
+		Help:      "Whether the websocket connection is up.",
+	})
+	// WsReconnects counts the websocket reconnect attempts
+	WsReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_reconnects_total",
+		Help:      "Websocket reconnect attempts.",
+	})
+
+	// BlocksStored counts the blocks written to storage
+	BlocksStored = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocks_stored_total",
+		Help:      "Blocks written to storage.",
+	})
+	chainHead = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "chain_head",
+		Help:      "Latest block number seen on the chain.",
+	})
+	storedHead = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stored_head",
+		Help:      "Latest block number in storage.",
+	})
+	headLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "head_lag_blocks",
+		Help:      "Chain head minus stored head.",
+	})
+
+	// CatchUpTarget is the head the current catch-up is working towards
+	CatchUpTarget = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "catchup_target_head",
+		Help:      "Head the current catch-up is working towards.",
+	})
+	// CatchUpRemaining is the number of blocks the catch-up still has to fetch
+	CatchUpRemaining = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "catchup_remaining_blocks",
+		Help:      "Blocks the catch-up still has to fetch.",
+	})
+	// CatchUpBlocks counts the blocks stored by the catch-up
+	CatchUpBlocks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "catchup_blocks_total",
+		Help:      "Blocks stored by the catch-up.",
+	})
+	// FailedBlocks counts the blocks recorded as failed by the step that failed
+	FailedBlocks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failed_blocks_total",
+		Help:      "Blocks recorded as failed after exhausting their retries, by failed step.",
+	}, []string{"step"})
+
+	// QueueDepth is the number of heads queued, being fetched or waiting to be stored
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Heads queued, being fetched or waiting to be stored.",
+	})
+	// QueueDropped counts the duplicate heads dropped by the queue
+	QueueDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_dropped_total",
+		Help:      "Duplicate heads dropped by the queue.",
+	})
+
+	// RateLimited counts the 429 responses that throttled an RPC provider, by provider
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_rate_limited_total",
+		Help:      "429 responses that throttled the RPC provider.",
+	}, []string{"provider"})
+
+	// ProviderHead is the latest block number reported by each RPC provider
+	ProviderHead = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rpc_provider_head",
+		Help:      "Latest block number reported by the RPC provider.",
+	}, []string{"provider"})
+	// ProviderEjected is 1 while an RPC provider is ejected from the pool for lagging behind
+	ProviderEjected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rpc_provider_ejected",
+		Help:      "Whether the RPC provider is ejected from the pool for lagging behind the chain head.",
+	}, []string{"provider"})
+	// Failovers counts the requests retried on another provider, by role
+	Failovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_failovers_total",
+		Help:      "RPC requests retried on another provider after a failure, by role.",
+	}, []string{"role"})
+
+	rpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_request_duration_seconds",
+		Help:      "RPC request latency by provider.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"provider"})
+	rpcErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_errors_total",
+		Help:      "Failed RPC requests by provider and reason.",
+	}, []string{"provider", "reason"})
+
+	// DbWriteDuration observes the storage write latency by backend and operation
+	DbWriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_write_duration_seconds",
+		Help:      "Storage write latency by backend and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "op"})
+	// ProcessRetries counts the retries of Indexer.ProcessBlock by the step that failed
+	ProcessRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "process_retries_total",
+		Help:      "Block processing retries by failed step.",
+	}, []string{"step"})
+)
+
+var chainHeadValue, storedHeadValue atomic.Int64
+
+// SetChainHead records the latest block number seen on the chain
+func SetChainHead(number int64) {
+	chainHeadValue.Store(number)
+	chainHead.Set(float64(number))
+	updateLag()
+}
+
+// SetStoredHead records the latest stored block number
+func SetStoredHead(number int64) {
+	storedHeadValue.Store(number)
+	storedHead.Set(float64(number))
+	updateLag()
+}
+
+// updateLag recomputes the head lag once both heads are known
+func updateLag() {
+	chain, stored := chainHeadValue.Load(), storedHeadValue.Load()
+	if chain == 0 || stored == 0 {
+		return
+	}
+	headLag.Set(float64(chain - stored))
+}
+
+// Since observes the time elapsed since start on the histogram
+func Since(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
+
+// Transport is an http.RoundTripper that records the latency
+// and the failures of the requests sent to an RPC provider
+type Transport struct {
+	provider string
+	next     http.RoundTripper
+}
+
+// NewTransport wraps the next RoundTripper, labeling its metrics with the provider
+func NewTransport(provider string, next http.RoundTripper) *Transport {
+	return &Transport{provider: provider, next: next}
+}
+
+// NewHTTPClient returns an http.Client instrumented for the provider
+func NewHTTPClient(provider string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: NewTransport(provider, http.DefaultTransport),
+		Timeout:   timeout,
+	}
+}
+
+// RoundTrip sends the request, recording its latency and whether it failed
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	rs, err := t.next.RoundTrip(req)
+	Since(rpcDuration.WithLabelValues(t.provider), start)
+
+	if err != nil {
+		rpcErrors.WithLabelValues(t.provider, "transport").Inc()
+		return nil, err
+	}
+	if rs.StatusCode != http.StatusOK {
+		rpcErrors.WithLabelValues(t.provider, strconv.Itoa(rs.StatusCode)).Inc()
+	}
+	return rs, nil
+}
@@ -0,0 +1,50 @@
+package rlp
+
+import (
+	"math/big"
+)
+
+// Bytes encodes a byte string
+func Bytes(b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return []byte{b[0]}
+	}
+	return append(header(0x80, len(b)), b...)
+}
+
+// Uint encodes an unsigned integer as its big endian bytes without leading zeros
+func Uint(u uint64) []byte {
+	return BigInt(new(big.Int).SetUint64(u))
+}
+
+// BigInt encodes a non-negative integer as its big endian bytes without leading zeros
+func BigInt(i *big.Int) []byte {
+	if i == nil {
+		return Bytes(nil)
+	}
+	return Bytes(i.Bytes())
+}
+
+// List encodes a list of already encoded items
+func List(items ...[]byte) []byte {
+	size := 0
+	for _, item := range items {
+		size += len(item)
+	}
+
+	res := header(0xc0, size)
+	for _, item := range items {
+		res = append(res, item...)
+	}
+	return res
+}
+
+// header returns the prefix of a string or list payload of the given size
+func header(offset byte, size int) []byte {
+	if size < 56 {
+		return []byte{offset + byte(size)}
+	}
+
+	sizeBytes := new(big.Int).SetUint64(uint64(size)).Bytes()
+	return append([]byte{offset + 55 + byte(len(sizeBytes))}, sizeBytes...)
+}
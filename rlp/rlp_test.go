@@ -0,0 +1,42 @@
+package rlp
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	lorem := []byte("Lorem ipsum dolor sit amet, consectetur adipisicing elit")
+	word := new(big.Int).Lsh(big.NewInt(1), 248)
+
+	tests := []struct {
+		name string
+		enc  []byte
+		want string
+	}{
+		{"empty string", Bytes(nil), "80"},
+		{"single low byte", Bytes([]byte{0x0f}), "0f"},
+		{"zero byte", Bytes([]byte{0x00}), "00"},
+		{"single high byte", Bytes([]byte{0x80}), "8180"},
+		{"short string", Bytes([]byte("dog")), "83646f67"},
+		{"long string", Bytes(lorem), "b838" + hex.EncodeToString(lorem)},
+		{"zero", Uint(0), "80"},
+		{"small integer", Uint(15), "0f"},
+		{"integer", Uint(1024), "820400"},
+		{"nil big integer", BigInt(nil), "80"},
+		{"big integer", BigInt(word), "a00100000000000000000000000000000000000000000000000000000000000000"},
+		{"empty list", List(), "c0"},
+		{"list of strings", List(Bytes([]byte("cat")), Bytes([]byte("dog"))), "c88363617483646f67"},
+		{"nested lists", List(List(), List(List()), List(List(), List(List()))), "c7c0c1c0c3c0c1c0"},
+		{"long list", List(Bytes(lorem)), "f83ab838" + hex.EncodeToString(lorem)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(tt.enc); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package rpc
+
+import (
+	"avax-indexer/third_party"
+	"encoding/json"
+	"github.com/onrik/ethrpc"
+	"github.com/pkg/errors"
+)
+
+// getBlockByHash fetches a block with its transactions and their envelopes by hash
+// It returns nil if the block is not found
+func getBlockByHash(client *ethrpc.EthRPC, hash string) (*BlockData, error) {
+	raw, err := client.Call("eth_getBlockByHash", hash, true)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlock(raw)
+}
+
+// getBlockByNumber fetches a block with its transactions and their envelopes by number
+// It returns nil if the block is not found
+func getBlockByNumber(client *ethrpc.EthRPC, number int64) (*BlockData, error) {
+	raw, err := client.Call("eth_getBlockByNumber", ethrpc.IntToHex(int(number)), true)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlock(raw)
+}
+
+// decodeBlock decodes a block fetched with its transactions, keeping the envelope
+// fields of the transactions that ethrpc.Block drops
+// It returns nil for a null block
+func decodeBlock(raw json.RawMessage) (*BlockData, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var proxy third_party.ProxyBlockWithTransactions
+	if err := json.Unmarshal(raw, &proxy); err != nil {
+		return nil, errors.Wrap(err, "failed to decode block")
+	}
+	var envelopes struct {
+		Transactions []*third_party.TxEnvelope `json:"transactions"`
+	}
+	if err := json.Unmarshal(raw, &envelopes); err != nil {
+		return nil, errors.Wrap(err, "failed to decode transaction envelopes")
+	}
+
+	block := proxy.ToBlock()
+	return &BlockData{Block: &block, Envelopes: envelopes.Transactions}, nil
+}
@@ -2,167 +2,285 @@ package rpc
 
 import (
 	"avax-indexer/db"
-	"avax-indexer/model"
-	"avax-indexer/third_party"
-	"bytes"
+	"avax-indexer/jsonrpc"
+	"avax-indexer/metrics"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/onrik/ethrpc"
 	"github.com/pkg/errors"
 	"golang.org/x/exp/slog"
-	"io"
 	"net/http"
 	"time"
 )
 
 // CatchUpper is a service that catches up missing blocks
+// The missing range is split into chunks of batchSize blocks, each fetched
+// with a single JSON-RPC batch request by a pool of workers and stored in ascending block order
+// Blocks failing in a batch are fetched again on their own according to the retry policy
+// The chain head is fetched from the live providers of the pool and the chunks from the bulk ones
 type CatchUpper struct {
 	chainRpc  *ethrpc.EthRPC
-	infuraRpc *ethrpc.EthRPC
-	http      *http.Client
-	repo      *db.MongoBlocksRepo
+	batch     *jsonrpc.Client
+	repo      db.BlocksRepo
+	pipeline  *Pipeline
 	blocksNum int64
+	batchSize int64
+	workers   int
+	retry     RetryPolicy
 }
 
-// Req is used for bulk requests to Infura
-type Req struct {
-	Method  string        `json:"method"`
-	Params  []interface{} `json:"params"`
-	Id      int64         `json:"id"`
-	Jsonrpc string        `json:"jsonrpc"`
+// backfillWindow is the number of block numbers checked for stored blocks at once when backfilling
+const backfillWindow = 10000
+
+// chunk is an inclusive range of block numbers fetched with a single batch request
+type chunk struct {
+	from int64
+	to   int64
 }
 
 // NewCatchUpper initializes a new CatchUpper service
-func NewCatchUpper(infuraRpc *ethrpc.EthRPC, chainRpc *ethrpc.EthRPC, repo *db.MongoBlocksRepo, blocksNum int64) *CatchUpper {
+// fetching up to workers chunks of batchSize blocks concurrently
+func NewCatchUpper(pool *Pool, repo db.BlocksRepo, pipeline *Pipeline, blocksNum int64, batchSize int64, workers int, retry RetryPolicy) *CatchUpper {
 	return &CatchUpper{
-		chainRpc:  chainRpc,
-		infuraRpc: infuraRpc,
-		http: &http.Client{
-			Timeout: 120 * time.Second,
-		},
+		chainRpc:  pool.Client(RoleLive),
+		batch:     jsonrpc.NewClient(&http.Client{Transport: pool.Transport(RoleBulk), Timeout: 120 * time.Second}, pool.URL(RoleBulk), retry),
 		repo:      repo,
+		pipeline:  pipeline,
 		blocksNum: blocksNum,
+		batchSize: batchSize,
+		workers:   workers,
+		retry:     retry,
 	}
 }
 
 // CatchUp brings the stored blocks up to date with the current head
 // It will fetch up to 90%*(10000 or the configured amount) blocks,
-// store them in an ordered fashion and then recursively call itself
-// until the current head is reached
-func (c *CatchUpper) CatchUp() error {
-	currBlock, err := c.chainRpc.EthBlockNumber()
-	if err != nil {
-		return errors.Wrap(err, "failed to get current block number")
-	}
+// store them chunk by chunk, oldest first, and then repeat until the current head is reached
+// It stops with the context's error once the context is cancelled
+func (c *CatchUpper) CatchUp(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-	storedHead, err := c.repo.LastHead(context.Background())
-	if err != nil {
-		return errors.Wrap(err, "failed to get last head")
-	}
+		currBlock, err := c.chainRpc.EthBlockNumber()
+		if err != nil {
+			return errors.Wrap(err, "failed to get current block number")
+		}
 
-	if int64(currBlock) == storedHead {
-		return nil
-	}
+		storedHead, err := c.repo.LastHead(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to get last head")
+		}
 
-	req, err := c.prepareRequestForPreviousBlocks(int64(currBlock), storedHead)
-	if err != nil {
-		return errors.Wrap(err, "failed to prepare request")
-	}
+		metrics.SetChainHead(int64(currBlock))
+		metrics.SetStoredHead(storedHead)
+		metrics.CatchUpTarget.Set(float64(currBlock))
+		if int64(currBlock) <= storedHead {
+			metrics.CatchUpRemaining.Set(0)
+			return nil
+		}
 
-	slog.Info("sending request for missing blocks")
-	rs, err := c.http.Do(req)
-	if err != nil {
-		return errors.Wrap(err, "failed to send request")
+		if err := c.fetchRange(ctx, c.missingRange(int64(currBlock), storedHead)); err != nil {
+			return err
+		}
+
+		slog.Info("checking if we need to continue catching up")
 	}
-	defer rs.Body.Close()
+}
 
-	if rs.StatusCode != http.StatusOK {
-		if rs.StatusCode == http.StatusTooManyRequests {
-			var infErr model.InfuraError
-			if err := json.NewDecoder(rs.Body).Decode(&infErr); err != nil {
-				return errors.Wrap(err, "failed to decode infura error")
-			}
+// Backfill fetches and stores the blocks in the inclusive range that are not stored yet,
+// reusing the chunked catch-up fetch path
+// Only missing blocks are fetched, so running it again after an interruption
+// resumes where it stopped
+func (c *CatchUpper) Backfill(ctx context.Context, from int64, to int64) error {
+	if from > to {
+		return errors.Errorf("invalid range: from %d is after to %d", from, to)
+	}
 
-			slog.Warn("got Infura 429; waiting", "backoff_seconds", infErr.Data.Rate.BackoffSeconds)
-			time.Sleep(time.Duration(infErr.Data.Rate.BackoffSeconds) * time.Second)
+	slog.Info("backfilling range", "from", from, "to", to)
+	for start := from; start <= to; start += backfillWindow {
+		end := start + backfillWindow - 1
+		if end > to {
+			end = to
+		}
 
-			return c.CatchUp()
+		stored, err := c.repo.StoredNumbers(ctx, start, end)
+		if err != nil {
+			return errors.Wrap(err, "failed to get stored block numbers")
 		}
 
-		return fmt.Errorf("got status code %d", rs.StatusCode)
+		for _, r := range missingRanges(start, end, stored) {
+			if err := c.fetchRange(ctx, r); err != nil {
+				return err
+			}
+		}
+		slog.Info("backfilled window", "from", start, "to", end, "already_stored", len(stored))
 	}
 
-	slog.Info("decoding blocks")
-	var res []*model.Params[third_party.ProxyBlockWithTransactions]
-	if err := json.NewDecoder(rs.Body).Decode(&res); err != nil {
-		if err == io.EOF {
-			return nil
+	return nil
+}
+
+// missingRange returns the inclusive range of blocks to fetch to reach the current head
+// It covers up to 90%*(10000 or the configured amount) blocks
+// If the stored head is 0, it covers the max amount of blocks
+// If the stored head is not 0, it covers the blocks between the stored head and the current head
+func (c *CatchUpper) missingRange(currHead int64, storedHead int64) chunk {
+	blocksToFetch := int64(0.9 * float32(c.blocksNum))
+	if storedHead != 0 {
+		missing := currHead - storedHead
+		if missing < blocksToFetch {
+			blocksToFetch = missing
 		}
-		return errors.Wrap(err, "failed to decode response body")
 	}
 
-	blocks := make([]*ethrpc.Block, len(res))
-	for i, blk := range res {
-		b := blk.Result.ToBlock()
-		blocks[i] = &b
-	}
+	return chunk{from: currHead - blocksToFetch + 1, to: currHead}
+}
 
-	if err := c.repo.UpsertMany(context.Background(), blocks); err != nil {
-		return errors.Wrap(err, "failed to upsert catching up blocks")
+// fetchRange fetches the range in chunks and stores them oldest first, reporting the progress
+// Up to workers chunks are fetched concurrently, but a chunk is only stored once every older chunk was,
+// so the blocks are inserted in ascending order, the order in which the capped collection evicts them
+// Once a chunk failed after all of its retries, no newer chunk is stored and the error is returned
+func (c *CatchUpper) fetchRange(ctx context.Context, r chunk) error {
+	total := r.to - r.from + 1
+	slog.Info("catching up", "from", r.from, "to", r.to, "count", total, "batch_size", c.batchSize, "workers", c.workers)
+	metrics.CatchUpRemaining.Set(float64(total))
+
+	chunks := make([]chunk, 0, total/c.batchSize+1)
+	for from := r.from; from <= r.to; from += c.batchSize {
+		ch := chunk{from: from, to: from + c.batchSize - 1}
+		if ch.to > r.to {
+			ch.to = r.to
+		}
+		chunks = append(chunks, ch)
 	}
-	slog.Info("saved blocks", "count", len(blocks))
 
-	slog.Info("checking if we need to continue catching up")
-	latestHead, err := c.chainRpc.EthBlockNumber()
-	if err != nil {
-		return errors.Wrap(err, "failed to get latest head")
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Every chunk holds a slot from the start of its fetch until it is stored,
+	// which bounds the fetched chunks waiting for an older one
+	type fetched struct {
+		blocks []*BlockData
+		err    error
 	}
+	results := make([]chan fetched, len(chunks))
+	for i := range results {
+		results[i] = make(chan fetched, 1)
+	}
+	slots := make(chan struct{}, c.workers)
+	go func() {
+		for i, ch := range chunks {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			i, ch := i, ch
+			go func() {
+				blocks, err := c.fetchChunk(ctx, ch)
+				results[i] <- fetched{blocks: blocks, err: err}
+			}()
+		}
+	}()
 
-	if latestHead > currBlock {
-		slog.Info("need to continue catching up", "stored_head", currBlock, "latest_head", latestHead)
-		return c.CatchUp()
+	start := time.Now()
+	done := int64(0)
+	for i, ch := range chunks {
+		var res fetched
+		select {
+		case res = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if res.err == nil {
+			res.err = c.storeChunk(ctx, ch, res.blocks)
+		}
+		<-slots
+		if res.err != nil {
+			slog.Error("giving up on chunk", "from", ch.from, "to", ch.to, "error", res.err)
+			return errors.Wrapf(res.err, "failed to catch up blocks %d to %d", ch.from, ch.to)
+		}
+
+		size := ch.to - ch.from + 1
+		done += size
+		metrics.CatchUpBlocks.Add(float64(size))
+		metrics.CatchUpRemaining.Set(float64(total - done))
+
+		rate := float64(done) / time.Since(start).Seconds()
+		eta := time.Duration(float64(total-done) / rate * float64(time.Second))
+		slog.Info("caught up chunk",
+			"from", ch.from, "to", ch.to,
+			"progress", fmt.Sprintf("%d/%d", done, total),
+			"blocks_per_sec", fmt.Sprintf("%.1f", rate),
+			"eta", eta.Round(time.Second))
 	}
 
+	slog.Info("caught up range", "from", r.from, "to", r.to, "elapsed", time.Since(start).Round(time.Second))
 	return nil
 }
 
-// prepareRequestForPreviousBlocks prepares a request for the previous blocks
-// It will fetch up to 90%*(10000 or the configured amount) blocks
-// If the stored head is 0, it will fetch the max amount of blocks
-// If the stored head is not 0, it will fetch the difference between the current head and the stored head
-func (c *CatchUpper) prepareRequestForPreviousBlocks(currHead int64, storedHead int64) (*http.Request, error) {
-	blocksToFetch := int64(0.9 * float32(c.blocksNum))
-	if storedHead != 0 {
-		missing := currHead - storedHead
-		if missing < blocksToFetch {
-			blocksToFetch = missing
-		}
+// fetchChunk fetches the blocks of the chunk with a batch request, ordered from oldest to newest
+// Blocks failing in the batch are fetched again on their own according to the retry policy
+func (c *CatchUpper) fetchChunk(ctx context.Context, ch chunk) ([]*BlockData, error) {
+	calls := make([]jsonrpc.Call, 0, ch.to-ch.from+1)
+	for num := ch.from; num <= ch.to; num++ {
+		calls = append(calls, jsonrpc.NewCall("eth_getBlockByNumber", fmt.Sprintf("0x%x", num), true))
 	}
 
-	blockNum := currHead
-	reqs := make([]Req, 0)
-	for i := int64(0); i < blocksToFetch; i++ {
-		reqs = append(reqs, Req{
-			Method:  "eth_getBlockByNumber",
-			Params:  []interface{}{fmt.Sprintf("0x%x", blockNum), true},
-			Id:      i,
-			Jsonrpc: "2.0",
-		})
-		blockNum--
+	// Rate limits are waited out by the pool, which pauses the provider for the backoff it asks for,
+	// so a RateLimitError means every bulk provider is throttled and the batch is retried as any failure
+	res, err := jsonrpc.Do[json.RawMessage](ctx, c.batch, calls)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch blocks")
 	}
 
-	b, err := json.Marshal(reqs)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to marshal request")
+	blocks := make([]*BlockData, 0, len(res))
+	for i, raw := range res {
+		num := ch.from + int64(i)
+		b, err := decodeBlock(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode block %d", num)
+		}
+		if b == nil {
+			return nil, errors.Errorf("block %d not found", num)
+		}
+		if int64(b.Number) != num {
+			return nil, errors.Errorf("got block %d for block %d", b.Number, num)
+		}
+		blocks = append(blocks, b)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, c.infuraRpc.URL(), bytes.NewBuffer(b))
+	return blocks, nil
+}
+
+// storeChunk runs the blocks of the chunk through the pipeline, retrying according to the retry policy
+func (c *CatchUpper) storeChunk(ctx context.Context, ch chunk, blocks []*BlockData) error {
+	_, err := c.retry.Do(ctx, func(ctx context.Context) error {
+		return c.pipeline.Process(ctx, blocks)
+	}, func(err error, backoff time.Duration) {
+		slog.Error("failed to process catching up blocks; retrying", "from", ch.from, "to", ch.to, "backoff", backoff, "error", err)
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create request")
+		return errors.Wrap(err, "failed to process catching up blocks")
+	}
+
+	return nil
+}
+
+// missingRanges groups the numbers in the inclusive range that are not in the
+// ascending list of stored numbers into contiguous chunks
+func missingRanges(from int64, to int64, stored []int64) []chunk {
+	ranges := make([]chunk, 0)
+	for _, num := range missingNumbers(from, to, stored) {
+		if n := len(ranges); n > 0 && ranges[n-1].to == num-1 {
+			ranges[n-1].to = num
+			continue
+		}
+		ranges = append(ranges, chunk{from: num, to: num})
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	slog.Info("prepared request for blocks", "count", blocksToFetch, "from", blockNum, "to", currHead)
-	return req, nil
+	return ranges
 }
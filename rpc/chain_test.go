@@ -0,0 +1,240 @@
+package rpc
+
+import (
+	"avax-indexer/db"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/onrik/ethrpc"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBlock is a block served by the fake chain
+type fakeBlock struct {
+	number     int64
+	hash       string
+	parentHash string
+}
+
+// fakeChain serves blocks over JSON-RPC like a provider would
+// Blocks are found by hash whether canonical or not, and by number only if canonical
+type fakeChain struct {
+	mu        sync.Mutex
+	byHash    map[string]*fakeBlock
+	canonical map[int64]*fakeBlock
+	head      int64
+	// delay, if set, holds back the answer for a block
+	delay func(b *fakeBlock) time.Duration
+}
+
+func newFakeChain() *fakeChain {
+	return &fakeChain{byHash: make(map[string]*fakeBlock), canonical: make(map[int64]*fakeBlock)}
+}
+
+// blockHash returns the hash of the block at the given number on the given fork
+func blockHash(fork byte, number int64) string {
+	return fmt.Sprintf("0x%02x%062x", fork, number)
+}
+
+// extend adds the blocks from..to of the fork to the chain, the first one having the given parent
+// Canonical blocks replace the blocks at their numbers and move the head
+func (c *fakeChain) extend(fork byte, parentHash string, from int64, to int64, canonical bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for num := from; num <= to; num++ {
+		b := &fakeBlock{number: num, hash: blockHash(fork, num), parentHash: parentHash}
+		c.byHash[b.hash] = b
+		if canonical {
+			c.canonical[num] = b
+			if num > c.head {
+				c.head = num
+			}
+		}
+		parentHash = b.hash
+	}
+}
+
+func (c *fakeChain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     int               `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var param string
+	if len(req.Params) > 0 {
+		_ = json.Unmarshal(req.Params[0], &param)
+	}
+
+	c.mu.Lock()
+	var result any
+	var block *fakeBlock
+	switch req.Method {
+	case "eth_blockNumber":
+		result = ethrpc.IntToHex(int(c.head))
+	case "eth_getBlockByHash":
+		block = c.byHash[param]
+	case "eth_getBlockByNumber":
+		var num int64
+		fmt.Sscanf(param, "0x%x", &num)
+		block = c.canonical[num]
+	}
+	delay := c.delay
+	c.mu.Unlock()
+
+	if block != nil {
+		if delay != nil {
+			time.Sleep(delay(block))
+		}
+		result = map[string]any{
+			"number":       ethrpc.IntToHex(int(block.number)),
+			"hash":         block.hash,
+			"parentHash":   block.parentHash,
+			"transactions": []any{},
+		}
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result})
+}
+
+// recordStage records the hashes of the processed blocks in order
+type recordStage struct {
+	mu     sync.Mutex
+	hashes []string
+}
+
+func (s *recordStage) Name() string {
+	return "record"
+}
+
+func (s *recordStage) Process(_ context.Context, blocks []*BlockData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range blocks {
+		s.hashes = append(s.hashes, b.Hash)
+	}
+	return nil
+}
+
+func (s *recordStage) processed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.hashes...)
+}
+
+// memoryFailedBlocks records failed blocks in memory
+type memoryFailedBlocks struct {
+	mu     sync.Mutex
+	blocks []db.FailedBlock
+}
+
+func (f *memoryFailedBlocks) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.blocks)
+}
+
+func (f *memoryFailedBlocks) Record(_ context.Context, block *db.FailedBlock) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blocks = append(f.blocks, *block)
+	return nil
+}
+
+func (f *memoryFailedBlocks) List(_ context.Context, limit int) ([]db.FailedBlock, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if limit > len(f.blocks) {
+		limit = len(f.blocks)
+	}
+	return append([]db.FailedBlock(nil), f.blocks[:limit]...), nil
+}
+
+func (f *memoryFailedBlocks) Delete(_ context.Context, hash string, number int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, b := range f.blocks {
+		if b.Hash == hash && b.Number == number {
+			f.blocks = append(f.blocks[:i], f.blocks[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// testIndexer is an indexer over a fake chain storing into a MemoryBlocksRepo
+type testIndexer struct {
+	*Indexer
+	repo     *db.MemoryBlocksRepo
+	recorder *recordStage
+	failed   *memoryFailedBlocks
+}
+
+func newTestIndexer(t *testing.T, chain *fakeChain) *testIndexer {
+	srv := httptest.NewServer(chain)
+	t.Cleanup(srv.Close)
+
+	client := ethrpc.New(srv.URL)
+	repo := db.NewMemoryBlocksRepo(1000)
+	recorder := &recordStage{}
+	failed := &memoryFailedBlocks{}
+	pipeline := NewPipeline(NewBlocksStage(repo), recorder)
+	return &testIndexer{
+		Indexer: &Indexer{
+			rpc:      client,
+			repo:     repo,
+			failed:   failed,
+			pipeline: pipeline,
+			gaps:     NewGapScanner(client, repo, pipeline),
+			retry:    RetryPolicy{MaxAttempts: 1},
+		},
+		repo:     repo,
+		recorder: recorder,
+		failed:   failed,
+	}
+}
+
+// storeCanonical stores the canonical blocks from..to of the fake chain directly, oldest first
+func (ti *testIndexer) storeCanonical(t *testing.T, from int64, to int64) {
+	for num := from; num <= to; num++ {
+		b, err := getBlockByNumber(ti.rpc, num)
+		if err != nil || b == nil {
+			t.Fatalf("failed to get block %d: %v", num, err)
+		}
+		if err := ti.repo.Insert(context.Background(), db.Block{}.FromResponse(b.Block)); err != nil {
+			t.Fatalf("failed to insert block %d: %v", num, err)
+		}
+	}
+}
+
+// storedHashes returns the hashes stored at each number in the inclusive range, in number order
+func (ti *testIndexer) storedHashes(t *testing.T, from int64, to int64) []string {
+	hashes := make([]string, 0)
+	for num := from; num <= to; num++ {
+		blocks, err := ti.repo.FindByNumber(context.Background(), num)
+		if err != nil {
+			t.Fatalf("failed to find block %d: %v", num, err)
+		}
+		for _, b := range blocks {
+			hashes = append(hashes, b.Hash)
+		}
+	}
+	return hashes
+}
+
+// forkHashes returns the hashes of the blocks from..to of the fork
+func forkHashes(fork byte, from int64, to int64) []string {
+	hashes := make([]string, 0, to-from+1)
+	for num := from; num <= to; num++ {
+		hashes = append(hashes, blockHash(fork, num))
+	}
+	return hashes
+}
@@ -0,0 +1,141 @@
+package rpc
+
+import (
+	"avax-indexer/db"
+	"avax-indexer/jsonrpc"
+	"avax-indexer/trie"
+	"context"
+	"encoding/hex"
+	"github.com/onrik/ethrpc"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ContractsStage detects the contracts created in the blocks, fetches their runtime code
+// with a batch of eth_getCode calls at their creation block and stores them along with their code
+// Contracts are not trimmed with the stored window, but are reverted with their block
+type ContractsStage struct {
+	repo  db.ContractsRepo
+	batch *jsonrpc.Client
+	retry RetryPolicy
+}
+
+// NewContractsStage initializes a new ContractsStage sending the batched requests to url with httpClient
+// and retrying them according to the retry policy
+func NewContractsStage(repo db.ContractsRepo, httpClient *http.Client, url string, retry RetryPolicy) *ContractsStage {
+	return &ContractsStage{repo: repo, batch: jsonrpc.NewClient(httpClient, url, nil), retry: retry}
+}
+
+// Name returns the name of the stage
+func (s *ContractsStage) Name() string {
+	return "contracts"
+}
+
+// Process stores the contracts created in the blocks and their code
+// Contracts created by contracts are included for the blocks that were traced
+func (s *ContractsStage) Process(ctx context.Context, blocks []*BlockData) error {
+	contracts := make([]db.Contract, 0)
+	destroyed := make(map[string]bool)
+	for _, b := range blocks {
+		block := db.Block{}.FromResponse(b.Block).WithReceipts(b.Receipts)
+		internal := db.InternalTransactionsFromTraces(b.Hash, b.Number, b.Traces)
+		contracts = append(contracts, db.ContractsFromBlock(block, internal)...)
+		for _, it := range internal {
+			if it.Type == "SELFDESTRUCT" && !it.Reverted {
+				destroyed[it.From] = true
+			}
+		}
+	}
+	if len(contracts) == 0 {
+		return nil
+	}
+
+	res, err := s.fetchCode(ctx, contracts, destroyed)
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch contract code")
+	}
+
+	codes := make([]db.Bytecode, 0, len(contracts))
+	seen := make(map[string]bool)
+	for i, code := range res {
+		raw, err := hex.DecodeString(strings.TrimPrefix(code, "0x"))
+		if err != nil {
+			return errors.Wrapf(err, "failed to decode code of contract %s", contracts[i].Address)
+		}
+
+		hash := "0x" + hex.EncodeToString(trie.Keccak256(raw))
+		contracts[i].CodeHash = hash
+		if !seen[hash] {
+			seen[hash] = true
+			codes = append(codes, db.Bytecode{CodeHash: hash, Code: "0x" + hex.EncodeToString(raw)})
+		}
+	}
+
+	if err := s.repo.UpsertMany(ctx, contracts, codes); err != nil {
+		return errors.Wrap(err, "failed to upsert contracts")
+	}
+
+	return nil
+}
+
+// errNoCode is the error of created contracts answered with empty code
+var errNoCode = errors.New("got no code")
+
+// fetchCode returns the code of the contracts at their creation block, retrying according to the retry policy
+// A provider that has not caught up with the creation block may answer 0x, so empty code is fetched again,
+// unless the contract is known to have self-destructed in a traced block
+// Runtime code can legally be empty, like for a constructor returning nothing, so code still empty
+// once the retries ran out is kept rather than failing the blocks
+func (s *ContractsStage) fetchCode(ctx context.Context, contracts []db.Contract, destroyed map[string]bool) ([]string, error) {
+	codes := make([]string, len(contracts))
+	pending := make([]int, len(contracts))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	_, err := s.retry.Do(ctx, func(ctx context.Context) error {
+		calls := make([]jsonrpc.Call, len(pending))
+		for j, i := range pending {
+			calls[j] = jsonrpc.NewCall("eth_getCode", contracts[i].Address, ethrpc.IntToHex(contracts[i].BlockNumber))
+		}
+		res, err := jsonrpc.Do[string](ctx, s.batch, calls)
+		if err != nil {
+			return err
+		}
+
+		empty := make([]int, 0)
+		for j, code := range res {
+			i := pending[j]
+			codes[i] = code
+			if (code == "" || code == "0x") && !destroyed[contracts[i].Address] {
+				empty = append(empty, i)
+			}
+		}
+		pending = empty
+		if len(pending) > 0 {
+			return errors.Wrapf(errNoCode, "%d created contracts, like %s", len(pending), contracts[pending[0]].Address)
+		}
+		return nil
+	}, func(err error, backoff time.Duration) {
+		slog.Warn("failed to fetch contract code; retrying", "contracts", len(pending), "backoff", backoff, "error", err)
+	})
+	if errors.Is(err, errNoCode) && ctx.Err() == nil {
+		for _, i := range pending {
+			slog.Warn("created contract has no code; storing it with empty code", "address", contracts[i].Address, "block", contracts[i].BlockNumber)
+		}
+		return codes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Revert removes the contracts created in orphaned blocks
+func (s *ContractsStage) Revert(ctx context.Context, hashes []string) error {
+	return s.repo.DeleteByBlockHashes(ctx, hashes)
+}
@@ -0,0 +1,98 @@
+package rpc
+
+import (
+	"avax-indexer/db"
+	"avax-indexer/third_party"
+	"context"
+	"encoding/json"
+	"github.com/onrik/ethrpc"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// emptyCodeHash is the Keccak-256 hash of empty code
+const emptyCodeHash = "0xc5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470"
+
+// memoryContracts stores contracts in memory
+type memoryContracts struct {
+	contracts []db.Contract
+	codes     []db.Bytecode
+}
+
+func (m *memoryContracts) UpsertMany(_ context.Context, contracts []db.Contract, codes []db.Bytecode) error {
+	m.contracts = append(m.contracts, contracts...)
+	m.codes = append(m.codes, codes...)
+	return nil
+}
+
+func (m *memoryContracts) DeleteByBlockHashes(context.Context, []string) error { return nil }
+
+func (m *memoryContracts) FindByAddress(context.Context, string) (*db.Contract, error) {
+	return nil, db.ErrNotFound
+}
+
+func (m *memoryContracts) FindByCodeHash(context.Context, string, int) ([]db.Contract, error) {
+	return nil, nil
+}
+
+func (m *memoryContracts) FindCode(context.Context, string) (*db.Bytecode, error) {
+	return nil, db.ErrNotFound
+}
+
+func TestContractsStageStoresEmptyCode(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqs []struct {
+			ID int `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		calls.Add(1)
+		res := make([]map[string]any, len(reqs))
+		for i, req := range reqs {
+			res[i] = map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": "0x"}
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	defer srv.Close()
+
+	const (
+		blockHash = "0x00000000000000000000000000000000000000000000000000000000000000b1"
+		txHash    = "0x00000000000000000000000000000000000000000000000000000000000000c1"
+		created   = "0x00000000000000000000000000000000000000d1"
+	)
+	block := &BlockData{
+		Block: &ethrpc.Block{
+			Number:       7,
+			Hash:         blockHash,
+			Transactions: []ethrpc.Transaction{{Hash: txHash, From: "0x00000000000000000000000000000000000000e1"}},
+		},
+		Receipts: []*third_party.Receipt{{
+			TransactionHash: txHash,
+			BlockHash:       blockHash,
+			BlockNumber:     7,
+			ContractAddress: created,
+			Status:          "0x1",
+		}},
+	}
+
+	repo := &memoryContracts{}
+	s := NewContractsStage(repo, srv.Client(), srv.URL, RetryPolicy{MaxAttempts: 3})
+	if err := s.Process(context.Background(), []*BlockData{block}); err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+
+	if n := calls.Load(); n != 3 {
+		t.Errorf("got %d eth_getCode batches, want the empty code retried up to 3 attempts", n)
+	}
+	if len(repo.contracts) != 1 || repo.contracts[0].Address != created || repo.contracts[0].CodeHash != emptyCodeHash {
+		t.Errorf("got contracts %+v, want %s with the empty code hash", repo.contracts, created)
+	}
+	if len(repo.codes) != 1 || repo.codes[0].CodeHash != emptyCodeHash || repo.codes[0].Code != "0x" {
+		t.Errorf("got codes %+v, want the empty code", repo.codes)
+	}
+}
@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"avax-indexer/db"
+	"context"
+	"github.com/pkg/errors"
+	"math/big"
+	"strings"
+)
+
+const (
+	// erc20TransferTopic is keccak256("Transfer(address,address,uint256)")
+	erc20TransferTopic = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+	// erc20ApprovalTopic is keccak256("Approval(address,address,uint256)")
+	erc20ApprovalTopic = "0x8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925"
+)
+
+// Token event kinds stored in db.TokenTransfer.Event
+const (
+	TokenEventTransfer = "transfer"
+	TokenEventApproval = "approval"
+)
+
+// DecodeERC20 decodes the standard ERC-20 Transfer and Approval events from the logs
+// ERC-721 events share the same signatures but index the token id as a fourth topic,
+// so only logs with exactly three topics and a single 32 byte word of data are decoded
+func DecodeERC20(logs []db.Log) []db.TokenTransfer {
+	result := make([]db.TokenTransfer, 0)
+	for _, l := range logs {
+		var event string
+		switch strings.ToLower(l.Topic0) {
+		case erc20TransferTopic:
+			event = TokenEventTransfer
+		case erc20ApprovalTopic:
+			event = TokenEventApproval
+		default:
+			continue
+		}
+
+		data := strings.TrimPrefix(l.Data, "0x")
+		if len(l.Topics) != 3 || len(data) != 64 {
+			continue
+		}
+		amount, ok := new(big.Int).SetString(data, 16)
+		if !ok {
+			continue
+		}
+
+		result = append(result, db.TokenTransfer{
+			Event:           event,
+			Token:           strings.ToLower(l.Address),
+			From:            topicToAddress(l.Topics[1]),
+			To:              topicToAddress(l.Topics[2]),
+			Amount:          amount.String(),
+			BlockNumber:     l.BlockNumber,
+			BlockHash:       l.BlockHash,
+			TransactionHash: l.TransactionHash,
+			LogIndex:        l.LogIndex,
+		})
+	}
+
+	return result
+}
+
+// topicToAddress returns the address held in the last 20 bytes of an indexed topic
+func topicToAddress(topic string) string {
+	t := strings.ToLower(strings.TrimPrefix(topic, "0x"))
+	if len(t) < 40 {
+		return "0x" + t
+	}
+	return "0x" + t[len(t)-40:]
+}
+
+// TokenTransfersStage decodes ERC-20 events from the fetched receipts and stores them
+// Transfers of blocks that fell out of the stored window are trimmed after every batch
+type TokenTransfersStage struct {
+	repo   db.TokenTransfersRepo
+	blocks db.BlocksRepo
+}
+
+// NewTokenTransfersStage initializes a new TokenTransfersStage
+func NewTokenTransfersStage(repo db.TokenTransfersRepo, blocks db.BlocksRepo) *TokenTransfersStage {
+	return &TokenTransfersStage{repo: repo, blocks: blocks}
+}
+
+// Name returns the name of the stage
+func (s *TokenTransfersStage) Name() string {
+	return "token_transfers"
+}
+
+// Process decodes and stores the token transfers of the blocks
+// and trims the transfers outside of the stored window
+func (s *TokenTransfersStage) Process(ctx context.Context, blocks []*BlockData) error {
+	transfers := make([]db.TokenTransfer, 0)
+	for _, b := range blocks {
+		transfers = append(transfers, DecodeERC20(db.LogsFromReceipts(b.Receipts))...)
+	}
+
+	if err := s.repo.UpsertMany(ctx, transfers); err != nil {
+		return errors.Wrap(err, "failed to upsert token transfers")
+	}
+
+	first, err := s.blocks.FirstHead(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get first head")
+	}
+	if err := s.repo.DeleteBefore(ctx, first); err != nil {
+		return errors.Wrap(err, "failed to trim token transfers")
+	}
+
+	return nil
+}
+
+// Revert removes the token transfers of orphaned blocks
+func (s *TokenTransfersStage) Revert(ctx context.Context, hashes []string) error {
+	return s.repo.DeleteByBlockHashes(ctx, hashes)
+}
@@ -0,0 +1,137 @@
+package rpc
+
+import (
+	"avax-indexer/db"
+	"context"
+	"github.com/onrik/ethrpc"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"time"
+)
+
+// gapBatchSize is the number of fetched missing blocks stored at once
+const gapBatchSize = 100
+
+// GapScanner is a service that finds block numbers missing from the stored window
+// and fetches exactly those blocks
+type GapScanner struct {
+	rpc      *ethrpc.EthRPC
+	repo     db.BlocksRepo
+	pipeline *Pipeline
+	trigger  chan struct{}
+}
+
+// NewGapScanner initializes a new GapScanner service
+func NewGapScanner(client *ethrpc.EthRPC, repo db.BlocksRepo, pipeline *Pipeline) *GapScanner {
+	return &GapScanner{
+		rpc:      client,
+		repo:     repo,
+		pipeline: pipeline,
+		trigger:  make(chan struct{}, 1),
+	}
+}
+
+// Run scans for gaps right away, then on every interval and whenever a scan is triggered,
+// until the context is cancelled
+func (g *GapScanner) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		if err := g.Scan(ctx); err != nil {
+			slog.Error("failed to scan for gaps", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-g.trigger:
+		}
+	}
+}
+
+// Trigger requests a scan from Run without blocking
+// Requests made while a scan is already pending are coalesced
+func (g *GapScanner) Trigger() {
+	select {
+	case g.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Scan finds the block numbers missing between the oldest and the newest stored block
+// and fetches and stores them
+func (g *GapScanner) Scan(ctx context.Context) error {
+	first, err := g.repo.FirstHead(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get first head")
+	}
+	last, err := g.repo.LastHead(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get last head")
+	}
+	if last == 0 {
+		return nil
+	}
+
+	stored, err := g.repo.StoredNumbers(ctx, first, last)
+	if err != nil {
+		return errors.Wrap(err, "failed to get stored block numbers")
+	}
+
+	missing := missingNumbers(first, last, stored)
+	if len(missing) == 0 {
+		return nil
+	}
+	slog.Info("found gaps in stored blocks", "missing", len(missing), "from", first, "to", last)
+
+	blocks := make([]*BlockData, 0, gapBatchSize)
+	for _, num := range missing {
+		block, err := getBlockByNumber(g.rpc, num)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get block %d", num)
+		}
+		if block == nil {
+			return errors.Errorf("block %d not found", num)
+		}
+
+		blocks = append(blocks, block)
+		if len(blocks) == gapBatchSize {
+			if err := g.pipeline.Process(ctx, blocks); err != nil {
+				return errors.Wrap(err, "failed to process missing blocks")
+			}
+			blocks = blocks[:0]
+		}
+	}
+
+	if len(blocks) > 0 {
+		if err := g.pipeline.Process(ctx, blocks); err != nil {
+			return errors.Wrap(err, "failed to process missing blocks")
+		}
+	}
+	slog.Info("filled gaps in stored blocks", "count", len(missing))
+
+	return nil
+}
+
+// missingNumbers returns the numbers in the inclusive range that are not in the
+// ascending list of stored numbers
+func missingNumbers(from int64, to int64, stored []int64) []int64 {
+	missing := make([]int64, 0)
+	next := from
+	for _, num := range stored {
+		if num < next {
+			continue
+		}
+		for ; next < num && next <= to; next++ {
+			missing = append(missing, next)
+		}
+		next = num + 1
+	}
+	for ; next <= to; next++ {
+		missing = append(missing, next)
+	}
+
+	return missing
+}
@@ -0,0 +1,105 @@
+package rpc
+
+import (
+	"context"
+	"golang.org/x/exp/slices"
+	"testing"
+)
+
+func TestMissingNumbers(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   int64
+		to     int64
+		stored []int64
+		want   []int64
+	}{
+		{"nothing stored", 1, 4, nil, []int64{1, 2, 3, 4}},
+		{"everything stored", 1, 4, []int64{1, 2, 3, 4}, []int64{}},
+		{"gaps inside", 1, 8, []int64{1, 3, 4, 7, 8}, []int64{2, 5, 6}},
+		{"gaps at both ends", 1, 6, []int64{3, 4}, []int64{1, 2, 5, 6}},
+		{"stored outside the range", 5, 7, []int64{1, 2, 6, 9}, []int64{5, 7}},
+		{"duplicate numbers", 1, 4, []int64{1, 2, 2, 4}, []int64{3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := missingNumbers(tt.from, tt.to, tt.stored); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMissingRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   int64
+		to     int64
+		stored []int64
+		want   []chunk
+	}{
+		{"nothing stored", 1, 4, nil, []chunk{{1, 4}}},
+		{"everything stored", 1, 4, []int64{1, 2, 3, 4}, []chunk{}},
+		{"gaps inside", 1, 8, []int64{1, 3, 4, 7, 8}, []chunk{{2, 2}, {5, 6}}},
+		{"gaps at both ends", 1, 6, []int64{3, 4}, []chunk{{1, 2}, {5, 6}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := missingRanges(tt.from, tt.to, tt.stored); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGapScannerScan(t *testing.T) {
+	chain := newFakeChain()
+	chain.extend(forkA, blockHash(forkA, 0), 1, 20, true)
+	ti := newTestIndexer(t, chain)
+
+	ctx := context.Background()
+	missing := []int64{3, 4, 9, 15}
+	for num := int64(1); num <= 20; num++ {
+		if !slices.Contains(missing, num) {
+			ti.storeCanonical(t, num, num)
+		}
+	}
+
+	if err := ti.gaps.Scan(ctx); err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+
+	if got := ti.storedHashes(t, 1, 20); !slices.Equal(got, forkHashes(forkA, 1, 20)) {
+		t.Errorf("stored %v after the scan, want every block", got)
+	}
+	want := make([]string, 0, len(missing))
+	for _, num := range missing {
+		want = append(want, blockHash(forkA, num))
+	}
+	if got := ti.recorder.processed(); !slices.Equal(got, want) {
+		t.Errorf("processed %v, want the missing blocks %v", got, want)
+	}
+
+	stored, err := ti.repo.StoredNumbers(ctx, 1, 20)
+	if err != nil {
+		t.Fatalf("failed to get stored numbers: %v", err)
+	}
+	if len(stored) != 20 {
+		t.Errorf("got %d stored numbers, want 20", len(stored))
+	}
+}
+
+func TestGapScannerScanEmpty(t *testing.T) {
+	chain := newFakeChain()
+	chain.extend(forkA, blockHash(forkA, 0), 1, 5, true)
+	ti := newTestIndexer(t, chain)
+
+	if err := ti.gaps.Scan(context.Background()); err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	if got := ti.recorder.processed(); len(got) != 0 {
+		t.Errorf("processed %v with nothing stored, want nothing", got)
+	}
+}
@@ -0,0 +1,263 @@
+package rpc
+
+import (
+	"avax-indexer/metrics"
+	"context"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"strconv"
+	"sync"
+)
+
+// head is a block announced by the websocket feed or found missing by a backfill
+// Backfilled heads are fetched by number and have no hash
+type head struct {
+	hash   string
+	number int64
+	seq    uint64
+	block  *BlockData
+	done   bool
+}
+
+// key identifies the head for deduplication
+func (h *head) key() string {
+	if h.hash != "" {
+		return h.hash
+	}
+	return "#" + strconv.FormatInt(h.number, 10)
+}
+
+// HeadQueue is a bounded queue of heads processed by a fixed pool of workers
+// Workers fetch the blocks concurrently, while a single committer stores them
+// in number order: a fetched block is only stored once every queued head
+// with a lower number has been stored. Heads arriving with the same number,
+// like the competing blocks of a reorg, are stored in the order they were received
+// Heads that are already queued or were recently stored are dropped
+// Heads whose block cannot be fetched or stored are recorded as failed blocks and skipped
+type HeadQueue struct {
+	indexer *Indexer
+	jobs    chan *head
+	size    int
+	workers int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[string]*head
+	recent  map[string]struct{}
+	ring    []string
+	ringPos int
+	seq     uint64
+	closed  bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewHeadQueue initializes a new HeadQueue holding up to size heads
+// and fetching up to workers blocks concurrently
+func NewHeadQueue(indexer *Indexer, size int, workers int) *HeadQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &HeadQueue{
+		indexer: indexer,
+		jobs:    make(chan *head, size),
+		size:    size,
+		workers: workers,
+		pending: make(map[string]*head),
+		recent:  make(map[string]struct{}),
+		ring:    make([]string, 2*size),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Start starts the workers and the committer
+func (q *HeadQueue) Start() {
+	for w := 0; w < q.workers; w++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	q.wg.Add(1)
+	go q.commit()
+}
+
+// Close stops accepting heads and waits for the workers and the committer to return
+// Heads that were not stored yet are dropped; they are backfilled on the next start
+func (q *HeadQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	q.cancel()
+	q.cond.Broadcast()
+	q.wg.Wait()
+}
+
+// Depth returns the number of heads queued, being fetched or waiting to be stored
+func (q *HeadQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Enqueue adds a head announced by hash to the queue
+// It blocks while size heads are pending, applying backpressure to the caller
+// It reports whether the head was queued, i.e. it was not a duplicate and the queue is open
+func (q *HeadQueue) Enqueue(hash string, number int64) bool {
+	return q.enqueue(&head{hash: hash, number: number})
+}
+
+// Backfill queues all blocks between the stored head and the current chain head
+// It is used to recover the heads missed while the websocket feed was disconnected
+// Nothing is done if no blocks are stored yet, as catching up is the CatchUpper's job
+func (q *HeadQueue) Backfill() error {
+	storedHead, err := q.indexer.repo.LastHead(q.ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get last head")
+	}
+	if storedHead == 0 {
+		return nil
+	}
+
+	currHead, err := q.indexer.rpc.EthBlockNumber()
+	if err != nil {
+		return errors.Wrap(err, "failed to get current block number")
+	}
+
+	if int64(currHead) <= storedHead {
+		return nil
+	}
+
+	slog.Info("backfilling missed heads", "from", storedHead+1, "to", currHead)
+	for num := storedHead + 1; num <= int64(currHead); num++ {
+		q.enqueue(&head{number: num})
+	}
+
+	return nil
+}
+
+// enqueue registers the head as pending and hands it to the workers
+// once there is room for it
+func (q *HeadQueue) enqueue(h *head) bool {
+	q.mu.Lock()
+	for !q.closed && len(q.pending) >= q.size {
+		q.cond.Wait()
+	}
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	key := h.key()
+	_, queued := q.pending[key]
+	_, stored := q.recent[key]
+	if queued || stored {
+		q.mu.Unlock()
+		metrics.QueueDropped.Inc()
+		slog.Debug("dropping duplicate head", "number", h.number, "hash", h.hash)
+		return false
+	}
+	q.seq++
+	h.seq = q.seq
+	q.pending[key] = h
+	metrics.QueueDepth.Set(float64(len(q.pending)))
+	q.mu.Unlock()
+
+	// Never blocks, as there are at most size pending heads
+	q.jobs <- h
+	return true
+}
+
+// work fetches the blocks of the queued heads until the queue is closed
+func (q *HeadQueue) work() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case h := <-q.jobs:
+			block, attempts, err := q.indexer.fetch(q.ctx, h.hash, h.number)
+			if q.ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				q.indexer.deadLetter(h.hash, h.number, attempts, err)
+			}
+
+			q.mu.Lock()
+			h.block = block
+			h.done = true
+			q.mu.Unlock()
+			q.cond.Broadcast()
+		}
+	}
+}
+
+// commit stores the fetched blocks in number order until the queue is closed
+func (q *HeadQueue) commit() {
+	defer q.wg.Done()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		next := q.next()
+		for !q.closed && (next == nil || !next.done) {
+			q.cond.Wait()
+			next = q.next()
+		}
+		if q.closed {
+			return
+		}
+
+		if next.block != nil {
+			q.mu.Unlock()
+			attempts, err := q.indexer.store(q.ctx, next.block)
+			if err != nil && q.ctx.Err() == nil {
+				q.indexer.deadLetter(next.block.Hash, int64(next.block.Number), attempts, err)
+			}
+			q.mu.Lock()
+		}
+
+		q.remember(next)
+		q.cond.Broadcast()
+	}
+}
+
+// next returns the pending head with the lowest number, received first among equal numbers
+// The caller must hold q.mu
+func (q *HeadQueue) next() *head {
+	var next *head
+	for _, h := range q.pending {
+		if next == nil || h.number < next.number || (h.number == next.number && h.seq < next.seq) {
+			next = h
+		}
+	}
+	return next
+}
+
+// remember moves a stored head from the pending heads to the recently stored ones
+// Backfilled heads are remembered by their block hash as well, so the same block
+// announced by the websocket feed afterwards is dropped
+// The caller must hold q.mu
+func (q *HeadQueue) remember(h *head) {
+	key := h.key()
+	delete(q.pending, key)
+	metrics.QueueDepth.Set(float64(len(q.pending)))
+
+	q.addRecent(key)
+	if h.hash == "" && h.block != nil {
+		q.addRecent(h.block.Hash)
+	}
+}
+
+// addRecent records a recently stored key, forgetting the oldest one once the ring is full
+// The caller must hold q.mu
+func (q *HeadQueue) addRecent(key string) {
+	if old := q.ring[q.ringPos]; old != "" {
+		delete(q.recent, old)
+	}
+	q.ring[q.ringPos] = key
+	q.ringPos = (q.ringPos + 1) % len(q.ring)
+	q.recent[key] = struct{}{}
+}
@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"context"
+	"golang.org/x/exp/slices"
+	"testing"
+	"time"
+)
+
+// waitDrained waits for the queue to store every pending head
+func waitDrained(t *testing.T, q *HeadQueue) {
+	deadline := time.Now().Add(10 * time.Second)
+	for q.Depth() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue still holds %d heads", q.Depth())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHeadQueueStoresInNumberOrder(t *testing.T) {
+	chain := newFakeChain()
+	chain.extend(forkA, blockHash(forkA, 0), 1, 20, true)
+	ti := newTestIndexer(t, chain)
+	ti.storeCanonical(t, 1, 10)
+
+	// Newer blocks are answered first, so they are fetched before the older ones
+	chain.delay = func(b *fakeBlock) time.Duration {
+		return time.Duration(20-b.number) * 20 * time.Millisecond
+	}
+
+	q := NewHeadQueue(ti.Indexer, 16, 8)
+	q.Start()
+	defer q.Close()
+
+	for _, num := range []int64{13, 11, 12, 16, 14, 15, 20, 17, 19, 18} {
+		if !q.Enqueue(blockHash(forkA, num), num) {
+			t.Fatalf("head %d was not queued", num)
+		}
+	}
+	if q.Enqueue(blockHash(forkA, 13), 13) {
+		t.Errorf("duplicate head 13 was queued")
+	}
+	waitDrained(t, q)
+
+	if got, want := ti.recorder.processed(), forkHashes(forkA, 11, 20); !slices.Equal(got, want) {
+		t.Errorf("processed %v, want %v", got, want)
+	}
+	if got := ti.storedHashes(t, 1, 20); !slices.Equal(got, forkHashes(forkA, 1, 20)) {
+		t.Errorf("stored %v, want every block", got)
+	}
+	if q.Enqueue(blockHash(forkA, 15), 15) {
+		t.Errorf("recently stored head 15 was queued")
+	}
+	if n := ti.failed.count(); n != 0 {
+		t.Errorf("got %d failed blocks, want none", n)
+	}
+}
+
+func TestHeadQueueStoresCompetingHeadsInReceivedOrder(t *testing.T) {
+	chain := newFakeChain()
+	chain.extend(forkA, blockHash(forkA, 0), 1, 11, true)
+	chain.extend(forkB, blockHash(forkA, 10), 11, 11, true)
+	ti := newTestIndexer(t, chain)
+	ti.storeCanonical(t, 1, 10)
+
+	// The head received last is answered first
+	chain.delay = func(b *fakeBlock) time.Duration {
+		if b.hash == blockHash(forkA, 11) {
+			return 200 * time.Millisecond
+		}
+		return 0
+	}
+
+	q := NewHeadQueue(ti.Indexer, 16, 4)
+	q.Start()
+	defer q.Close()
+
+	q.Enqueue(blockHash(forkA, 11), 11)
+	q.Enqueue(blockHash(forkB, 11), 11)
+	waitDrained(t, q)
+
+	want := []string{blockHash(forkA, 11), blockHash(forkB, 11)}
+	if got := ti.recorder.processed(); !slices.Equal(got, want) {
+		t.Errorf("processed %v, want %v", got, want)
+	}
+	blocks, err := ti.repo.FindByNumber(context.Background(), 11)
+	if err != nil {
+		t.Fatalf("failed to find block 11: %v", err)
+	}
+	if len(blocks) != 1 || blocks[0].Hash != blockHash(forkB, 11) {
+		t.Errorf("stored %v at 11, want the head received last", blocks)
+	}
+	if orphans := ti.repo.Orphans(); len(orphans) != 1 || orphans[0].ReplacedBy != blockHash(forkB, 11) {
+		t.Errorf("got orphans %v, want the first head replaced by the last one", orphans)
+	}
+}
@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"avax-indexer/db"
+	"avax-indexer/metrics"
 	"context"
 	"github.com/onrik/ethrpc"
 	"github.com/pkg/errors"
@@ -9,48 +10,370 @@ import (
 	"time"
 )
 
+// maxReorgDepth is the maximum number of blocks the indexer walks back
+// when looking for the common ancestor of a reorganized chain
+const maxReorgDepth = 128
+
+// reorgTimeout bounds the time spent walking back and storing a canonical branch
+const reorgTimeout = 30 * time.Second
+
+// processTimeout bounds the time spent running a block through the pipeline
+const processTimeout = 30 * time.Second
+
+// fetchDelay is the time given to a new head to propagate before it is fetched by hash
+const fetchDelay = 1 * time.Second
+
+// Processing steps, recorded on failed blocks and labelling the retry metrics
+const (
+	stepFetch   = "fetch"
+	stepReorg   = "reorg"
+	stepHead    = "head"
+	stepProcess = "process"
+)
+
 // Indexer is a service that processes received blocks and stores them in the database
+// Fetching and storing a block are retried according to the retry policy,
+// after which the block is recorded in the failed blocks repository to be redriven later
+// Blocks are fetched from the live providers of the pool
+// Whenever it stores a block more than one past the previously stored head,
+// it triggers the gap scanner to fill the skipped blocks
 type Indexer struct {
-	rpc  *ethrpc.EthRPC
-	repo *db.MongoBlocksRepo
+	rpc      *ethrpc.EthRPC
+	repo     db.BlocksRepo
+	failed   db.FailedBlocksRepo
+	pipeline *Pipeline
+	gaps     *GapScanner
+	retry    RetryPolicy
 }
 
 // NewIndexer initializes a new Indexer service
-func NewIndexer(client *ethrpc.EthRPC, repo *db.MongoBlocksRepo) *Indexer {
-	return &Indexer{rpc: client, repo: repo}
-}
-
-// ProcessBlock fetches a block by hash and stores it in the database
-// Retries fetching the block if it ETH returns an error after 1 second
-// Retries fetching the block if ETH returns an empty block after 1 second
-// Retries inserting the block if the database returns an error after 1 second
-func (i *Indexer) ProcessBlock(hash string) {
-retry:
-	time.Sleep(1 * time.Second)
-	block, err := i.rpc.EthGetBlockByHash(hash, true)
+func NewIndexer(pool *Pool, repo db.BlocksRepo, failed db.FailedBlocksRepo, pipeline *Pipeline, gaps *GapScanner, retry RetryPolicy) *Indexer {
+	return &Indexer{rpc: pool.Client(RoleLive), repo: repo, failed: failed, pipeline: pipeline, gaps: gaps, retry: retry}
+}
+
+// Redrive retries up to limit blocks recorded in the failed blocks repository, in number order
+// Stored blocks are removed from the repository and blocks failing again have their entry updated
+// Blocks that fell out of the stored window in the meantime are removed without being retried
+// It returns the number of stored and of still failing blocks
+func (i *Indexer) Redrive(ctx context.Context, limit int) (int, int, error) {
+	failed, err := i.failed.List(ctx, limit)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to list failed blocks")
+	}
+	firstHead, err := i.repo.FirstHead(ctx)
 	if err != nil {
-		if e := new(ethrpc.EthError); errors.As(err, e) {
-			if e.Code == -32000 {
-				slog.Warn("too early; retrying block after 1 second", "hash", hash)
-				goto retry
+		return 0, 0, errors.Wrap(err, "failed to get first head")
+	}
+
+	stored, failing := 0, 0
+	for _, fb := range failed {
+		if fb.Number < firstHead {
+			slog.Info("failed block fell out of the stored window; dropping it", "number", fb.Number, "hash", fb.Hash)
+			if err := i.failed.Delete(ctx, fb.Hash, fb.Number); err != nil {
+				return stored, failing, err
 			}
+			continue
+		}
+
+		slog.Info("redriving failed block", "number", fb.Number, "hash", fb.Hash, "attempts", fb.Attempts, "error", fb.Error)
+		block, attempts, err := i.fetch(ctx, fb.Hash, fb.Number)
+		if err == nil {
+			var storeAttempts int
+			storeAttempts, err = i.store(ctx, block)
+			attempts += storeAttempts
+		}
+		if ctx.Err() != nil {
+			return stored, failing, ctx.Err()
+		}
+		if err != nil {
+			i.deadLetter(fb.Hash, fb.Number, attempts, err)
+			failing++
+			continue
+		}
+
+		if err := i.failed.Delete(ctx, fb.Hash, fb.Number); err != nil {
+			return stored, failing, err
+		}
+		stored++
+	}
+
+	return stored, failing, nil
+}
+
+// Repair fetches the canonical blocks at the given numbers and stores them, replacing the stored ones
+// Stored blocks that are not canonical are orphaned along the way, like on a reorg
+// Blocks that cannot be fetched or stored are recorded in the failed blocks repository
+// It returns the number of repaired and of still failing blocks
+func (i *Indexer) Repair(ctx context.Context, numbers []int64) (int, int, error) {
+	repaired, failing := 0, 0
+	for _, num := range numbers {
+		slog.Info("repairing block", "number", num)
+		block, attempts, err := i.fetch(ctx, "", num)
+		if err == nil {
+			var storeAttempts int
+			storeAttempts, err = i.store(ctx, block)
+			attempts += storeAttempts
+		}
+		if ctx.Err() != nil {
+			return repaired, failing, ctx.Err()
+		}
+		if err != nil {
+			i.deadLetter("", num, attempts, err)
+			failing++
+			continue
+		}
+		repaired++
+	}
+
+	return repaired, failing, nil
+}
+
+// fetch fetches a block by hash, or by number if no hash is given, retrying according to the retry policy
+// Blocks announced by hash are given some time to propagate first
+// It returns the number of attempts made
+func (i *Indexer) fetch(ctx context.Context, hash string, number int64) (*BlockData, int, error) {
+	if hash != "" && !sleep(ctx, fetchDelay) {
+		return nil, 0, ctx.Err()
+	}
+
+	var block *BlockData
+	attempts, err := i.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		if hash != "" {
+			block, err = getBlockByHash(i.rpc, hash)
+		} else {
+			block, err = getBlockByNumber(i.rpc, number)
+		}
+		if err != nil {
+			return &stepError{step: stepFetch, err: errors.Wrap(err, "failed to get block")}
+		}
+		if block == nil {
+			return &stepError{step: stepFetch, err: errors.New("block not found")}
+		}
+		return nil
+	}, func(err error, backoff time.Duration) {
+		metrics.ProcessRetries.WithLabelValues(stepFetch).Inc()
+		if e := new(ethrpc.EthError); errors.As(err, e) && e.Code == -32000 {
+			slog.Warn("too early; retrying block", "number", number, "hash", hash, "backoff", backoff)
+			return
+		}
+		slog.Error("failed to get block; retrying", "number", number, "hash", hash, "backoff", backoff, "error", err)
+	})
+	if err != nil {
+		return nil, attempts, err
+	}
+
+	return block, attempts, nil
+}
+
+// store resolves reorgs for the block and runs it through the pipeline, retrying according to the retry policy
+// It returns the number of attempts made
+func (i *Indexer) store(ctx context.Context, block *BlockData) (int, error) {
+	return i.retry.Do(ctx, func(ctx context.Context) error {
+		return i.storeOnce(ctx, block)
+	}, func(err error, backoff time.Duration) {
+		metrics.ProcessRetries.WithLabelValues(stepOf(err)).Inc()
+		slog.Error("failed to store block; retrying", "number", block.Number, "hash", block.Hash, "backoff", backoff, "error", err)
+	})
+}
+
+// storeOnce resolves reorgs for the block and runs it through the pipeline
+func (i *Indexer) storeOnce(parent context.Context, block *BlockData) error {
+	reorgCtx, cancelReorg := context.WithTimeout(parent, reorgTimeout)
+	defer cancelReorg()
+
+	if err := i.resolveReorg(reorgCtx, block); err != nil {
+		return &stepError{step: stepReorg, err: errors.Wrap(err, "failed to resolve reorg")}
+	}
+
+	ctx, cancel := context.WithTimeout(parent, processTimeout)
+	defer cancel()
+
+	storedHead, err := i.repo.LastHead(ctx)
+	if err != nil {
+		return &stepError{step: stepHead, err: errors.Wrap(err, "failed to get last head")}
+	}
+
+	if err := i.pipeline.Process(ctx, []*BlockData{block}); err != nil {
+		return &stepError{step: stepProcess, err: errors.Wrap(err, "failed to process block")}
+	}
+
+	if int64(block.Number) > storedHead {
+		metrics.SetStoredHead(int64(block.Number))
+	}
+
+	if storedHead != 0 && int64(block.Number) > storedHead+1 {
+		slog.Warn("head skipped blocks; triggering gap scan", "number", block.Number, "stored_head", storedHead)
+		i.gaps.Trigger()
+	}
+
+	return nil
+}
+
+// deadLetter records a block that failed all its attempts in the failed blocks repository
+func (i *Indexer) deadLetter(hash string, number int64, attempts int, err error) {
+	slog.Error("giving up on block; recording it as failed", "number", number, "hash", hash, "attempts", attempts, "error", err)
+	metrics.FailedBlocks.WithLabelValues(stepOf(err)).Inc()
+
+	now := time.Now().UTC()
+	fb := &db.FailedBlock{
+		Hash:          hash,
+		Number:        number,
+		Step:          stepOf(err),
+		Error:         err.Error(),
+		Attempts:      attempts,
+		FirstFailedAt: now,
+		LastFailedAt:  now,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), processTimeout)
+	defer cancel()
+	if err := i.failed.Record(ctx, fb); err != nil {
+		slog.Error("failed to record failed block", "number", number, "hash", hash, "error", err)
+	}
+}
+
+// resolveReorg checks that the given block extends the stored chain
+// If the block's parent hash does not match the block stored at number-1, it walks back along
+// the parent hashes until it finds the common ancestor and stores the canonical branch it fetched
+// Competing blocks stored at the heights of the block and of the branch are orphaned
+// The stored chain is only changed once the common ancestor was found, so a reorg deeper
+// than maxReorgDepth fails and leaves it untouched
+func (i *Indexer) resolveReorg(ctx context.Context, block *BlockData) error {
+	canonical := make([]*BlockData, 0)
+	curr := block
+	for {
+		extends, err := i.extendsStored(ctx, int64(curr.Number-1), curr.ParentHash)
+		if err != nil {
+			return err
+		}
+		if extends {
+			break
+		}
+		if len(canonical) == maxReorgDepth {
+			slog.Error("reorg is deeper than the max depth; giving up", "number", block.Number, "hash", block.Hash, "max_depth", maxReorgDepth)
+			return errors.Errorf("reorg is deeper than %d blocks", maxReorgDepth)
+		}
+
+		parent, err := getBlockByHash(i.rpc, curr.ParentHash)
+		if err != nil {
+			return errors.Wrap(err, "failed to get canonical parent block")
+		}
+		if parent == nil {
+			return errors.Errorf("canonical parent block %s not found", curr.ParentHash)
+		}
+
+		canonical = append(canonical, parent)
+		curr = parent
+	}
+
+	if err := i.orphanNonCanonical(ctx, int64(block.Number), block.Hash); err != nil {
+		return err
+	}
+	for _, b := range canonical {
+		if err := i.orphanNonCanonical(ctx, int64(b.Number), b.Hash); err != nil {
+			return err
+		}
+	}
+
+	if len(canonical) == 0 {
+		return nil
+	}
+
+	// The branch was fetched walking back, and is stored oldest first
+	for l, r := 0, len(canonical)-1; l < r; l, r = l+1, r-1 {
+		canonical[l], canonical[r] = canonical[r], canonical[l]
+	}
+	slog.Info("storing canonical branch", "count", len(canonical), "from", canonical[0].Number, "to", block.Number-1)
+	if err := i.pipeline.Process(ctx, canonical); err != nil {
+		return errors.Wrap(err, "failed to process canonical branch")
+	}
+
+	return nil
+}
+
+// extendsStored reports whether a block with the given parent extends the stored chain,
+// which it does when the parent is stored at its height or nothing is stored there at all
+func (i *Indexer) extendsStored(ctx context.Context, number int64, parentHash string) (bool, error) {
+	blocks, err := i.repo.FindByNumber(ctx, number)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to find stored blocks")
+	}
+	if len(blocks) == 0 {
+		return true, nil
+	}
+
+	for _, b := range blocks {
+		if b.Hash == parentHash {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// orphanNonCanonical moves all blocks stored at the given height whose hash differs
+// from the canonical one to the orphaned blocks collection
+func (i *Indexer) orphanNonCanonical(ctx context.Context, number int64, canonicalHash string) error {
+	blocks, err := i.repo.FindByNumber(ctx, number)
+	if err != nil {
+		return errors.Wrap(err, "failed to find stored blocks")
+	}
+
+	orphans := make([]db.Block, 0)
+	hashes := make([]string, 0)
+	for _, b := range blocks {
+		if b.Hash == canonicalHash {
+			continue
 		}
-		slog.Error("failed to get block; retrying after 1 second", "hash", hash, "error", err)
-		goto retry
+		orphans = append(orphans, b)
+		hashes = append(hashes, b.Hash)
 	}
 
-	if block == nil {
-		slog.Warn("block not found; retrying", "hash", hash)
-		goto retry
+	if len(orphans) == 0 {
+		return nil
 	}
 
-retryInsert:
-	ctx, c := context.WithTimeout(context.Background(), 1*time.Second)
-	defer c()
+	slog.Warn("chain reorganization detected", "number", number, "canonical_hash", canonicalHash, "orphaned", len(orphans))
+	// Derived data is reverted first, so a failure leaves the blocks in place to be retried
+	if err := i.pipeline.Revert(ctx, hashes); err != nil {
+		return errors.Wrap(err, "failed to revert orphaned blocks")
+	}
+	if err := i.repo.MoveToOrphans(ctx, orphans, canonicalHash); err != nil {
+		return errors.Wrap(err, "failed to orphan blocks")
+	}
+
+	return nil
+}
+
+// sleep waits for the duration and reports whether it elapsed before the context was cancelled
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// stepError tags an error with the processing step that failed
+type stepError struct {
+	step string
+	err  error
+}
+
+func (e *stepError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stepError) Unwrap() error {
+	return e.err
+}
 
-	if err := i.repo.Insert(ctx, block); err != nil {
-		slog.Error("failed to insert block; retrying in 1 sec", "hash", block.Hash, "error", err)
-		time.Sleep(1 * time.Second)
-		goto retryInsert
+// stepOf returns the processing step that failed with the error
+func stepOf(err error) string {
+	var e *stepError
+	if errors.As(err, &e) {
+		return e.step
 	}
+	return "unknown"
 }
@@ -0,0 +1,118 @@
+package rpc
+
+import (
+	"context"
+	"golang.org/x/exp/slices"
+	"strings"
+	"testing"
+)
+
+const (
+	forkA byte = 0xa
+	forkB byte = 0xb
+)
+
+func TestResolveReorg(t *testing.T) {
+	tests := []struct {
+		name string
+		// forkAt is the number of the last block fork B shares with fork A, or 0 if B is not mined
+		forkAt int64
+		// head is the number of the block of fork B given to the indexer, or of fork A if B is not mined
+		head int64
+		// wantStored is the fork stored at each number after the head was stored
+		wantStored []string
+		// wantProcessed is the blocks run through the pipeline, in order
+		wantProcessed []string
+		wantOrphaned  []string
+	}{
+		{
+			name:          "block extends the stored chain",
+			head:          11,
+			wantStored:    forkHashes(forkA, 1, 11),
+			wantProcessed: forkHashes(forkA, 11, 11),
+		},
+		{
+			name:          "competing block at the stored head",
+			forkAt:        9,
+			head:          10,
+			wantStored:    append(forkHashes(forkA, 1, 9), forkHashes(forkB, 10, 10)...),
+			wantProcessed: forkHashes(forkB, 10, 10),
+			wantOrphaned:  forkHashes(forkA, 10, 10),
+		},
+		{
+			name:          "new head on a fork of the stored head",
+			forkAt:        8,
+			head:          11,
+			wantStored:    append(forkHashes(forkA, 1, 8), forkHashes(forkB, 9, 11)...),
+			wantProcessed: forkHashes(forkB, 9, 11),
+			wantOrphaned:  forkHashes(forkA, 9, 10),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := newFakeChain()
+			chain.extend(forkA, blockHash(forkA, 0), 1, 11, true)
+			ti := newTestIndexer(t, chain)
+			ti.storeCanonical(t, 1, 10)
+
+			fork := forkA
+			if tt.forkAt != 0 {
+				chain.extend(forkB, blockHash(forkA, tt.forkAt), tt.forkAt+1, tt.head, true)
+				fork = forkB
+			}
+			head, err := getBlockByHash(ti.rpc, blockHash(fork, tt.head))
+			if err != nil || head == nil {
+				t.Fatalf("failed to get head: %v", err)
+			}
+
+			if err := ti.storeOnce(context.Background(), head); err != nil {
+				t.Fatalf("failed to store head: %v", err)
+			}
+
+			if got := ti.storedHashes(t, 1, tt.head); !slices.Equal(got, tt.wantStored) {
+				t.Errorf("stored %v, want %v", got, tt.wantStored)
+			}
+			if got := ti.recorder.processed(); !slices.Equal(got, tt.wantProcessed) {
+				t.Errorf("processed %v, want %v", got, tt.wantProcessed)
+			}
+			orphaned := make([]string, 0)
+			for _, o := range ti.repo.Orphans() {
+				orphaned = append(orphaned, o.Hash)
+			}
+			slices.Sort(orphaned)
+			if !slices.Equal(orphaned, tt.wantOrphaned) {
+				t.Errorf("orphaned %v, want %v", orphaned, tt.wantOrphaned)
+			}
+		})
+	}
+}
+
+func TestResolveReorgDeeperThanMaxDepth(t *testing.T) {
+	const stored = maxReorgDepth + 20
+	chain := newFakeChain()
+	chain.extend(forkA, blockHash(forkA, 0), 1, stored, true)
+	ti := newTestIndexer(t, chain)
+	ti.storeCanonical(t, 1, stored)
+
+	// Fork B diverges right after block 10 and reaches past the stored head
+	chain.extend(forkB, blockHash(forkA, 10), 11, stored+1, true)
+	head, err := getBlockByHash(ti.rpc, blockHash(forkB, stored+1))
+	if err != nil || head == nil {
+		t.Fatalf("failed to get head: %v", err)
+	}
+
+	err = ti.storeOnce(context.Background(), head)
+	if err == nil || !strings.Contains(err.Error(), "reorg is deeper than") {
+		t.Fatalf("got error %v, want a reorg deeper than the max depth", err)
+	}
+	if got := ti.storedHashes(t, 1, stored+1); !slices.Equal(got, forkHashes(forkA, 1, stored)) {
+		t.Errorf("stored chain was changed: %v", got)
+	}
+	if orphans := ti.repo.Orphans(); len(orphans) != 0 {
+		t.Errorf("got %d orphaned blocks, want none", len(orphans))
+	}
+	if processed := ti.recorder.processed(); len(processed) != 0 {
+		t.Errorf("processed %v, want nothing", processed)
+	}
+}
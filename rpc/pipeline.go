@@ -0,0 +1,78 @@
+package rpc
+
+import (
+	"avax-indexer/third_party"
+	"context"
+	"github.com/onrik/ethrpc"
+	"github.com/pkg/errors"
+)
+
+// BlockData is a fetched block together with the data the pipeline stages gather for it
+// Envelopes are the signature fields of the block's transactions, fetched along with the block
+// Traces are the call trees of the transactions, in transaction order, and are nil unless
+// the block was traced
+type BlockData struct {
+	*ethrpc.Block
+	Envelopes []*third_party.TxEnvelope
+	Receipts  []*third_party.Receipt
+	Traces    []*third_party.TxTrace
+}
+
+// Stage is a single step of processing fetched blocks
+// Stages run in order, so a stage can rely on the data gathered by the stages before it
+type Stage interface {
+	// Name identifies the stage in errors and logs
+	Name() string
+	// Process handles a batch of blocks ordered from oldest to newest
+	Process(ctx context.Context, blocks []*BlockData) error
+}
+
+// Reverter is implemented by stages that store data derived from blocks,
+// which has to be removed when the blocks are orphaned by a reorg
+type Reverter interface {
+	Revert(ctx context.Context, hashes []string) error
+}
+
+// Pipeline runs fetched blocks through the configured stages
+// It is shared by the Indexer, the CatchUpper and the GapScanner,
+// so every stored block goes through the same processing
+type Pipeline struct {
+	stages []Stage
+}
+
+// NewPipeline initializes a new Pipeline running the stages in the given order
+func NewPipeline(stages ...Stage) *Pipeline {
+	return &Pipeline{stages: stages}
+}
+
+// Process runs all stages over the blocks, stopping at the first failing stage
+// The blocks must be ordered from oldest to newest
+// All stages are idempotent, so a failed batch can be processed again
+func (p *Pipeline) Process(ctx context.Context, blocks []*BlockData) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	for _, s := range p.stages {
+		if err := s.Process(ctx, blocks); err != nil {
+			return errors.Wrapf(err, "stage %s failed", s.Name())
+		}
+	}
+
+	return nil
+}
+
+// Revert removes the data the stages derived from the given orphaned blocks
+func (p *Pipeline) Revert(ctx context.Context, hashes []string) error {
+	for _, s := range p.stages {
+		r, ok := s.(Reverter)
+		if !ok {
+			continue
+		}
+		if err := r.Revert(ctx, hashes); err != nil {
+			return errors.Wrapf(err, "failed to revert stage %s", s.Name())
+		}
+	}
+
+	return nil
+}
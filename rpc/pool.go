@@ -0,0 +1,442 @@
+package rpc
+
+import (
+	"avax-indexer/metrics"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/onrik/ethrpc"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Provider roles
+const (
+	// RoleLive providers serve the new heads and the chain head
+	RoleLive = "live"
+	// RoleBulk providers serve the catch-up, backfill and gap scan requests
+	RoleBulk = "bulk"
+)
+
+// ewmaAlpha is the weight of the latest sample in the latency and error rate averages
+const ewmaAlpha = 0.2
+
+// minLatency is the latency assumed for providers without samples and the floor of the average
+const minLatency = 10 * time.Millisecond
+
+// ProviderConfig is an RPC endpoint of the pool
+// The weight scales the health score, so that preferred providers are chosen
+// over others performing equally
+// RPS and CreditsPerSec limit the calls sent to the provider, with 0 being unlimited
+type ProviderConfig struct {
+	URL           string
+	Weight        float64
+	Roles         []string
+	RPS           float64
+	CreditsPerSec float64
+}
+
+// ProviderStatus is a snapshot of the health of a provider
+type ProviderStatus struct {
+	Name      string
+	Roles     []string
+	Weight    float64
+	Latency   time.Duration
+	ErrorRate float64
+	Head      int64
+	Ejected   bool
+}
+
+// provider is an RPC endpoint of the pool and its health
+type provider struct {
+	name   string
+	url    *url.URL
+	weight float64
+	roles  []string
+	next   http.RoundTripper
+	limit  *limiter
+	rpc    *ethrpc.EthRPC
+
+	mu        sync.Mutex
+	latency   time.Duration
+	errorRate float64
+	head      int64
+	ejected   bool
+}
+
+// record updates the latency and error rate averages with a request outcome
+func (p *provider) record(latency time.Duration, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	failure := 0.0
+	if failed {
+		failure = 1
+	}
+	p.errorRate = ewmaAlpha*failure + (1-ewmaAlpha)*p.errorRate
+	if p.latency == 0 {
+		p.latency = latency
+	} else {
+		p.latency = time.Duration(ewmaAlpha*float64(latency) + (1-ewmaAlpha)*float64(p.latency))
+	}
+}
+
+// score returns the health score of the provider, higher being healthier
+func (p *provider) score() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	latency := p.latency
+	if latency < minLatency {
+		latency = minLatency
+	}
+	return p.weight * (1 - p.errorRate) / latency.Seconds()
+}
+
+func (p *provider) isEjected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ejected
+}
+
+// Pool routes the JSON-RPC requests of each role to the healthiest of its providers
+// Providers are scored by their weight, average latency and error rate, and rate limited
+// to their configured requests and credits per second. A request failing
+// on one provider is retried on the next best one. Providers whose head falls more than
+// maxLag blocks behind the highest head seen are ejected until they catch up,
+// and are only used when no other provider is left
+// The pool is used through the ethrpc clients and http clients it builds for a role
+type Pool struct {
+	providers []*provider
+	maxLag    int64
+	timeout   time.Duration
+}
+
+// NewPool initializes a new Pool of the given providers
+// Requests time out after timeout, including the retries on other providers
+func NewPool(configs []ProviderConfig, maxLag int64, timeout time.Duration) (*Pool, error) {
+	pool := &Pool{maxLag: maxLag, timeout: timeout}
+	names := make(map[string]int)
+	for _, c := range configs {
+		u, err := url.Parse(c.URL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, errors.Errorf("invalid provider url for %v", c.Roles)
+		}
+		if c.Weight <= 0 {
+			return nil, errors.Errorf("provider %s must have a positive weight", u.Host)
+		}
+		if c.RPS < 0 || c.CreditsPerSec < 0 {
+			return nil, errors.Errorf("provider %s must not have negative rate limits", u.Host)
+		}
+		for _, role := range c.Roles {
+			if role != RoleLive && role != RoleBulk {
+				return nil, errors.Errorf("provider %s has unknown role %q", u.Host, role)
+			}
+		}
+
+		// Providers are named after their host, which unlike the path holds no API key
+		name := u.Host
+		if names[u.Host]++; names[u.Host] > 1 {
+			name = fmt.Sprintf("%s#%d", u.Host, names[u.Host])
+		}
+		limit := newLimiter(c.RPS, c.CreditsPerSec)
+		next := &limitedTransport{provider: name, limiter: limit, next: metrics.NewTransport(name, http.DefaultTransport)}
+		pool.providers = append(pool.providers, &provider{
+			name:   name,
+			url:    u,
+			weight: c.Weight,
+			roles:  c.Roles,
+			next:   next,
+			limit:  limit,
+			rpc:    ethrpc.New(c.URL, ethrpc.WithHttpClient(&http.Client{Transport: next, Timeout: timeout})),
+		})
+	}
+
+	for _, role := range []string{RoleLive, RoleBulk} {
+		if len(pool.candidates(role)) == 0 {
+			return nil, errors.Errorf("no provider has the %s role", role)
+		}
+	}
+	return pool, nil
+}
+
+// URL returns the placeholder URL of a role
+// Requests sent to it through the role's transport are routed to a provider
+func (p *Pool) URL(role string) string {
+	return "http://" + role + ".pool"
+}
+
+// Transport returns the RoundTripper routing the requests of a role
+func (p *Pool) Transport(role string) http.RoundTripper {
+	return &poolTransport{pool: p, role: role}
+}
+
+// HTTPClient returns an http.Client routing the requests of a role
+func (p *Pool) HTTPClient(role string) *http.Client {
+	return &http.Client{Transport: p.Transport(role), Timeout: p.timeout}
+}
+
+// Client returns an ethrpc client routing its calls to the providers of a role
+func (p *Pool) Client(role string) *ethrpc.EthRPC {
+	return ethrpc.New(p.URL(role), ethrpc.WithHttpClient(p.HTTPClient(role)))
+}
+
+// Run polls the heads of the providers right away and then on every interval,
+// until the context is cancelled
+func (p *Pool) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.Poll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll fetches the head of every provider, updating their health,
+// and ejects the providers lagging too far behind the highest head
+func (p *Pool) Poll() {
+	var wg sync.WaitGroup
+	for _, prov := range p.providers {
+		prov := prov
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			head, err := prov.rpc.EthBlockNumber()
+			prov.record(time.Since(start), err != nil)
+			if err != nil {
+				slog.Warn("failed to poll rpc provider head", "provider", prov.name, "error", err)
+				return
+			}
+
+			prov.mu.Lock()
+			prov.head = int64(head)
+			prov.mu.Unlock()
+			metrics.ProviderHead.WithLabelValues(prov.name).Set(float64(head))
+		}()
+	}
+	wg.Wait()
+
+	chainHead := int64(0)
+	for _, prov := range p.providers {
+		if s := prov.status(); s.Head > chainHead {
+			chainHead = s.Head
+		}
+	}
+
+	for _, prov := range p.providers {
+		prov.mu.Lock()
+		behind := prov.head < chainHead-p.maxLag
+		if behind != prov.ejected {
+			if behind {
+				slog.Warn("rpc provider fell behind the chain head; ejecting it", "provider", prov.name, "head", prov.head, "chain_head", chainHead)
+			} else {
+				slog.Info("rpc provider caught up with the chain head; restoring it", "provider", prov.name, "head", prov.head)
+			}
+		}
+		prov.ejected = behind
+		prov.mu.Unlock()
+
+		ejected := 0.0
+		if behind {
+			ejected = 1
+		}
+		metrics.ProviderEjected.WithLabelValues(prov.name).Set(ejected)
+	}
+}
+
+// Status returns a snapshot of the health of every provider
+func (p *Pool) Status() []ProviderStatus {
+	res := make([]ProviderStatus, len(p.providers))
+	for i, prov := range p.providers {
+		res[i] = prov.status()
+	}
+	return res
+}
+
+func (p *provider) status() ProviderStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return ProviderStatus{
+		Name:      p.name,
+		Roles:     p.roles,
+		Weight:    p.weight,
+		Latency:   p.latency,
+		ErrorRate: p.errorRate,
+		Head:      p.head,
+		Ejected:   p.ejected,
+	}
+}
+
+// candidates returns the providers of a role in the order they are tried,
+// the healthy ones by descending score followed by the ones waiting out a rate limit backoff
+// and the ejected ones
+func (p *Pool) candidates(role string) []*provider {
+	now := time.Now()
+	healthy := make([]*provider, 0)
+	paused := make([]*provider, 0)
+	ejected := make([]*provider, 0)
+	for _, prov := range p.providers {
+		if !slices.Contains(prov.roles, role) {
+			continue
+		}
+		switch {
+		case prov.isEjected():
+			ejected = append(ejected, prov)
+		case prov.limit.paused(now):
+			paused = append(paused, prov)
+		default:
+			healthy = append(healthy, prov)
+		}
+	}
+
+	byScore := func(ps []*provider) {
+		scores := make(map[*provider]float64, len(ps))
+		for _, prov := range ps {
+			scores[prov] = prov.score()
+		}
+		sort.SliceStable(ps, func(i, j int) bool {
+			return scores[ps[i]] > scores[ps[j]]
+		})
+	}
+	byScore(healthy)
+	byScore(paused)
+	byScore(ejected)
+	return append(append(healthy, paused...), ejected...)
+}
+
+// poolTransport routes the requests of a role to the pool's providers
+type poolTransport struct {
+	pool *Pool
+	role string
+}
+
+// RoundTrip sends the request to the healthiest provider of the role, failing over to the next
+// one on a transport error or an unsuccessful status
+// A successful response carrying a JSON-RPC error, for the request or any call of a batch,
+// counts as a failure of the provider but is returned, as the caller decides whether to retry it
+// If every provider fails, the last failure is returned
+func (t *poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	candidates := t.pool.candidates(t.role)
+
+	var lastRs *http.Response
+	var lastErr error
+	for i, prov := range candidates {
+		out := req.Clone(req.Context())
+		if i > 0 {
+			// The body was consumed by the previous attempt
+			if req.Context().Err() != nil || (req.Body != nil && req.GetBody == nil) {
+				break
+			}
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					break
+				}
+				out.Body = body
+			}
+			metrics.Failovers.WithLabelValues(t.role).Inc()
+		}
+		u := *prov.url
+		out.URL = &u
+		out.Host = u.Host
+
+		start := time.Now()
+		rs, err := prov.next.RoundTrip(out)
+		rpcFailed := false
+		if err == nil && rs.StatusCode == http.StatusOK {
+			rpcFailed, err = peekRPCError(rs)
+			if err != nil {
+				rs = nil
+			}
+		}
+		failed := err != nil || rs.StatusCode != http.StatusOK
+		prov.record(time.Since(start), failed || rpcFailed)
+		if lastRs != nil {
+			lastRs.Body.Close()
+			lastRs = nil
+		}
+		if !failed {
+			return rs, nil
+		}
+
+		if err != nil {
+			slog.Warn("rpc provider request failed", "provider", prov.name, "role", t.role, "error", err)
+		} else {
+			slog.Warn("rpc provider request failed", "provider", prov.name, "role", t.role, "status", rs.StatusCode)
+		}
+		lastRs, lastErr = rs, err
+	}
+
+	if lastRs != nil {
+		return lastRs, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.Errorf("no %s provider available", t.role)
+	}
+	return nil, lastErr
+}
+
+// peekRPCError reports whether the body of the response holds a JSON-RPC error,
+// for a single call or any call of a batch, leaving the body to be read again as it was received
+func peekRPCError(rs *http.Response) (bool, error) {
+	raw, err := io.ReadAll(rs.Body)
+	rs.Body.Close()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read response")
+	}
+	rs.Body = io.NopCloser(bytes.NewReader(raw))
+	body := decompressed(rs, raw)
+
+	type response struct {
+		Error json.RawMessage `json:"error"`
+	}
+	hasError := func(r response) bool {
+		return len(r.Error) > 0 && string(r.Error) != "null"
+	}
+
+	var batch []response
+	if err := json.Unmarshal(body, &batch); err == nil {
+		return slices.ContainsFunc(batch, hasError), nil
+	}
+
+	var single response
+	if err := json.Unmarshal(body, &single); err != nil {
+		return false, nil
+	}
+	return hasError(single), nil
+}
+
+// decompressed returns the body read from the response, decompressed if it is gzip encoded
+// Clients asking for gzip themselves get the compressed body from the transport
+// A body that fails to decompress is returned as is
+func decompressed(rs *http.Response, body []byte) []byte {
+	if rs.Header.Get("Content-Encoding") != "gzip" {
+		return body
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return body
+	}
+	defer gz.Close()
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		return body
+	}
+	return data
+}
@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gzipped compresses s
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(s)); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestPoolTransportRecordsGzippedRPCErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantFail bool
+	}{
+		{"result", `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, false},
+		{"error", `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"boom"}}`, true},
+		{"batch with an error", `[{"jsonrpc":"2.0","id":0,"result":"0x1"},{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"boom"}}]`, true},
+		{"batch with results", `[{"jsonrpc":"2.0","id":0,"result":"0x1"},{"jsonrpc":"2.0","id":1,"result":null,"error":null}]`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed := gzipped(t, tt.body)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "gzip")
+				_, _ = w.Write(compressed)
+			}))
+			defer srv.Close()
+
+			pool, err := NewPool([]ProviderConfig{{URL: srv.URL, Weight: 1, Roles: []string{RoleLive, RoleBulk}}}, 10, time.Second)
+			if err != nil {
+				t.Fatalf("failed to create pool: %v", err)
+			}
+
+			// Asking for gzip keeps the transport from decompressing the response, like the batch client does
+			req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(`{}`))
+			req.Header.Set("Accept-Encoding", "gzip")
+			rs, err := pool.HTTPClient(RoleBulk).Do(req)
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			body, err := io.ReadAll(rs.Body)
+			rs.Body.Close()
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+
+			if !bytes.Equal(body, compressed) {
+				t.Errorf("response body was not passed on as received")
+			}
+			if failed := pool.Status()[0].ErrorRate > 0; failed != tt.wantFail {
+				t.Errorf("provider failure recorded: %t, want %t", failed, tt.wantFail)
+			}
+		})
+	}
+}
+
+func TestLimitedTransportReadsGzippedRateHints(t *testing.T) {
+	compressed := gzipped(t, `{"code":-32005,"message":"rate limited","data":{"rate":{"current_rps":20,"allowed_rps":10,"backoff_seconds":30}}}`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write(compressed)
+	}))
+	defer srv.Close()
+
+	limit := newLimiter(0, 0)
+	tr := &limitedTransport{provider: "test", limiter: limit, next: http.DefaultTransport}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(`[{"method":"eth_blockNumber"}]`))
+	req.Header.Set("Accept-Encoding", "gzip")
+	rs, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	body, _ := io.ReadAll(rs.Body)
+	rs.Body.Close()
+
+	if !bytes.Equal(body, compressed) {
+		t.Errorf("response body was not passed on as received")
+	}
+	// The default backoff is a second, so a longer pause comes from the hint
+	if !limit.paused(time.Now().Add(10 * time.Second)) {
+		t.Errorf("provider is not paused for the backoff it asked for")
+	}
+}
@@ -0,0 +1,242 @@
+package rpc
+
+import (
+	"avax-indexer/metrics"
+	"avax-indexer/model"
+	"bytes"
+	"encoding/json"
+	"golang.org/x/exp/slog"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// methodCredits approximates the Infura credit cost of the methods the indexer calls
+// Methods missing from it cost defaultCredits
+var methodCredits = map[string]float64{
+	"eth_blockNumber":           80,
+	"eth_chainId":               80,
+	"eth_gasPrice":              80,
+	"eth_getBlockByHash":        80,
+	"eth_getBlockByNumber":      80,
+	"eth_getTransactionReceipt": 80,
+	"eth_getBlockReceipts":      1000,
+	"eth_getCode":               80,
+	"eth_getBalance":            80,
+	"debug_traceBlockByNumber":  1000,
+}
+
+// defaultCredits is the credit cost of the methods missing from methodCredits
+const defaultCredits = 80
+
+// rateHeadroom is the share of the rate Infura reports as allowed that is used after a 429
+const rateHeadroom = 0.9
+
+// rateRecovery is the time over which an adapted rate recovers to the configured one
+const rateRecovery = time.Minute
+
+// defaultRateBackoff is the pause after a 429 that comes without a backoff hint
+const defaultRateBackoff = time.Second
+
+// bucket is a token bucket refilled at rate tokens per second, holding up to one second of tokens
+// Taking more tokens than available puts the bucket in debt, which later takes wait for
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes n tokens at the given rate and returns how long to wait until they are available
+func (b *bucket) take(now time.Time, rate float64, n float64) time.Duration {
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > rate {
+			b.tokens = rate
+		}
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// limiter limits the requests and credits per second sent to a provider
+// A zero limit is unlimited. When the provider answers 429, the limiter pauses for the backoff
+// it asks for and lowers its request rate to the allowed rate it reports, recovering
+// to the configured rate over rateRecovery
+type limiter struct {
+	rps     float64
+	credits float64
+
+	mu          sync.Mutex
+	requests    bucket
+	creditsUsed bucket
+	adaptedRPS  float64
+	adaptedAt   time.Time
+	pausedUntil time.Time
+}
+
+func newLimiter(rps float64, credits float64) *limiter {
+	return &limiter{rps: rps, credits: credits}
+}
+
+// reserve takes the tokens for the calls and returns how long to wait before sending them
+func (l *limiter) reserve(now time.Time, calls []string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var wait time.Duration
+	if l.pausedUntil.After(now) {
+		wait = l.pausedUntil.Sub(now)
+	}
+	if rps := l.currentRPS(now); rps > 0 {
+		if d := l.requests.take(now, rps, float64(len(calls))); d > wait {
+			wait = d
+		}
+	}
+	if l.credits > 0 {
+		cost := 0.0
+		for _, method := range calls {
+			c, ok := methodCredits[method]
+			if !ok {
+				c = defaultCredits
+			}
+			cost += c
+		}
+		if d := l.creditsUsed.take(now, l.credits, cost); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// paused reports whether the limiter is waiting out a 429 backoff
+func (l *limiter) paused(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pausedUntil.After(now)
+}
+
+// currentRPS returns the request rate, adapted after a 429, or 0 if unlimited
+// The caller must hold l.mu
+func (l *limiter) currentRPS(now time.Time) float64 {
+	if l.adaptedAt.IsZero() {
+		return l.rps
+	}
+	since := now.Sub(l.adaptedAt)
+	if since >= rateRecovery {
+		l.adaptedAt = time.Time{}
+		return l.rps
+	}
+	if l.rps == 0 {
+		// There is no configured rate to recover to, so the adapted one holds until it expires
+		return l.adaptedRPS
+	}
+	return l.adaptedRPS + (l.rps-l.adaptedRPS)*since.Seconds()/rateRecovery.Seconds()
+}
+
+// throttle pauses the limiter for the backoff and adapts the request rate
+// to the current and allowed rates reported by the provider, if any
+func (l *limiter) throttle(now time.Time, backoff time.Duration, currentRPS float64, allowedRPS float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := now.Add(backoff); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	if allowedRPS <= 0 {
+		return
+	}
+
+	// Scale the rate sent at down by how far it overshot the allowance
+	target := allowedRPS
+	if rps := l.currentRPS(now); rps > 0 && currentRPS > allowedRPS {
+		if scaled := rps * allowedRPS / currentRPS; scaled < target {
+			target = scaled
+		}
+	}
+	l.adaptedRPS = target * rateHeadroom
+	l.adaptedAt = now
+}
+
+// limitedTransport waits for the limiter of a provider before sending each request,
+// and throttles it on 429 responses
+type limitedTransport struct {
+	provider string
+	limiter  *limiter
+	next     http.RoundTripper
+}
+
+// RoundTrip waits until the calls of the request fit the limits and sends it
+// The request body is read to count the calls of single and batch requests
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var calls []string
+	if req.Body != nil {
+		req = req.Clone(req.Context())
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		calls = methodsOf(body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	if wait := t.limiter.reserve(time.Now(), calls); wait > 0 && !sleep(req.Context(), wait) {
+		return nil, req.Context().Err()
+	}
+
+	rs, err := t.next.RoundTrip(req)
+	if err != nil || rs.StatusCode != http.StatusTooManyRequests {
+		return rs, err
+	}
+
+	body, err := io.ReadAll(rs.Body)
+	rs.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	rs.Body = io.NopCloser(bytes.NewReader(body))
+
+	backoff := defaultRateBackoff
+	if secs, err := strconv.Atoi(rs.Header.Get("Retry-After")); err == nil && secs > 0 {
+		backoff = time.Duration(secs) * time.Second
+	}
+	var infErr model.InfuraError
+	if json.Unmarshal(decompressed(rs, body), &infErr) == nil && infErr.Data.Rate.BackoffSeconds > 0 {
+		backoff = time.Duration(infErr.Data.Rate.BackoffSeconds * float64(time.Second))
+	}
+	slog.Warn("rpc provider rate limited; throttling", "provider", t.provider, "backoff", backoff, "current_rps", infErr.Data.Rate.CurrentRps, "allowed_rps", infErr.Data.Rate.AllowedRps)
+	t.limiter.throttle(time.Now(), backoff, infErr.Data.Rate.CurrentRps, infErr.Data.Rate.AllowedRps)
+	metrics.RateLimited.WithLabelValues(t.provider).Inc()
+
+	return rs, nil
+}
+
+// methodsOf returns the methods of the calls of a single or batch JSON-RPC request
+// A body that is not JSON-RPC counts as a single call
+func methodsOf(body []byte) []string {
+	type call struct {
+		Method string `json:"method"`
+	}
+
+	var batch []call
+	if err := json.Unmarshal(body, &batch); err == nil {
+		methods := make([]string, len(batch))
+		for i, c := range batch {
+			methods[i] = c.Method
+		}
+		return methods
+	}
+
+	var single call
+	_ = json.Unmarshal(body, &single)
+	return []string{single.Method}
+}
@@ -0,0 +1,139 @@
+package rpc
+
+import (
+	"avax-indexer/jsonrpc"
+	"avax-indexer/third_party"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/onrik/ethrpc"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"golang.org/x/sync/errgroup"
+	"net/http"
+	"sync/atomic"
+)
+
+// codeMethodNotFound is the JSON-RPC error code for unsupported methods
+const codeMethodNotFound = -32601
+
+// ReceiptsStage fetches the receipts of the transactions of each block
+// It uses eth_getBlockReceipts and falls back to batched eth_getTransactionReceipt
+// calls once the provider reports that the method is not available
+type ReceiptsStage struct {
+	rpc             *ethrpc.EthRPC
+	batch           *jsonrpc.Client
+	workers         int
+	noBlockReceipts atomic.Bool
+}
+
+// NewReceiptsStage initializes a new ReceiptsStage fetching
+// the receipts of up to workers blocks concurrently
+// Batched requests are sent to the client's URL with httpClient
+func NewReceiptsStage(client *ethrpc.EthRPC, httpClient *http.Client, workers int) *ReceiptsStage {
+	return &ReceiptsStage{
+		rpc:     client,
+		batch:   jsonrpc.NewClient(httpClient, client.URL(), nil),
+		workers: workers,
+	}
+}
+
+// Name returns the name of the stage
+func (s *ReceiptsStage) Name() string {
+	return "receipts"
+}
+
+// Process fetches the receipts of all blocks
+func (s *ReceiptsStage) Process(ctx context.Context, blocks []*BlockData) error {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.workers)
+
+	for _, b := range blocks {
+		b := b
+		if len(b.Block.Transactions) == 0 {
+			continue
+		}
+
+		g.Go(func() error {
+			receipts, err := s.fetch(ctx, b.Block)
+			if err != nil {
+				return errors.Wrapf(err, "failed to fetch receipts of block %d", b.Block.Number)
+			}
+			b.Receipts = receipts
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// fetch returns the receipts of a block, ordered by transaction index
+func (s *ReceiptsStage) fetch(ctx context.Context, block *ethrpc.Block) ([]*third_party.Receipt, error) {
+	if !s.noBlockReceipts.Load() {
+		receipts, err := s.fetchBlockReceipts(ctx, block)
+		if err == nil {
+			return receipts, s.validate(block, receipts)
+		}
+
+		if e := new(jsonrpc.Error); !errors.As(err, &e) || e.Code != codeMethodNotFound {
+			return nil, err
+		}
+		slog.Warn("eth_getBlockReceipts is not supported; falling back to eth_getTransactionReceipt", "host", s.rpc.URL())
+		s.noBlockReceipts.Store(true)
+	}
+
+	receipts, err := s.fetchTransactionReceipts(ctx, block)
+	if err != nil {
+		return nil, err
+	}
+	return receipts, s.validate(block, receipts)
+}
+
+// fetchBlockReceipts fetches all receipts of a block with eth_getBlockReceipts
+// The call is sent on its own through the batch client, so it is cancelled with the context
+// and an unsupported method comes back as a *jsonrpc.Error
+func (s *ReceiptsStage) fetchBlockReceipts(ctx context.Context, block *ethrpc.Block) ([]*third_party.Receipt, error) {
+	res, err := s.batch.Batch(ctx, []jsonrpc.Call{jsonrpc.NewCall("eth_getBlockReceipts", fmt.Sprintf("0x%x", block.Number))})
+	if err != nil {
+		return nil, err
+	}
+	if res[0].Err != nil {
+		return nil, res[0].Err
+	}
+
+	var receipts []*third_party.Receipt
+	if err := json.Unmarshal(res[0].Result, &receipts); err != nil {
+		return nil, errors.Wrap(err, "failed to decode block receipts")
+	}
+
+	return receipts, nil
+}
+
+// fetchTransactionReceipts fetches the receipts of a block with a batch of eth_getTransactionReceipt calls
+func (s *ReceiptsStage) fetchTransactionReceipts(ctx context.Context, block *ethrpc.Block) ([]*third_party.Receipt, error) {
+	calls := make([]jsonrpc.Call, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		calls[i] = jsonrpc.NewCall("eth_getTransactionReceipt", tx.Hash)
+	}
+
+	receipts, err := jsonrpc.Do[*third_party.Receipt](ctx, s.batch, calls)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch transaction receipts")
+	}
+
+	return receipts, nil
+}
+
+// validate checks that the receipts belong to the block and cover all its transactions
+func (s *ReceiptsStage) validate(block *ethrpc.Block, receipts []*third_party.Receipt) error {
+	if len(receipts) != len(block.Transactions) {
+		return errors.Errorf("got %d receipts for %d transactions", len(receipts), len(block.Transactions))
+	}
+	for _, r := range receipts {
+		if r == nil || r.BlockHash != block.Hash {
+			return errors.New("got receipts of a different block")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package rpc
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy retries an operation with exponential backoff and full jitter
+// The backoff before the n-th retry is drawn uniformly from [0, min(MaxBackoff, MinBackoff*2^(n-1))]
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+// DefaultRetryPolicy is used when no policy is configured
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	MinBackoff:  1 * time.Second,
+	MaxBackoff:  30 * time.Second,
+}
+
+// Do calls fn until it succeeds, the attempts are exhausted or the context is cancelled
+// onRetry, if set, is called with the error and the backoff before every retry
+// It returns the number of attempts made and the last error
+func (p RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context) error, onRetry func(err error, backoff time.Duration)) (int, error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(ctx); err == nil {
+			return attempt, nil
+		}
+		if attempt >= p.MaxAttempts {
+			return attempt, err
+		}
+
+		backoff := p.backoff(attempt)
+		if onRetry != nil {
+			onRetry(err, backoff)
+		}
+		if !sleep(ctx, backoff) {
+			return attempt, err
+		}
+	}
+}
+
+// backoff returns the jittered backoff before the retry following the given attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	ceil := p.MinBackoff
+	for i := 1; i < attempt && ceil < p.MaxBackoff; i++ {
+		ceil *= 2
+	}
+	if ceil > p.MaxBackoff {
+		ceil = p.MaxBackoff
+	}
+	if ceil <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceil) + 1))
+}
@@ -0,0 +1,185 @@
+package rpc
+
+import (
+	"avax-indexer/db"
+	"avax-indexer/metrics"
+	"context"
+	"github.com/pkg/errors"
+)
+
+// BlocksStage stores the blocks together with the envelope and receipt fields of their transactions
+type BlocksStage struct {
+	repo db.BlocksRepo
+}
+
+// NewBlocksStage initializes a new BlocksStage
+func NewBlocksStage(repo db.BlocksRepo) *BlocksStage {
+	return &BlocksStage{repo: repo}
+}
+
+// Name returns the name of the stage
+func (s *BlocksStage) Name() string {
+	return "blocks"
+}
+
+// Process maps the blocks and upserts them by hash
+func (s *BlocksStage) Process(ctx context.Context, blocks []*BlockData) error {
+	mapped := make([]*db.Block, len(blocks))
+	for i, b := range blocks {
+		mapped[i] = db.Block{}.FromResponse(b.Block).WithEnvelopes(b.Envelopes).WithReceipts(b.Receipts)
+	}
+
+	if len(mapped) == 1 {
+		if err := s.repo.Insert(ctx, mapped[0]); err != nil {
+			return errors.Wrap(err, "failed to insert block")
+		}
+	} else if err := s.repo.UpsertMany(ctx, mapped); err != nil {
+		return errors.Wrap(err, "failed to upsert blocks")
+	}
+
+	metrics.BlocksStored.Add(float64(len(mapped)))
+	return nil
+}
+
+// LogsStage stores the event logs of the fetched receipts
+// Logs of blocks that fell out of the stored window are trimmed after every batch
+type LogsStage struct {
+	repo   db.LogsRepo
+	blocks db.BlocksRepo
+}
+
+// NewLogsStage initializes a new LogsStage
+func NewLogsStage(repo db.LogsRepo, blocks db.BlocksRepo) *LogsStage {
+	return &LogsStage{repo: repo, blocks: blocks}
+}
+
+// Name returns the name of the stage
+func (s *LogsStage) Name() string {
+	return "logs"
+}
+
+// Process stores the logs of the blocks and trims the logs outside of the stored window
+func (s *LogsStage) Process(ctx context.Context, blocks []*BlockData) error {
+	logs := make([]db.Log, 0)
+	for _, b := range blocks {
+		logs = append(logs, db.LogsFromReceipts(b.Receipts)...)
+	}
+
+	if err := s.repo.UpsertMany(ctx, logs); err != nil {
+		return errors.Wrap(err, "failed to upsert logs")
+	}
+
+	first, err := s.blocks.FirstHead(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get first head")
+	}
+	if err := s.repo.DeleteBefore(ctx, first); err != nil {
+		return errors.Wrap(err, "failed to trim logs")
+	}
+
+	return nil
+}
+
+// Revert removes the logs of orphaned blocks
+func (s *LogsStage) Revert(ctx context.Context, hashes []string) error {
+	return s.repo.DeleteByBlockHashes(ctx, hashes)
+}
+
+// InternalTransactionsStage stores the internal transactions flattened from the traced call trees
+// Untraced blocks are skipped. Internal transactions of blocks that fell out of the stored window
+// are trimmed after every batch
+type InternalTransactionsStage struct {
+	repo   db.InternalTransactionsRepo
+	blocks db.BlocksRepo
+	traces *TracesStage
+}
+
+// NewInternalTransactionsStage initializes a new InternalTransactionsStage storing the traces of the traces stage
+// The stage turns off along with the traces stage
+func NewInternalTransactionsStage(repo db.InternalTransactionsRepo, blocks db.BlocksRepo, traces *TracesStage) *InternalTransactionsStage {
+	return &InternalTransactionsStage{repo: repo, blocks: blocks, traces: traces}
+}
+
+// Name returns the name of the stage
+func (s *InternalTransactionsStage) Name() string {
+	return "internal_transactions"
+}
+
+// Process stores the internal transactions of the traced blocks
+// and trims the internal transactions outside of the stored window, unless tracing was turned off
+func (s *InternalTransactionsStage) Process(ctx context.Context, blocks []*BlockData) error {
+	if s.traces.Disabled() {
+		return nil
+	}
+
+	txs := make([]db.InternalTransaction, 0)
+	for _, b := range blocks {
+		txs = append(txs, db.InternalTransactionsFromTraces(b.Hash, b.Number, b.Traces)...)
+	}
+
+	if err := s.repo.UpsertMany(ctx, txs); err != nil {
+		return errors.Wrap(err, "failed to upsert internal transactions")
+	}
+
+	first, err := s.blocks.FirstHead(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get first head")
+	}
+	if err := s.repo.DeleteBefore(ctx, first); err != nil {
+		return errors.Wrap(err, "failed to trim internal transactions")
+	}
+
+	return nil
+}
+
+// Revert removes the internal transactions of orphaned blocks
+func (s *InternalTransactionsStage) Revert(ctx context.Context, hashes []string) error {
+	return s.repo.DeleteByBlockHashes(ctx, hashes)
+}
+
+// BalanceDeltasStage derives the native AVAX balance deltas of every address from the blocks and stores them
+// The internal transactions are included for the blocks that were traced
+// Deltas of blocks that fell out of the stored window are trimmed after every batch
+type BalanceDeltasStage struct {
+	repo   db.BalanceDeltasRepo
+	blocks db.BlocksRepo
+}
+
+// NewBalanceDeltasStage initializes a new BalanceDeltasStage
+func NewBalanceDeltasStage(repo db.BalanceDeltasRepo, blocks db.BlocksRepo) *BalanceDeltasStage {
+	return &BalanceDeltasStage{repo: repo, blocks: blocks}
+}
+
+// Name returns the name of the stage
+func (s *BalanceDeltasStage) Name() string {
+	return "balance_deltas"
+}
+
+// Process stores the balance deltas of the blocks and trims the deltas outside of the stored window
+func (s *BalanceDeltasStage) Process(ctx context.Context, blocks []*BlockData) error {
+	deltas := make([]db.BalanceDelta, 0)
+	for _, b := range blocks {
+		block := db.Block{}.FromResponse(b.Block).WithReceipts(b.Receipts)
+		internal := db.InternalTransactionsFromTraces(b.Hash, b.Number, b.Traces)
+		deltas = append(deltas, db.BalanceDeltasFromBlock(block, internal, b.Traces != nil)...)
+	}
+
+	if err := s.repo.UpsertMany(ctx, deltas); err != nil {
+		return errors.Wrap(err, "failed to upsert balance deltas")
+	}
+
+	first, err := s.blocks.FirstHead(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get first head")
+	}
+	if err := s.repo.DeleteBefore(ctx, first); err != nil {
+		return errors.Wrap(err, "failed to trim balance deltas")
+	}
+
+	return nil
+}
+
+// Revert removes the balance deltas of orphaned blocks
+func (s *BalanceDeltasStage) Revert(ctx context.Context, hashes []string) error {
+	return s.repo.DeleteByBlockHashes(ctx, hashes)
+}
@@ -0,0 +1,152 @@
+package rpc
+
+import (
+	"avax-indexer/jsonrpc"
+	"avax-indexer/third_party"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/onrik/ethrpc"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"golang.org/x/sync/errgroup"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// callTracer is the tracer config asking debug_traceBlockByNumber for the call tree of every transaction
+var callTracer = map[string]string{"tracer": "callTracer"}
+
+// unsupportedMessages are the parts of error messages providers answer with when the debug namespace
+// is not available, whatever the error code
+var unsupportedMessages = []string{"does not exist", "not available", "not supported"}
+
+// TracesStage traces the transactions of each block with debug_traceBlockByNumber and the callTracer
+// The stage turns itself off for the run once the provider reports that the debug namespace is not available,
+// leaving the blocks untraced
+type TracesStage struct {
+	batch    *jsonrpc.Client
+	url      string
+	workers  int
+	disabled atomic.Bool
+}
+
+// NewTracesStage initializes a new TracesStage tracing up to workers blocks concurrently
+// The calls are sent to url with httpClient
+func NewTracesStage(httpClient *http.Client, url string, workers int) *TracesStage {
+	return &TracesStage{batch: jsonrpc.NewClient(httpClient, url, nil), url: url, workers: workers}
+}
+
+// Disabled reports whether the stage turned itself off
+func (s *TracesStage) Disabled() bool {
+	return s.disabled.Load()
+}
+
+// Name returns the name of the stage
+func (s *TracesStage) Name() string {
+	return "traces"
+}
+
+// Process traces all blocks with transactions, unless the stage is turned off
+func (s *TracesStage) Process(ctx context.Context, blocks []*BlockData) error {
+	if s.disabled.Load() {
+		return nil
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.workers)
+
+	for _, b := range blocks {
+		b := b
+		if len(b.Block.Transactions) == 0 {
+			continue
+		}
+
+		g.Go(func() error {
+			if ctx.Err() != nil || s.disabled.Load() {
+				return ctx.Err()
+			}
+			traces, err := s.trace(ctx, b.Block)
+			if unsupported(err) {
+				if !s.disabled.Swap(true) {
+					slog.Warn("debug_traceBlockByNumber is not supported; disabling call tracing", "host", s.url, "error", err)
+				}
+				return nil
+			}
+			if err != nil {
+				return errors.Wrapf(err, "failed to trace block %d", b.Block.Number)
+			}
+			b.Traces = traces
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	// Blocks traced before the stage turned off are left untraced too, like the rest of the run
+	if s.disabled.Load() {
+		for _, b := range blocks {
+			b.Traces = nil
+		}
+	}
+
+	return nil
+}
+
+// unsupported reports whether the error means the provider does not expose debug_traceBlockByNumber
+// Besides the method not found code, providers answer with their own codes and messages,
+// and gateways reject the method with 403 Forbidden or 405 Method Not Allowed
+func unsupported(err error) bool {
+	if e := new(jsonrpc.Error); errors.As(err, &e) {
+		if e.Code == codeMethodNotFound {
+			return true
+		}
+		msg := strings.ToLower(e.Message)
+		for _, m := range unsupportedMessages {
+			if strings.Contains(msg, m) {
+				return true
+			}
+		}
+	}
+	if e := new(jsonrpc.StatusError); errors.As(err, &e) {
+		return e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusMethodNotAllowed
+	}
+	return false
+}
+
+// trace returns the call trees of the transactions of a block, in transaction order
+// The call is sent on its own through the batch client, so it is cancelled with the context
+// and unsupported methods come back as a *jsonrpc.Error or *jsonrpc.StatusError
+func (s *TracesStage) trace(ctx context.Context, block *ethrpc.Block) ([]*third_party.TxTrace, error) {
+	res, err := s.batch.Batch(ctx, []jsonrpc.Call{jsonrpc.NewCall("debug_traceBlockByNumber", fmt.Sprintf("0x%x", block.Number), callTracer)})
+	if err != nil {
+		return nil, err
+	}
+	if res[0].Err != nil {
+		return nil, res[0].Err
+	}
+
+	var traces []*third_party.TxTrace
+	if err := json.Unmarshal(res[0].Result, &traces); err != nil {
+		return nil, errors.Wrap(err, "failed to decode block traces")
+	}
+	if len(traces) != len(block.Transactions) {
+		return nil, errors.Errorf("got %d traces for %d transactions", len(traces), len(block.Transactions))
+	}
+
+	for i, t := range traces {
+		if t.Error != "" {
+			return nil, errors.Errorf("failed to trace transaction %s: %s", block.Transactions[i].Hash, t.Error)
+		}
+		if t.TxHash == "" {
+			t.TxHash = block.Transactions[i].Hash
+		} else if t.TxHash != block.Transactions[i].Hash {
+			return nil, errors.Errorf("got trace of transaction %s for transaction %s", t.TxHash, block.Transactions[i].Hash)
+		}
+	}
+
+	return traces, nil
+}
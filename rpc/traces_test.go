@@ -0,0 +1,102 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/onrik/ethrpc"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTracesStageDisablesUnsupportedTracing(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		code         int
+		message      string
+		wantDisabled bool
+	}{
+		{"method not found", http.StatusOK, codeMethodNotFound, "the method debug_traceBlockByNumber does not exist", true},
+		{"method does not exist", http.StatusOK, -32000, "the method debug_traceBlockByNumber does not exist/is not available", true},
+		{"method not supported", http.StatusOK, -32000, "Method Not Supported", true},
+		{"forbidden", http.StatusForbidden, 0, "", true},
+		{"method not allowed", http.StatusMethodNotAllowed, 0, "", true},
+		{"other error", http.StatusOK, -32000, "execution timeout", false},
+		{"other status", http.StatusBadGateway, 0, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				if tt.status != http.StatusOK {
+					http.Error(w, http.StatusText(tt.status), tt.status)
+					return
+				}
+				_ = json.NewEncoder(w).Encode([]map[string]any{{
+					"jsonrpc": "2.0",
+					"id":      0,
+					"error":   map[string]any{"code": tt.code, "message": tt.message},
+				}})
+			}))
+			defer srv.Close()
+
+			s := NewTracesStage(srv.Client(), srv.URL, 1)
+			block := func(num int) *BlockData {
+				return &BlockData{Block: &ethrpc.Block{
+					Number:       num,
+					Hash:         blockHash(forkA, int64(num)),
+					Transactions: []ethrpc.Transaction{{Hash: blockHash(forkB, int64(num))}},
+				}}
+			}
+
+			err := s.Process(context.Background(), []*BlockData{block(1), block(2)})
+			if got := err != nil; got == tt.wantDisabled {
+				t.Fatalf("got error %v, want an error: %t", err, !tt.wantDisabled)
+			}
+			if s.Disabled() != tt.wantDisabled {
+				t.Errorf("got disabled %t, want %t", s.Disabled(), tt.wantDisabled)
+			}
+			if !tt.wantDisabled {
+				return
+			}
+
+			// Later batches are not traced anymore
+			calls.Store(0)
+			b := block(3)
+			if err := s.Process(context.Background(), []*BlockData{b}); err != nil {
+				t.Fatalf("failed to process: %v", err)
+			}
+			if n := calls.Load(); n != 0 {
+				t.Errorf("got %d calls after tracing was disabled, want none", n)
+			}
+			if b.Traces != nil {
+				t.Errorf("got traces %v, want none", b.Traces)
+			}
+		})
+	}
+}
+
+func TestInternalTransactionsStageStopsWithTracing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	traces := NewTracesStage(srv.Client(), srv.URL, 1)
+	// A nil repo fails the test if the stage stores anything
+	internal := NewInternalTransactionsStage(nil, nil, traces)
+	b := &BlockData{
+		Block: &ethrpc.Block{Number: 1, Hash: blockHash(forkA, 1), Transactions: []ethrpc.Transaction{{Hash: blockHash(forkB, 1)}}},
+	}
+
+	if err := NewPipeline(traces, internal).Process(context.Background(), []*BlockData{b}); err != nil {
+		t.Fatalf("failed to process: %v", err)
+	}
+	if !traces.Disabled() {
+		t.Errorf("tracing is still enabled after a 403")
+	}
+}
@@ -0,0 +1,57 @@
+package third_party
+
+import (
+	"encoding/json"
+	"github.com/onrik/ethrpc"
+	"math/big"
+	"unsafe"
+)
+
+// Receipt is a transaction receipt, including the fields
+// ethrpc.TransactionReceipt does not provide, like the effective gas price
+type Receipt struct {
+	TransactionHash   string
+	TransactionIndex  int
+	BlockHash         string
+	BlockNumber       int
+	From              string
+	To                string
+	CumulativeGasUsed int
+	GasUsed           int
+	EffectiveGasPrice big.Int
+	ContractAddress   string
+	Logs              []ethrpc.Log
+	LogsBloom         string
+	Status            string
+}
+
+// ProxyReceipt is a proxy for Receipt
+// Sourced from github.com/onrik/ethrpc
+type ProxyReceipt struct {
+	TransactionHash   string       `json:"transactionHash"`
+	TransactionIndex  hexInt       `json:"transactionIndex"`
+	BlockHash         string       `json:"blockHash"`
+	BlockNumber       hexInt       `json:"blockNumber"`
+	From              string       `json:"from"`
+	To                string       `json:"to"`
+	CumulativeGasUsed hexInt       `json:"cumulativeGasUsed"`
+	GasUsed           hexInt       `json:"gasUsed"`
+	EffectiveGasPrice hexBig       `json:"effectiveGasPrice"`
+	ContractAddress   string       `json:"contractAddress"`
+	Logs              []ethrpc.Log `json:"logs"`
+	LogsBloom         string       `json:"logsBloom"`
+	Status            string       `json:"status"`
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+// Sourced from github.com/onrik/ethrpc
+func (r *Receipt) UnmarshalJSON(data []byte) error {
+	proxy := new(ProxyReceipt)
+	if err := json.Unmarshal(data, proxy); err != nil {
+		return err
+	}
+
+	*r = *(*Receipt)(unsafe.Pointer(proxy))
+
+	return nil
+}
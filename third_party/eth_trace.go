@@ -0,0 +1,60 @@
+package third_party
+
+import (
+	"encoding/json"
+	"math/big"
+)
+
+// TxTrace is the call tree of a transaction returned by debug_traceBlockByNumber with the callTracer
+// Older nodes do not return the transaction hash, leaving the traces to be matched by position
+type TxTrace struct {
+	TxHash string    `json:"txHash"`
+	Result CallFrame `json:"result"`
+	Error  string    `json:"error"`
+}
+
+// CallFrame is a call of a call tree returned by the callTracer
+// Value is nil for the calls that cannot move value, like STATICCALL and DELEGATECALL
+type CallFrame struct {
+	Type    string
+	From    string
+	To      string
+	Value   *big.Int
+	Gas     int
+	GasUsed int
+	Error   string
+	Calls   []CallFrame
+}
+
+// ProxyCallFrame is a proxy for CallFrame
+type ProxyCallFrame struct {
+	Type    string      `json:"type"`
+	From    string      `json:"from"`
+	To      string      `json:"to"`
+	Value   *hexBig     `json:"value"`
+	Gas     hexInt      `json:"gas"`
+	GasUsed hexInt      `json:"gasUsed"`
+	Error   string      `json:"error"`
+	Calls   []CallFrame `json:"calls"`
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (f *CallFrame) UnmarshalJSON(data []byte) error {
+	proxy := new(ProxyCallFrame)
+	if err := json.Unmarshal(data, proxy); err != nil {
+		return err
+	}
+
+	*f = CallFrame{
+		Type:    proxy.Type,
+		From:    proxy.From,
+		To:      proxy.To,
+		Value:   (*big.Int)(proxy.Value),
+		Gas:     int(proxy.Gas),
+		GasUsed: int(proxy.GasUsed),
+		Error:   proxy.Error,
+		Calls:   proxy.Calls,
+	}
+
+	return nil
+}
@@ -1,5 +1,11 @@
 package third_party
 
+import (
+	"encoding/json"
+	"math/big"
+	"unsafe"
+)
+
 // ProxyTransaction is a proxy for ethrpc.Transaction
 // Sourced from github.com/onrik/ethrpc
 type ProxyTransaction struct {
@@ -15,3 +21,49 @@ type ProxyTransaction struct {
 	GasPrice         hexBig  `json:"gasPrice"`
 	Input            string  `json:"input"`
 }
+
+// AccessTuple is an entry of the access list of a typed transaction
+type AccessTuple struct {
+	Address     string   `json:"address"`
+	StorageKeys []string `json:"storageKeys"`
+}
+
+// TxEnvelope holds the fields of a signed transaction that ethrpc.Transaction does not provide,
+// needed to encode the transaction as it was included in its block
+// ChainID and the fee caps are nil for the transaction types that do not have them
+type TxEnvelope struct {
+	Hash                 string
+	Type                 int
+	ChainID              *big.Int
+	MaxFeePerGas         *big.Int
+	MaxPriorityFeePerGas *big.Int
+	AccessList           []AccessTuple
+	V                    string
+	R                    string
+	S                    string
+}
+
+// ProxyTxEnvelope is a proxy for TxEnvelope
+type ProxyTxEnvelope struct {
+	Hash                 string        `json:"hash"`
+	Type                 hexInt        `json:"type"`
+	ChainID              *hexBig       `json:"chainId"`
+	MaxFeePerGas         *hexBig       `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas *hexBig       `json:"maxPriorityFeePerGas"`
+	AccessList           []AccessTuple `json:"accessList"`
+	V                    string        `json:"v"`
+	R                    string        `json:"r"`
+	S                    string        `json:"s"`
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (e *TxEnvelope) UnmarshalJSON(data []byte) error {
+	proxy := new(ProxyTxEnvelope)
+	if err := json.Unmarshal(data, proxy); err != nil {
+		return err
+	}
+
+	*e = *(*TxEnvelope)(unsafe.Pointer(proxy))
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package trie
+
+import (
+	"avax-indexer/rlp"
+	"bytes"
+	"golang.org/x/crypto/sha3"
+	"sort"
+)
+
+// EmptyRoot is the root hash of an empty trie
+var EmptyRoot = Keccak256(rlp.Bytes(nil))
+
+// Keccak256 returns the Keccak-256 hash of the concatenated data
+func Keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// DeriveRoot returns the root hash of the trie keyed by the RLP encoded index of each value,
+// like the transactions and receipts tries of a block
+func DeriveRoot(values [][]byte) []byte {
+	keys := make([][]byte, len(values))
+	for i := range values {
+		keys[i] = rlp.Uint(uint64(i))
+	}
+	return Root(keys, values)
+}
+
+// Root returns the root hash of the Merkle Patricia trie holding the key value pairs
+// The keys must be unique and the values must not be empty
+func Root(keys [][]byte, values [][]byte) []byte {
+	if len(keys) == 0 {
+		return EmptyRoot
+	}
+
+	pairs := make([]pair, len(keys))
+	for i, k := range keys {
+		pairs[i] = pair{key: nibbles(k), value: values[i]}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].key, pairs[j].key) < 0
+	})
+
+	// The root node is hashed even when its encoding is shorter than a hash
+	return Keccak256(node(pairs, 0))
+}
+
+// pair is a key, split into nibbles, and its value
+type pair struct {
+	key   []byte
+	value []byte
+}
+
+// node returns the encoding of the node holding the pairs, sorted by key,
+// whose keys share their first depth nibbles
+func node(pairs []pair, depth int) []byte {
+	if len(pairs) == 1 {
+		return rlp.List(rlp.Bytes(compact(pairs[0].key[depth:], true)), rlp.Bytes(pairs[0].value))
+	}
+
+	// Being sorted, the first and last keys share the prefix common to all of them
+	first, last := pairs[0].key, pairs[len(pairs)-1].key
+	prefix := 0
+	for depth+prefix < len(first) && depth+prefix < len(last) && first[depth+prefix] == last[depth+prefix] {
+		prefix++
+	}
+	if prefix > 0 {
+		child := node(pairs, depth+prefix)
+		return rlp.List(rlp.Bytes(compact(first[depth:depth+prefix], false)), reference(child))
+	}
+
+	items := make([][]byte, 17)
+	var value []byte
+	start := 0
+	if len(first) == depth {
+		// Only the first key can end at the branch
+		value = pairs[0].value
+		start = 1
+	}
+	for nibble := byte(0); nibble < 16; nibble++ {
+		end := start
+		for end < len(pairs) && pairs[end].key[depth] == nibble {
+			end++
+		}
+		if end == start {
+			items[nibble] = rlp.Bytes(nil)
+			continue
+		}
+		items[nibble] = reference(node(pairs[start:end], depth+1))
+		start = end
+	}
+	items[16] = rlp.Bytes(value)
+
+	return rlp.List(items...)
+}
+
+// reference returns how a parent refers to a child node, embedding it
+// if its encoding is shorter than a hash and referring to it by hash otherwise
+func reference(encoded []byte) []byte {
+	if len(encoded) < 32 {
+		return encoded
+	}
+	return rlp.Bytes(Keccak256(encoded))
+}
+
+// nibbles splits a key into its 4 bit halves
+func nibbles(key []byte) []byte {
+	res := make([]byte, 0, len(key)*2)
+	for _, b := range key {
+		res = append(res, b>>4, b&0x0f)
+	}
+	return res
+}
+
+// compact encodes a path of nibbles with the hex prefix flagging leaves and odd lengths
+func compact(path []byte, leaf bool) []byte {
+	flag := byte(0)
+	if leaf {
+		flag = 2
+	}
+
+	res := make([]byte, 0, len(path)/2+1)
+	if len(path)%2 == 1 {
+		res = append(res, (flag+1)<<4|path[0])
+		path = path[1:]
+	} else {
+		res = append(res, flag<<4)
+	}
+	for i := 0; i < len(path); i += 2 {
+		res = append(res, path[i]<<4|path[i+1])
+	}
+	return res
+}
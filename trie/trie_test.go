@@ -0,0 +1,85 @@
+package trie
+
+import (
+	"avax-indexer/rlp"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestRoot(t *testing.T) {
+	tests := []struct {
+		name   string
+		keys   []string
+		values []string
+		want   string
+	}{
+		{
+			name: "empty",
+			want: "56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421",
+		},
+		{
+			name:   "single leaf",
+			keys:   []string{"A"},
+			values: []string{strings.Repeat("a", 50)},
+			want:   "d23786fb4a010da3ce639d66d5e904a11dbc02746d1ce25029e53290cabf28ab",
+		},
+		{
+			name:   "extension and branch",
+			keys:   []string{"doe", "dog", "dogglesworth"},
+			values: []string{"reindeer", "puppy", "cat"},
+			want:   "8aad789dff2f538bca5d8ea56e8abe10f4c7ba3a5dea95fea4cd6e7c3a1168d3",
+		},
+		{
+			name:   "insertion order",
+			keys:   []string{"dogglesworth", "doe", "dog"},
+			values: []string{"cat", "reindeer", "puppy"},
+			want:   "8aad789dff2f538bca5d8ea56e8abe10f4c7ba3a5dea95fea4cd6e7c3a1168d3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := make([][]byte, len(tt.keys))
+			values := make([][]byte, len(tt.values))
+			for i := range tt.keys {
+				keys[i], values[i] = []byte(tt.keys[i]), []byte(tt.values[i])
+			}
+			if got := hex.EncodeToString(Root(keys, values)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeriveRoot(t *testing.T) {
+	values := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	keys := [][]byte{rlp.Uint(0), rlp.Uint(1), rlp.Uint(2)}
+
+	if got, want := hex.EncodeToString(DeriveRoot(values)), hex.EncodeToString(Root(keys, values)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := hex.EncodeToString(DeriveRoot(nil)); got != hex.EncodeToString(EmptyRoot) {
+		t.Errorf("got %s for no values, want the empty root", got)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	tests := []struct {
+		path []byte
+		leaf bool
+		want string
+	}{
+		{[]byte{1, 2, 3, 4, 5}, false, "112345"},
+		{[]byte{0, 1, 2, 3, 4, 5}, false, "00012345"},
+		{[]byte{0, 15, 1, 12, 11, 8}, true, "200f1cb8"},
+		{[]byte{15, 1, 12, 11, 8}, true, "3f1cb8"},
+		{nil, true, "20"},
+	}
+
+	for _, tt := range tests {
+		if got := hex.EncodeToString(compact(tt.path, tt.leaf)); got != tt.want {
+			t.Errorf("compact(%x, %t): got %s, want %s", tt.path, tt.leaf, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package verify
+
+import (
+	"avax-indexer/db"
+	"avax-indexer/rlp"
+	"avax-indexer/trie"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// Transaction types with a known encoding
+const (
+	txLegacy     = 0
+	txAccessList = 1
+	txDynamicFee = 2
+)
+
+// errNoEnvelope is returned for transactions stored without their envelope fields,
+// whose encoding cannot be rebuilt
+var errNoEnvelope = errors.New("transaction was stored without its envelope fields")
+
+// transactionsRoot recomputes the transactions root of a block from its stored transactions
+// Every transaction must encode to its own hash, which points at the stored fields of
+// the failing transaction when the root does not match
+func transactionsRoot(b *db.Block) (string, error) {
+	txs := make([]db.Transaction, len(b.Transactions))
+	copy(txs, b.Transactions)
+	sort.SliceStable(txs, func(i, j int) bool {
+		return txs[i].TransactionIndex != nil && txs[j].TransactionIndex != nil &&
+			*txs[i].TransactionIndex < *txs[j].TransactionIndex
+	})
+
+	values := make([][]byte, len(txs))
+	for i := range txs {
+		enc, err := encodeTx(&txs[i])
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to encode transaction %s", txs[i].Hash)
+		}
+		if hash := "0x" + hex.EncodeToString(trie.Keccak256(enc)); !strings.EqualFold(hash, txs[i].Hash) {
+			return "", errors.Errorf("transaction %s encodes to hash %s", txs[i].Hash, hash)
+		}
+		values[i] = enc
+	}
+
+	return "0x" + hex.EncodeToString(trie.DeriveRoot(values)), nil
+}
+
+// encodeTx returns the encoding of a signed transaction as included in its block
+func encodeTx(t *db.Transaction) ([]byte, error) {
+	if t.V == "" {
+		return nil, errNoEnvelope
+	}
+
+	d := &decoder{}
+	nonce := rlp.Uint(uint64(t.Nonce))
+	gas := rlp.Uint(uint64(t.Gas))
+	to := rlp.Bytes(d.hexBytes(t.To))
+	value := rlp.BigInt(d.decimal(t.Value))
+	input := rlp.Bytes(d.hexBytes(t.Input))
+	v, r, s := rlp.BigInt(d.hexInt(t.V)), rlp.BigInt(d.hexInt(t.R)), rlp.BigInt(d.hexInt(t.S))
+
+	var enc []byte
+	switch t.Type {
+	case txLegacy:
+		enc = rlp.List(nonce, rlp.BigInt(d.decimal(t.GasPrice)), gas, to, value, input, v, r, s)
+	case txAccessList:
+		enc = append([]byte{txAccessList}, rlp.List(rlp.BigInt(d.decimal(t.ChainID)), nonce,
+			rlp.BigInt(d.decimal(t.GasPrice)), gas, to, value, input, d.accessList(t.AccessList), v, r, s)...)
+	case txDynamicFee:
+		enc = append([]byte{txDynamicFee}, rlp.List(rlp.BigInt(d.decimal(t.ChainID)), nonce,
+			rlp.BigInt(d.decimal(t.MaxPriorityFeePerGas)), rlp.BigInt(d.decimal(t.MaxFeePerGas)),
+			gas, to, value, input, d.accessList(t.AccessList), v, r, s)...)
+	default:
+		return nil, errors.Errorf("unsupported transaction type %d", t.Type)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return enc, nil
+}
+
+// decoder parses the stored string fields of a transaction, keeping the first error
+type decoder struct {
+	err error
+}
+
+func (d *decoder) decimal(s string) *big.Int {
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok && d.err == nil {
+		d.err = errors.Errorf("invalid decimal %q", s)
+	}
+	return i
+}
+
+func (d *decoder) hexInt(s string) *big.Int {
+	i, ok := new(big.Int).SetString(strings.TrimPrefix(s, "0x"), 16)
+	if !ok && d.err == nil {
+		d.err = errors.Errorf("invalid hex number %q", s)
+	}
+	return i
+}
+
+func (d *decoder) hexBytes(s string) []byte {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil && d.err == nil {
+		d.err = errors.Wrapf(err, "invalid hex string %q", s)
+	}
+	return b
+}
+
+func (d *decoder) accessList(list []db.AccessTuple) []byte {
+	tuples := make([][]byte, len(list))
+	for i, t := range list {
+		keys := make([][]byte, len(t.StorageKeys))
+		for j, k := range t.StorageKeys {
+			keys[j] = rlp.Bytes(d.hexBytes(k))
+		}
+		tuples[i] = rlp.List(rlp.Bytes(d.hexBytes(t.Address)), rlp.List(keys...))
+	}
+	return rlp.List(tuples...)
+}
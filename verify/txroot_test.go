@@ -0,0 +1,212 @@
+package verify
+
+import (
+	"avax-indexer/db"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// legacyTx is the only transaction of Ethereum mainnet block 46147
+var legacyTx = db.Transaction{
+	Hash:     "0x5c504ed432cb51138bcf09aa5e8a410dd4a1e204ef84bfed1be16dfba1b22060",
+	Nonce:    0,
+	To:       "0x5df9b87991262f6ba471f09758cde1c0fc1de734",
+	Value:    "31337",
+	Gas:      21000,
+	GasPrice: "50000000000000",
+	Input:    "0x",
+	V:        "0x1c",
+	R:        "0x88ff6cf0fefd94db46111149ae4bfc179e9b94721fffd821d38d16464b3f71d0",
+	S:        "0x45e0aff800961cfce805daef7016b9b675c137a6a41a548f7b60a3484c06a33a",
+}
+
+func TestEncodeTx(t *testing.T) {
+	tests := []struct {
+		name string
+		tx   db.Transaction
+		want string
+	}{
+		{
+			// The signed transaction of the EIP-155 example
+			name: "legacy with replay protection",
+			tx: db.Transaction{
+				Nonce:    9,
+				To:       "0x3535353535353535353535353535353535353535",
+				Value:    "1000000000000000000",
+				Gas:      21000,
+				GasPrice: "20000000000",
+				Input:    "0x",
+				V:        "0x25",
+				R:        "0x28ef61340bd939bc2195fe537567866003e1a15d3c71ff63e1590620aa636276",
+				S:        "0x67cbe9d8997f761aecb703304b3800ccf555c9f3dc64214b297fb1966a3b6d83",
+			},
+			want: "f86c098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a7640000" +
+				"8025a028ef61340bd939bc2195fe537567866003e1a15d3c71ff63e1590620aa636276" +
+				"a067cbe9d8997f761aecb703304b3800ccf555c9f3dc64214b297fb1966a3b6d83",
+		},
+		{
+			// The signed access list transaction of the go-ethereum EIP-2718 encoding test
+			name: "access list",
+			tx: db.Transaction{
+				Type:     txAccessList,
+				ChainID:  "1",
+				Nonce:    3,
+				To:       "0xb94f5374fce5edbc8e2a8697c15331677e6ebf0b",
+				Value:    "10",
+				Gas:      25000,
+				GasPrice: "1",
+				Input:    "0x5544",
+				V:        "0x1",
+				R:        "0xc9519f4f2b30335884581971573fadf60c6204f59a911df35ee8a540456b2660",
+				S:        "0x32f1e8e2c5dd761f9e4f88f41c8310aeaba26a8bfcdacfedfa12ec3862d37521",
+			},
+			want: "01f8630103018261a894b94f5374fce5edbc8e2a8697c15331677e6ebf0b0a825544c0" +
+				"01a0c9519f4f2b30335884581971573fadf60c6204f59a911df35ee8a540456b2660" +
+				"a032f1e8e2c5dd761f9e4f88f41c8310aeaba26a8bfcdacfedfa12ec3862d37521",
+		},
+		{
+			name: "dynamic fee with an access list",
+			tx: db.Transaction{
+				Type:                 txDynamicFee,
+				ChainID:              "43114",
+				Nonce:                3,
+				To:                   "0xb94f5374fce5edbc8e2a8697c15331677e6ebf0b",
+				Value:                "10",
+				Gas:                  25000,
+				MaxPriorityFeePerGas: "1",
+				MaxFeePerGas:         "2",
+				Input:                "0x5544",
+				AccessList: []db.AccessTuple{{
+					Address:     "0xb94f5374fce5edbc8e2a8697c15331677e6ebf0b",
+					StorageKeys: []string{"0x0000000000000000000000000000000000000000000000000000000000000001"},
+				}},
+				V: "0x1",
+				R: "0xc9519f4f2b30335884581971573fadf60c6204f59a911df35ee8a540456b2660",
+				S: "0x32f1e8e2c5dd761f9e4f88f41c8310aeaba26a8bfcdacfedfa12ec3862d37521",
+			},
+			want: "02f89f82a86a0301028261a894b94f5374fce5edbc8e2a8697c15331677e6ebf0b0a825544" +
+				"f838f794b94f5374fce5edbc8e2a8697c15331677e6ebf0b" +
+				"e1a00000000000000000000000000000000000000000000000000000000000000001" +
+				"01a0c9519f4f2b30335884581971573fadf60c6204f59a911df35ee8a540456b2660" +
+				"a032f1e8e2c5dd761f9e4f88f41c8310aeaba26a8bfcdacfedfa12ec3862d37521",
+		},
+		{
+			name: "contract creation",
+			tx: db.Transaction{
+				Nonce:    0,
+				Value:    "0",
+				Gas:      21000,
+				GasPrice: "1",
+				Input:    "0x00",
+				V:        "0x1b",
+				R:        "0x1",
+				S:        "0x2",
+			},
+			want: "cb80018252088080001b0102",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, err := encodeTx(&tt.tx)
+			if err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+			if got := hex.EncodeToString(enc); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransactionsRoot(t *testing.T) {
+	indexed := withIndex(legacyTx, 0)
+	upper := withIndex(legacyTx, 0)
+	upper.Hash = "0x" + strings.ToUpper(upper.Hash[2:])
+	tampered := withIndex(legacyTx, 0)
+	tampered.Value = "31338"
+	unindexed := withIndex(legacyTx, 0)
+	unindexed.V = ""
+
+	tests := []struct {
+		name    string
+		txs     []db.Transaction
+		want    string
+		wantErr string
+	}{
+		{
+			name: "no transactions",
+			want: "0x56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421",
+		},
+		{
+			// The published transactions root of Ethereum mainnet block 46147
+			name: "single legacy transaction",
+			txs:  []db.Transaction{indexed},
+			want: "0x4513310fcb9f6f616972a3b948dc5d547f280849a87ebb5af0191f98b87be598",
+		},
+		{
+			name: "hash in upper case",
+			txs:  []db.Transaction{upper},
+			want: "0x4513310fcb9f6f616972a3b948dc5d547f280849a87ebb5af0191f98b87be598",
+		},
+		{
+			name:    "field not matching the hash",
+			txs:     []db.Transaction{tampered},
+			wantErr: "encodes to hash",
+		},
+		{
+			name:    "missing envelope",
+			txs:     []db.Transaction{unindexed},
+			wantErr: errNoEnvelope.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := transactionsRoot(&db.Block{Transactions: tt.txs})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to compute the root: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransactionsRootOrder(t *testing.T) {
+	second := legacyTx
+	second.Hash = "0x33469b22e9f636356c4160a87eb19df52b7412e8eac32a4a55ffe88ea8350788"
+	second.Nonce = 9
+	second.To = "0x3535353535353535353535353535353535353535"
+	second.Value = "1000000000000000000"
+	second.GasPrice = "20000000000"
+	second.V = "0x25"
+	second.R = "0x28ef61340bd939bc2195fe537567866003e1a15d3c71ff63e1590620aa636276"
+	second.S = "0x67cbe9d8997f761aecb703304b3800ccf555c9f3dc64214b297fb1966a3b6d83"
+
+	ordered, err := transactionsRoot(&db.Block{Transactions: []db.Transaction{withIndex(legacyTx, 0), withIndex(second, 1)}})
+	if err != nil {
+		t.Fatalf("failed to compute the root: %v", err)
+	}
+	shuffled, err := transactionsRoot(&db.Block{Transactions: []db.Transaction{withIndex(second, 1), withIndex(legacyTx, 0)}})
+	if err != nil {
+		t.Fatalf("failed to compute the root: %v", err)
+	}
+	if ordered != shuffled {
+		t.Errorf("got %s for shuffled transactions, want %s", shuffled, ordered)
+	}
+}
+
+// withIndex returns a copy of the transaction at the given index in its block
+func withIndex(tx db.Transaction, i int) db.Transaction {
+	tx.TransactionIndex = &i
+	return tx
+}
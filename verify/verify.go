@@ -0,0 +1,187 @@
+package verify
+
+import (
+	"avax-indexer/db"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+)
+
+// window is the number of block numbers loaded and checked at once
+const window = 200
+
+// Issue kinds
+const (
+	KindGap            = "gap"
+	KindDuplicate      = "duplicate"
+	KindParentMismatch = "parent_mismatch"
+	KindTxMismatch     = "tx_mismatch"
+	KindTxRoot         = "transactions_root"
+)
+
+// Issue is a single integrity problem found in the stored blocks
+type Issue struct {
+	Kind   string `json:"kind"`
+	Number int64  `json:"number"`
+	Hash   string `json:"hash,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// Report is the result of verifying the stored blocks
+// Unchecked counts the blocks whose transactions root could not be recomputed,
+// because their transactions were stored without the envelope fields
+type Report struct {
+	From         int64   `json:"from"`
+	To           int64   `json:"to"`
+	Blocks       int     `json:"blocks"`
+	Transactions int     `json:"transactions"`
+	Unchecked    int     `json:"unchecked_roots"`
+	Issues       []Issue `json:"issues"`
+}
+
+// OK reports whether no issues were found
+func (r *Report) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// Numbers returns the distinct block numbers with issues, in ascending order
+func (r *Report) Numbers() []int64 {
+	numbers := make([]int64, 0, len(r.Issues))
+	seen := make(map[int64]bool, len(r.Issues))
+	for _, issue := range r.Issues {
+		if !seen[issue.Number] {
+			seen[issue.Number] = true
+			numbers = append(numbers, issue.Number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers
+}
+
+// Verify checks the blocks stored between the oldest and the newest stored block
+// Every number must be stored exactly once, and the parent hash of every block
+// must match the hash of the block stored right below it
+// The transactions of every block must refer to it, and hash to its transactions root
+func Verify(ctx context.Context, repo db.BlocksRepo) (*Report, error) {
+	first, err := repo.FirstHead(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get first head")
+	}
+	last, err := repo.LastHead(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get last head")
+	}
+
+	report := &Report{From: first, To: last, Issues: make([]Issue, 0)}
+	if last == 0 {
+		return report, nil
+	}
+
+	// prev holds the blocks stored at the number right below the one being checked
+	var prev []db.Block
+	for start := first; start <= last; start += window {
+		end := start + window - 1
+		if end > last {
+			end = last
+		}
+
+		byNumber, count, err := load(ctx, repo, start, end)
+		if err != nil {
+			return nil, err
+		}
+		report.Blocks += count
+
+		for num := start; num <= end; num++ {
+			curr := byNumber[num]
+			report.Issues = append(report.Issues, check(num, curr, prev)...)
+			for i := range curr {
+				report.Transactions += len(curr[i].Transactions)
+				issues, checked := checkTransactions(&curr[i])
+				report.Issues = append(report.Issues, issues...)
+				if !checked {
+					report.Unchecked++
+				}
+			}
+			prev = curr
+		}
+	}
+
+	return report, nil
+}
+
+// load returns the blocks stored in the inclusive range grouped by number, and their count
+func load(ctx context.Context, repo db.BlocksRepo, from int64, to int64) (map[int64][]db.Block, int, error) {
+	// Leave room for unresolved competing blocks, which are reported as duplicates
+	limit := int(to-from+1) * 4
+	blocks, err := repo.FindBlocks(ctx, db.BlockFilter{FromNumber: &from, ToNumber: &to}, limit)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to load blocks %d to %d", from, to)
+	}
+
+	byNumber := make(map[int64][]db.Block, to-from+1)
+	for _, b := range blocks {
+		byNumber[int64(b.Number)] = append(byNumber[int64(b.Number)], b)
+	}
+	return byNumber, len(blocks), nil
+}
+
+// check returns the issues of the blocks stored at the number,
+// given the blocks stored right below it
+func check(num int64, curr []db.Block, prev []db.Block) []Issue {
+	switch {
+	case len(curr) == 0:
+		return []Issue{{Kind: KindGap, Number: num, Detail: "no block stored"}}
+	case len(curr) > 1:
+		hashes := make([]string, len(curr))
+		for i, b := range curr {
+			hashes[i] = b.Hash
+		}
+		return []Issue{{Kind: KindDuplicate, Number: num, Detail: fmt.Sprintf("%d blocks stored: %v", len(curr), hashes)}}
+	case len(prev) == 1 && curr[0].ParentHash != prev[0].Hash:
+		return []Issue{{
+			Kind:   KindParentMismatch,
+			Number: num,
+			Hash:   curr[0].Hash,
+			Detail: fmt.Sprintf("parent hash %s does not match stored block %s", curr[0].ParentHash, prev[0].Hash),
+		}}
+	}
+	return nil
+}
+
+// checkTransactions returns the issues of the transactions embedded in a block
+// It reports whether the transactions root could be recomputed
+func checkTransactions(b *db.Block) ([]Issue, bool) {
+	issues := make([]Issue, 0)
+	for _, t := range b.Transactions {
+		if t.BlockHash != b.Hash || t.BlockNumber == nil || *t.BlockNumber != b.Number {
+			number := "none"
+			if t.BlockNumber != nil {
+				number = fmt.Sprint(*t.BlockNumber)
+			}
+			issues = append(issues, Issue{
+				Kind:   KindTxMismatch,
+				Number: int64(b.Number),
+				Hash:   b.Hash,
+				Detail: fmt.Sprintf("transaction %s refers to block %s at %s", t.Hash, t.BlockHash, number),
+			})
+		}
+	}
+
+	root, err := transactionsRoot(b)
+	if errors.Is(err, errNoEnvelope) {
+		return issues, false
+	}
+	if err != nil {
+		issues = append(issues, Issue{Kind: KindTxRoot, Number: int64(b.Number), Hash: b.Hash, Detail: err.Error()})
+	} else if !strings.EqualFold(root, b.TransactionsRoot) {
+		issues = append(issues, Issue{
+			Kind:   KindTxRoot,
+			Number: int64(b.Number),
+			Hash:   b.Hash,
+			Detail: fmt.Sprintf("transactions root %s does not match recomputed root %s", b.TransactionsRoot, root),
+		})
+	}
+	return issues, true
+}
@@ -1,6 +1,7 @@
 package ws
 
 import (
+	"avax-indexer/metrics"
 	"avax-indexer/model"
 	"avax-indexer/rpc"
 	"encoding/json"
@@ -9,86 +10,78 @@ import (
 	"github.com/pkg/errors"
 	"golang.org/x/exp/slog"
 	"math/big"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Listener is a service that listens to newHeads events
+const (
+	minReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff = 30 * time.Second
+
+	// pongWait is how long the connection may stay silent, answering no ping and sending no message,
+	// before it is considered lost
+	pongWait = 60 * time.Second
+	// pingPeriod is how often the connection is pinged, leaving time for the pong to arrive
+	pingPeriod = pongWait * 9 / 10
+	// writeWait is how long writing a ping may take
+	writeWait = 10 * time.Second
+)
+
+// Listener is a service that listens to newHeads events and queues them for processing
+// The connection is pinged periodically and considered lost when it stays silent for pongWait
+// If the connection drops, it reconnects with exponential backoff,
+// resubscribes and backfills the heads missed while disconnected
 type Listener struct {
-	indexer *rpc.Indexer
-	sck     *websocket.Conn
-	done    chan struct{}
+	host          string
+	queue         *rpc.HeadQueue
+	maxReconnects int
+
+	mu         sync.Mutex
+	sck        *websocket.Conn
+	subscribed bool
+	closing    atomic.Bool
+
+	done chan struct{}
 }
 
 // NewListener initializes a new Listener service
 // It dials the host and sets up the receiver goroutine
 // For each received message it tries to unmarshal it into a newHead
-// If successful, it starts a new goroutine to process the block
-func NewListener(host string, indexer *rpc.Indexer) *Listener {
+// If successful, it adds the head to the queue, waiting while the queue is full
+// maxReconnects is the number of consecutive failed reconnect attempts after which the listener gives up
+func NewListener(host string, queue *rpc.HeadQueue, maxReconnects int) (*Listener, error) {
 	// Create service
 	ws := &Listener{
-		done:    make(chan struct{}),
-		indexer: indexer,
+		host:          host,
+		queue:         queue,
+		maxReconnects: maxReconnects,
+		done:          make(chan struct{}),
 	}
 
 	// Dial target ETH ws host
-	c, _, err := websocket.DefaultDialer.Dial(host, nil)
-	if err != nil {
-		slog.Error("error while dialing websocket", "error", err)
+	if err := ws.dial(); err != nil {
+		return nil, err
 	}
-	slog.Info("connected to avax websocket feed", "host", host)
-
-	// Set connection
-	ws.sck = c
 
 	// Start listener goroutine
-	go func() {
-		defer close(ws.done)
-		for {
-			_, message, err := c.ReadMessage()
-			if err != nil {
-				if e := new(websocket.CloseError); errors.As(err, &e) {
-					if e.Code == websocket.CloseNormalClosure {
-						slog.Info("closed ws connection normally")
-						return
-					}
-				}
-				slog.Error("recv err", "error", err)
-				return
-			}
+	go ws.run()
 
-			var data model.WsResponse[model.NewHead]
-			if err := json.Unmarshal(message, &data); err != nil {
-				slog.Error("failed to unmarshal ws message", "error", err)
-				return
-			}
-
-			if data.Method != "eth_subscription" {
-				continue
-			}
-
-			bHash := data.Params.Result.Hash
-			num := new(big.Int)
-			fmt.Sscanf(data.Params.Result.Number, "0x%x", num)
-
-			// Start processing goroutine
-			go ws.indexer.ProcessBlock(bHash)
-			slog.Info("recv", "num", num, "hash", bHash)
-		}
-	}()
-
-	return ws
+	return ws, nil
 }
 
 // Subscribe sends a subscription request for newHeads to the websocket
+// The subscription is re-sent automatically after each reconnect
 func (ws *Listener) Subscribe() error {
-	slog.Info("subscribing to newHeads")
-	if err := ws.sck.WriteMessage(websocket.TextMessage, []byte(`{"id":1,"jsonrpc":"2.0","method":"eth_subscribe","params":["newHeads"]}`)); err != nil {
-		return errors.Wrap(err, "failed to subscribe to newHeads")
-	}
-	return nil
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.subscribed = true
+	return ws.subscribe()
 }
 
 // Done returns a channel that is closed when the websocket connection is closed
+// and the listener has given up reconnecting
 func (ws *Listener) Done() <-chan struct{} {
 	return ws.done
 }
@@ -96,10 +89,13 @@ func (ws *Listener) Done() <-chan struct{} {
 // GraceClose gracefully closes the websocket connection
 func (ws *Listener) GraceClose() error {
 	slog.Info("gracefully closing ws connection")
+	ws.closing.Store(true)
 
 	// Cleanly close the connection by sending a close message and then
 	// waiting (with timeout) for the server to close the connection.
+	ws.mu.Lock()
 	err := ws.sck.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	ws.mu.Unlock()
 	if err != nil {
 		return errors.Wrap(err, "failed to write close message")
 	}
@@ -111,3 +107,185 @@ func (ws *Listener) GraceClose() error {
 
 	return nil
 }
+
+// dial connects to the websocket host and replaces the current connection
+func (ws *Listener) dial() error {
+	c, _, err := websocket.DefaultDialer.Dial(ws.host, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to dial websocket")
+	}
+	slog.Info("connected to avax websocket feed", "host", ws.host)
+	metrics.WsConnected.Set(1)
+
+	ws.mu.Lock()
+	ws.sck = c
+	ws.mu.Unlock()
+
+	return nil
+}
+
+// subscribe writes the newHeads subscription request
+// The caller must hold ws.mu
+func (ws *Listener) subscribe() error {
+	slog.Info("subscribing to newHeads")
+	if err := ws.sck.WriteMessage(websocket.TextMessage, []byte(`{"id":1,"jsonrpc":"2.0","method":"eth_subscribe","params":["newHeads"]}`)); err != nil {
+		return errors.Wrap(err, "failed to subscribe to newHeads")
+	}
+	return nil
+}
+
+// run reads messages until the connection is closed normally,
+// reconnecting whenever the connection is lost
+func (ws *Listener) run() {
+	defer close(ws.done)
+	for {
+		err := ws.read()
+		metrics.WsConnected.Set(0)
+		if err == nil || ws.closing.Load() {
+			return
+		}
+		slog.Error("lost ws connection", "error", err)
+
+		if err := ws.reconnect(); err != nil {
+			slog.Error("giving up on ws connection", "error", err)
+			return
+		}
+	}
+}
+
+// read processes messages from the current connection while pinging it
+// Every message and pong extends the read deadline, so a silent connection fails the read
+// The deadline is extended again once a head is queued, so waiting on a full queue does not fail the read
+// It returns nil if the connection was closed normally
+func (ws *Listener) read() error {
+	ws.mu.Lock()
+	c := ws.sck
+	ws.mu.Unlock()
+
+	extend := func(string) error {
+		return c.SetReadDeadline(time.Now().Add(pongWait))
+	}
+	if err := extend(""); err != nil {
+		return errors.Wrap(err, "failed to set ws read deadline")
+	}
+	c.SetPongHandler(extend)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go ping(c, stop)
+
+	for {
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			if e := new(websocket.CloseError); errors.As(err, &e) {
+				if e.Code == websocket.CloseNormalClosure {
+					slog.Info("closed ws connection normally")
+					return nil
+				}
+			}
+			return errors.Wrap(err, "failed to read ws message")
+		}
+		if err := extend(""); err != nil {
+			return errors.Wrap(err, "failed to set ws read deadline")
+		}
+
+		var data model.WsResponse[model.NewHead]
+		if err := json.Unmarshal(message, &data); err != nil {
+			slog.Error("failed to unmarshal ws message; skipping", "error", err)
+			continue
+		}
+
+		if data.Method != "eth_subscription" {
+			continue
+		}
+
+		bHash := data.Params.Result.Hash
+		num := new(big.Int)
+		fmt.Sscanf(data.Params.Result.Number, "0x%x", num)
+
+		metrics.WsBlocksReceived.Inc()
+		metrics.SetChainHead(num.Int64())
+
+		slog.Info("recv", "num", num, "hash", bHash)
+		ws.queue.Enqueue(bHash, num.Int64())
+
+		// Enqueue waits while the queue is full, which may take longer than pongWait
+		// The connection was not read meanwhile, so the wait does not count as silence
+		if err := extend(""); err != nil {
+			return errors.Wrap(err, "failed to set ws read deadline")
+		}
+	}
+}
+
+// ping pings the connection every pingPeriod until stop is closed
+// A failed ping is left to the read deadline to detect
+func ping(c *websocket.Conn, stop <-chan struct{}) {
+	t := time.NewTicker(pingPeriod)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			// WriteControl may be called concurrently with the other writes
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				slog.Warn("failed to ping ws connection", "error", err)
+			}
+		}
+	}
+}
+
+// reconnect closes the lost connection and dials the host with exponential backoff until it succeeds
+// or the configured number of attempts is exhausted
+// After reconnecting it resubscribes and backfills the missed heads
+func (ws *Listener) reconnect() error {
+	ws.mu.Lock()
+	_ = ws.sck.Close()
+	ws.mu.Unlock()
+
+	backoff := minReconnectBackoff
+	for attempt := 1; attempt <= ws.maxReconnects; attempt++ {
+		slog.Warn("reconnecting to ws", "attempt", attempt, "max_attempts", ws.maxReconnects, "backoff", backoff)
+		metrics.WsReconnects.Inc()
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+
+		if ws.closing.Load() {
+			return errors.New("listener is closing")
+		}
+
+		if err := ws.dial(); err != nil {
+			slog.Error("failed to reconnect to ws", "attempt", attempt, "error", err)
+			continue
+		}
+
+		ws.mu.Lock()
+		var err error
+		if ws.subscribed {
+			err = ws.subscribe()
+			if err != nil {
+				_ = ws.sck.Close()
+			}
+		}
+		ws.mu.Unlock()
+		if err != nil {
+			slog.Error("failed to resubscribe to newHeads", "attempt", attempt, "error", err)
+			continue
+		}
+
+		go func() {
+			if err := ws.queue.Backfill(); err != nil {
+				slog.Error("failed to backfill missed heads", "error", err)
+			}
+		}()
+
+		return nil
+	}
+
+	return errors.Errorf("failed to reconnect after %d attempts", ws.maxReconnects)
+}